@@ -0,0 +1,192 @@
+package backup
+
+// A backup is a gzipped tarball holding a snapshot of the database, every file
+// under the repos directory, and a manifest listing all of them with their
+// checksums. The manifest is the last entry since it's only complete once
+// everything else has been written.
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"subscribe-bot/config"
+	"subscribe-bot/repo"
+)
+
+const (
+	FORMAT_VERSION = 1
+
+	MANIFEST_NAME = "manifest.json"
+	DB_NAME       = "db.bolt"
+	REPOS_DIR     = "repos"
+)
+
+type Manifest struct {
+	FormatVersion int       `json:"format_version"`
+	CreatedAt     time.Time `json:"created_at"`
+	BotVersion    string    `json:"bot_version"`
+	// Storage backend the repositories were written by
+	Storage string `json:"storage"`
+	Files   []File `json:"files"`
+}
+
+type File struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type archiveWriter struct {
+	tar      *tar.Writer
+	manifest Manifest
+}
+
+// Add a regular file to the archive and record it in the manifest. write must
+// produce exactly size bytes.
+func (aw *archiveWriter) add(name string, size int64, modTime time.Time, write func(io.Writer) error) (err error) {
+	err = aw.tar.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return
+	}
+
+	hash := sha256.New()
+	err = write(io.MultiWriter(aw.tar, hash))
+	if err != nil {
+		err = fmt.Errorf("couldn't write %s: %w", name, err)
+		return
+	}
+
+	aw.manifest.Files = append(aw.manifest.Files, File{
+		Path:   name,
+		Size:   size,
+		SHA256: fmt.Sprintf("%x", hash.Sum(nil)),
+	})
+	return
+}
+
+// Copy every file under the repos directory. Writes to the repositories have
+// to be held off until this is done.
+func (aw *archiveWriter) addRepos(reposDir string) (err error) {
+	return filepath.Walk(reposDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(reposDir, filePath)
+		if err != nil {
+			return err
+		}
+		name := path.Join(REPOS_DIR, filepath.ToSlash(rel))
+
+		if info.IsDir() {
+			return aw.tar.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     name + "/",
+				Mode:     0755,
+				ModTime:  info.ModTime(),
+			})
+		} else if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		return aw.add(name, info.Size(), info.ModTime(), func(w io.Writer) error {
+			file, err := os.Open(filePath)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			_, err = io.Copy(w, file)
+			return err
+		})
+	})
+}
+
+// Write a full backup of the database and every repository to w. This is
+// safe to run while the bot is running.
+func Write(w io.Writer, database *bolt.DB, repos repo.Backend, config *config.Config, version string) (err error) {
+	storage := config.Storage
+	if storage == "" {
+		storage = repo.BACKEND_DIR
+	}
+
+	gz := gzip.NewWriter(w)
+	aw := &archiveWriter{
+		tar: tar.NewWriter(gz),
+		manifest: Manifest{
+			FormatVersion: FORMAT_VERSION,
+			CreatedAt:     time.Now().UTC(),
+			BotVersion:    version,
+			Storage:       storage,
+		},
+	}
+
+	// the repositories are frozen before the database snapshot is taken, so
+	// they can't end up behind what the database says about them
+	unfreeze := repos.Freeze()
+	defer unfreeze()
+
+	err = database.View(func(tx *bolt.Tx) error {
+		return aw.add(DB_NAME, tx.Size(), aw.manifest.CreatedAt, func(w io.Writer) error {
+			_, err := tx.WriteTo(w)
+			return err
+		})
+	})
+	if err != nil {
+		err = fmt.Errorf("couldn't back up database: %w", err)
+		return
+	}
+
+	err = aw.addRepos(config.Repos)
+	if err != nil {
+		err = fmt.Errorf("couldn't back up repositories: %w", err)
+		return
+	}
+
+	manifest, err := json.MarshalIndent(&aw.manifest, "", "  ")
+	if err != nil {
+		return
+	}
+	err = aw.tar.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     MANIFEST_NAME,
+		Size:     int64(len(manifest)),
+		Mode:     0644,
+		ModTime:  aw.manifest.CreatedAt,
+	})
+	if err != nil {
+		return
+	}
+	_, err = aw.tar.Write(manifest)
+	if err != nil {
+		return
+	}
+
+	err = aw.tar.Close()
+	if err != nil {
+		return
+	}
+
+	return gz.Close()
+}
+
+// Name to give a backup made at the given time
+func FileName(when time.Time) string {
+	return fmt.Sprintf("subscribe-bot-backup-%s.tar.gz", when.UTC().Format("20060102-150405"))
+}
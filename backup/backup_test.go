@@ -0,0 +1,99 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+
+	"subscribe-bot/repo"
+)
+
+// A backend that runs a write to the database as it's frozen, like a snapshot
+// that was still finishing up
+type freezeWriter struct {
+	repo.Backend
+	database *bolt.DB
+}
+
+func (backend freezeWriter) Freeze() (unfreeze func()) {
+	err := backend.database.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("test"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("announced"), []byte("yes"))
+	})
+	if err != nil {
+		panic(err)
+	}
+	return backend.Backend.Freeze()
+}
+
+func TestWriteFreezesFirst(t *testing.T) {
+	config := testConfig(t)
+	database, err := bolt.Open(config.DatabasePath, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	repos, err := repo.NewDirBackend(config.Repos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repos.OpenOrInit(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	err = Write(&archive, database, freezeWriter{repos, database}, config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gz, err := gzip.NewReader(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	dbPath := filepath.Join(t.TempDir(), "db.bolt")
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			t.Fatal("backup has no database")
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if header.Name != DB_NAME {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err == nil {
+			err = ioutil.WriteFile(dbPath, data, 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+
+	backedUp, err := bolt.Open(dbPath, 0644, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backedUp.Close()
+	backedUp.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("test"))
+		if bucket == nil || bucket.Get([]byte("announced")) == nil {
+			t.Error("the database was backed up before the repositories were frozen")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,267 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"subscribe-bot/config"
+	"subscribe-bot/repo"
+)
+
+var (
+	ErrInvalid = errors.New("invalid backup")
+	ErrInUse   = errors.New("database is in use, stop the bot before restoring")
+)
+
+// Where an archive is being unpacked before it's installed
+type staging struct {
+	db    string
+	repos string
+	// what was actually found in the archive, to check against the manifest
+	files    map[string]File
+	manifest *Manifest
+}
+
+// Check that an entry name can't escape the staging directories
+func cleanName(name string) (clean string, ok bool) {
+	clean = strings.TrimSuffix(name, "/")
+	ok = clean != "" && clean == path.Clean(clean) && !path.IsAbs(clean) &&
+		clean != ".." && !strings.HasPrefix(clean, "../")
+	return
+}
+
+func (st *staging) extract(header *tar.Header, r io.Reader) (err error) {
+	name, ok := cleanName(header.Name)
+	if !ok {
+		return fmt.Errorf("%w: bad entry name %q", ErrInvalid, header.Name)
+	}
+
+	if name == MANIFEST_NAME {
+		st.manifest = &Manifest{}
+		err = json.NewDecoder(r).Decode(st.manifest)
+		if err != nil {
+			err = fmt.Errorf("%w: couldn't parse manifest: %s", ErrInvalid, err)
+		}
+		return
+	}
+
+	var dest string
+	if name == DB_NAME {
+		dest = st.db
+	} else if strings.HasPrefix(name, REPOS_DIR+"/") {
+		dest = filepath.Join(st.repos, filepath.FromSlash(strings.TrimPrefix(name, REPOS_DIR+"/")))
+	} else if name == REPOS_DIR && header.Typeflag == tar.TypeDir {
+		return
+	} else {
+		return fmt.Errorf("%w: unexpected entry %q", ErrInvalid, header.Name)
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(dest, 0755)
+	case tar.TypeReg:
+	default:
+		return fmt.Errorf("%w: %q isn't a regular file", ErrInvalid, header.Name)
+	}
+
+	if _, seen := st.files[name]; seen {
+		return fmt.Errorf("%w: %q appears twice", ErrInvalid, header.Name)
+	}
+
+	err = os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return
+	}
+
+	file, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), r)
+	if err != nil {
+		err = fmt.Errorf("couldn't extract %s: %w", name, err)
+		return
+	}
+
+	st.files[name] = File{
+		Path:   name,
+		Size:   size,
+		SHA256: fmt.Sprintf("%x", hash.Sum(nil)),
+	}
+	return
+}
+
+// Make sure the archive holds exactly what its manifest says, and that the
+// database inside it is intact
+func (st *staging) validate(storage string) (err error) {
+	if st.manifest == nil {
+		return fmt.Errorf("%w: no manifest", ErrInvalid)
+	}
+	manifest := st.manifest
+	if manifest.FormatVersion != FORMAT_VERSION {
+		return fmt.Errorf("%w: unsupported format version %d", ErrInvalid, manifest.FormatVersion)
+	}
+	if manifest.Storage != storage {
+		return fmt.Errorf("%w: repositories were backed up from %q storage but the config uses %q", ErrInvalid, manifest.Storage, storage)
+	}
+
+	listed := make(map[string]bool)
+	for _, expected := range manifest.Files {
+		listed[expected.Path] = true
+		found, ok := st.files[expected.Path]
+		if !ok {
+			return fmt.Errorf("%w: %s is missing", ErrInvalid, expected.Path)
+		}
+		if found != expected {
+			return fmt.Errorf("%w: %s doesn't match its checksum", ErrInvalid, expected.Path)
+		}
+	}
+	for name := range st.files {
+		if !listed[name] {
+			return fmt.Errorf("%w: %s isn't in the manifest", ErrInvalid, name)
+		}
+	}
+	if !listed[DB_NAME] {
+		return fmt.Errorf("%w: no database", ErrInvalid)
+	}
+
+	db, err := bolt.Open(st.db, 0644, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("%w: couldn't open database: %s", ErrInvalid, err)
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			return fmt.Errorf("%w: database is corrupt: %s", ErrInvalid, err)
+		}
+		return nil
+	})
+}
+
+// Move whatever is at target out of the way, then put src in its place
+func install(src string, target string, suffix string) (err error) {
+	_, err = os.Stat(target)
+	if err == nil {
+		err = os.Rename(target, target+suffix)
+		if err != nil {
+			return
+		}
+	} else if !os.IsNotExist(err) {
+		return
+	}
+
+	return os.Rename(src, target)
+}
+
+// Unpack a backup next to the configured database and repos directory, check
+// it against its manifest, and only then move it into place. Whatever was
+// there before is kept alongside with a .pre-restore suffix. The bot must not
+// be running.
+func Restore(r io.Reader, config *config.Config) (manifest Manifest, err error) {
+	storage := config.Storage
+	if storage == "" {
+		storage = repo.BACKEND_DIR
+	}
+	dbPath := filepath.Clean(config.DatabasePath)
+	reposPath := filepath.Clean(config.Repos)
+
+	// bolt only allows one process to have the database open
+	_, err = os.Stat(dbPath)
+	if err == nil {
+		var current *bolt.DB
+		current, err = bolt.Open(dbPath, 0644, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+		if err == bolt.ErrTimeout {
+			err = ErrInUse
+			return
+		} else if err != nil {
+			return
+		}
+		current.Close()
+	} else if !os.IsNotExist(err) {
+		return
+	}
+
+	// stage on the same filesystems as the targets, so installing is a rename
+	dbFile, err := ioutil.TempFile(filepath.Dir(dbPath), ".restore-db")
+	if err != nil {
+		return
+	}
+	dbFile.Close()
+	defer os.Remove(dbFile.Name())
+
+	reposDir, err := ioutil.TempDir(filepath.Dir(reposPath), ".restore-repos")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(reposDir)
+
+	st := &staging{
+		db:    dbFile.Name(),
+		repos: reposDir,
+		files: make(map[string]File),
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", ErrInvalid, err)
+		return
+	}
+	ar := tar.NewReader(gz)
+	for {
+		var header *tar.Header
+		header, err = ar.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			err = fmt.Errorf("%w: %s", ErrInvalid, err)
+			return
+		}
+
+		err = st.extract(header, ar)
+		if err != nil {
+			return
+		}
+	}
+
+	err = st.validate(storage)
+	if err != nil {
+		return
+	}
+	manifest = *st.manifest
+
+	err = os.Chmod(reposDir, 0755)
+	if err != nil {
+		return
+	}
+
+	suffix := fmt.Sprintf(".pre-restore-%d", time.Now().Unix())
+	err = install(st.db, dbPath, suffix)
+	if err != nil {
+		err = fmt.Errorf("couldn't install database: %w", err)
+		return
+	}
+	err = install(reposDir, reposPath, suffix)
+	if err != nil {
+		err = fmt.Errorf("database was restored but the repositories couldn't be installed: %w", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,269 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+	bolt "go.etcd.io/bbolt"
+
+	"subscribe-bot/config"
+	"subscribe-bot/repo"
+)
+
+type entry struct {
+	name     string
+	typeflag byte
+	body     []byte
+}
+
+// Build a backup archive out of entries, followed by a manifest if there is
+// one
+func buildArchive(t *testing.T, entries []entry, manifest *Manifest) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	write := func(e entry) {
+		if e.typeflag == 0 {
+			e.typeflag = tar.TypeReg
+		}
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: e.typeflag,
+			Name:     e.name,
+			Size:     int64(len(e.body)),
+			Mode:     0644,
+		})
+		if err == nil {
+			_, err = tw.Write(e.body)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, e := range entries {
+		write(e)
+	}
+	if manifest != nil {
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(entry{name: MANIFEST_NAME, body: data})
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func fileOf(name string, body []byte) File {
+	return File{Path: name, Size: int64(len(body)), SHA256: fmt.Sprintf("%x", sha256.Sum256(body))}
+}
+
+func testConfig(t *testing.T) *config.Config {
+	dir := t.TempDir()
+	return &config.Config{
+		DatabasePath: filepath.Join(dir, "db.bolt"),
+		Repos:        filepath.Join(dir, "repos"),
+	}
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	db := []byte("not really a database")
+	osu := []byte("osu file format v14")
+	manifest := func(files ...File) *Manifest {
+		return &Manifest{FormatVersion: FORMAT_VERSION, Storage: repo.BACKEND_DIR, Files: files}
+	}
+
+	tests := []struct {
+		name     string
+		entries  []entry
+		manifest *Manifest
+	}{
+		{"escaping name", []entry{{name: "../db.bolt", body: db}}, manifest(fileOf("../db.bolt", db))},
+		{"escaping repo", []entry{{name: "repos/../../evil", body: osu}}, manifest()},
+		{"absolute name", []entry{{name: "/etc/passwd", body: osu}}, manifest()},
+		{"unclean name", []entry{{name: "repos//sets/1.osu", body: osu}}, manifest()},
+		{"unexpected entry", []entry{{name: "other.txt", body: osu}}, manifest()},
+		{"symlink", []entry{{name: "repos/link", typeflag: tar.TypeSymlink}}, manifest()},
+		{"duplicate entry", []entry{{name: DB_NAME, body: db}, {name: DB_NAME, body: db}}, manifest(fileOf(DB_NAME, db))},
+		{"missing manifest", []entry{{name: DB_NAME, body: db}}, nil},
+		{
+			"unsupported version",
+			[]entry{{name: DB_NAME, body: db}},
+			&Manifest{FormatVersion: FORMAT_VERSION + 1, Storage: repo.BACKEND_DIR, Files: []File{fileOf(DB_NAME, db)}},
+		},
+		{
+			"other storage",
+			[]entry{{name: DB_NAME, body: db}},
+			&Manifest{FormatVersion: FORMAT_VERSION, Storage: repo.BACKEND_PACKED, Files: []File{fileOf(DB_NAME, db)}},
+		},
+		{
+			"checksum mismatch",
+			[]entry{{name: DB_NAME, body: db}, {name: "repos/sets/1/1.osu", body: osu}},
+			manifest(fileOf(DB_NAME, db), fileOf("repos/sets/1/1.osu", []byte("something else"))),
+		},
+		{
+			"missing file",
+			[]entry{{name: DB_NAME, body: db}},
+			manifest(fileOf(DB_NAME, db), fileOf("repos/sets/1/1.osu", osu)),
+		},
+		{
+			"file not in the manifest",
+			[]entry{{name: DB_NAME, body: db}, {name: "repos/sets/1/1.osu", body: osu}},
+			manifest(fileOf(DB_NAME, db)),
+		},
+		{"no database", []entry{{name: "repos/sets/1/1.osu", body: osu}}, manifest(fileOf("repos/sets/1/1.osu", osu))},
+		{"corrupt database", []entry{{name: DB_NAME, body: db}}, manifest(fileOf(DB_NAME, db))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig(t)
+			archive := buildArchive(t, test.entries, test.manifest)
+
+			_, err := Restore(bytes.NewReader(archive), config)
+			if !errors.Is(err, ErrInvalid) {
+				t.Fatalf("expected ErrInvalid, got %v", err)
+			}
+
+			// nothing gets installed, and nothing is left lying around
+			leftovers, err := ioutil.ReadDir(filepath.Dir(config.DatabasePath))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, info := range leftovers {
+				t.Errorf("%s was left behind", info.Name())
+			}
+		})
+	}
+
+	t.Run("not gzipped", func(t *testing.T) {
+		_, err := Restore(bytes.NewReader([]byte("plain text")), testConfig(t))
+		if !errors.Is(err, ErrInvalid) {
+			t.Errorf("expected ErrInvalid, got %v", err)
+		}
+	})
+}
+
+func TestRoundTrip(t *testing.T) {
+	source := testConfig(t)
+	database, err := bolt.Open(source.DatabasePath, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	err = database.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("test"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("key"), []byte("value"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repos, err := repo.NewDirBackend(source.Repos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := repos.OpenOrInit(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := t.TempDir()
+	err = ioutil.WriteFile(filepath.Join(src, "1.osu"), []byte("osu file format v14"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err := r.Snapshot(src, &repo.SnapshotOptions{
+		Subject:   "Update",
+		Author:    object.Signature{Name: "mapper", When: time.Unix(1600000000, 0)},
+		Committer: object.Signature{Name: "subscribe-bot", When: time.Unix(1600000000, 0)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	err = Write(&archive, database, repos, source, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := testConfig(t)
+	previousDb, err := bolt.Open(target.DatabasePath, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousDb.Close()
+	manifest, err := Restore(bytes.NewReader(archive.Bytes()), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.BotVersion != "test" || manifest.Storage != repo.BACKEND_DIR {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+
+	restored, err := bolt.Open(target.DatabasePath, 0644, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	restored.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("test"))
+		if bucket == nil || string(bucket.Get([]byte("key"))) != "value" {
+			t.Error("database wasn't restored")
+		}
+		return nil
+	})
+
+	restoredRepos, err := repo.NewDirBackend(target.Repos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoredRepo, err := restoredRepos.Open(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revs, err := restoredRepo.Log(1)
+	if err != nil || len(revs) != 1 || revs[0].Hash != rev.Hash {
+		t.Errorf("expected the repository to end at %s, got %v (%v)", rev.Hash, revs, err)
+	}
+
+	previous, err := filepath.Glob(target.DatabasePath + ".pre-restore-*")
+	if err != nil || len(previous) != 1 {
+		t.Errorf("expected the previous database to be kept, found %v (%v)", previous, err)
+	}
+}
+
+func TestRestoreInUse(t *testing.T) {
+	config := testConfig(t)
+	database, err := bolt.Open(config.DatabasePath, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	_, err = Restore(bytes.NewReader(nil), config)
+	if !errors.Is(err, ErrInUse) {
+		t.Errorf("expected ErrInUse, got %v", err)
+	}
+}
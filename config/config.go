@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
@@ -13,9 +14,31 @@ type Config struct {
 	BotToken     string `toml:"bot_token"`
 	Repos        string `toml:"repos"`
 	DatabasePath string `toml:"db_path"`
+	// How repositories are stored under Repos, either "dir" (the default)
+	// or "packed"
+	Storage string `toml:"storage,omitempty"`
+	// Download whole mapsets to keep their audio, backgrounds and storyboards
+	// along with the difficulties
+	ArchiveAssets bool `toml:"archive_assets,omitempty"`
+	// Save every API response under this directory, to replay them with
+	// dry-run later
+	RecordApi string `toml:"record_api,omitempty"`
 
-	Oauth OauthConfig `toml:"oauth"`
-	Web   WebConfig   `toml:"web"`
+	Oauth       OauthConfig       `toml:"oauth"`
+	Web         WebConfig         `toml:"web"`
+	Maintenance MaintenanceConfig `toml:"maintenance"`
+	Scraper     ScraperConfig     `toml:"scraper"`
+	Leader      LeaderConfig      `toml:"leader"`
+}
+
+// A duration written as a string like "90s" or "24h"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return
 }
 
 type OauthConfig struct {
@@ -28,6 +51,52 @@ type WebConfig struct {
 	Port          int    `toml:"port"`
 	ServedAt      string `toml:"served_at"`
 	SessionSecret string `toml:"session_secret"`
+
+	// Allow cloning map repositories over git's smart HTTP protocol
+	GitHttp bool `toml:"git_http,omitempty"`
+	// Git requests allowed per minute from a single client, defaults to 30
+	GitRateLimit int `toml:"git_rate_limit,omitempty"`
+	// Mappers whose repositories shouldn't be served at all
+	OptOutMappers []int `toml:"opt_out_mappers,omitempty"`
+	// osu! user ids allowed to use the admin pages once logged in
+	Admins []int `toml:"admins,omitempty"`
+}
+
+type MaintenanceConfig struct {
+	// How often to run maintenance, 0 disables it
+	Interval Duration `toml:"interval,omitempty"`
+	// Revisions to keep for graveyarded maps, 0 keeps everything
+	GraveyardRevisions int `toml:"graveyard_revisions,omitempty"`
+	// Revisions to keep for any other map, 0 keeps everything
+	MaxRevisions int `toml:"max_revisions,omitempty"`
+}
+
+type ScraperConfig struct {
+	// How often to scrape, defaults to 30 seconds
+	Interval Duration `toml:"interval,omitempty"`
+	// Each wait between scrapes is randomly up to this much shorter or longer
+	Jitter Duration `toml:"jitter,omitempty"`
+	// How far back to catch up on updates missed while the bot was down,
+	// defaults to 24 hours
+	MaxLookback Duration `toml:"max_lookback,omitempty"`
+	// How to find updates: "search" (the default) follows the global searches,
+	// "activity" polls each tracked mapper's recent activity instead, and
+	// "both" polls activity alongside the searches to catch what they miss
+	Strategy string `toml:"strategy,omitempty"`
+	// How many mappers' activity feeds to poll a minute, defaults to 120
+	ActivityPerMinute int `toml:"activity_per_minute,omitempty"`
+	// How many updates to work on at once, defaults to 4
+	Workers int `toml:"workers,omitempty"`
+}
+
+type LeaderConfig struct {
+	// Lease file on storage shared by every instance, leaving it out runs a
+	// single instance that always leads
+	LeasePath string `toml:"lease_path,omitempty"`
+	// How long the lease lasts without being renewed, defaults to 30 seconds
+	Ttl Duration `toml:"ttl,omitempty"`
+	// Name of this instance, defaults to its hostname and pid
+	ID string `toml:"id,omitempty"`
 }
 
 func ReadConfig(path string) (config Config, err error) {
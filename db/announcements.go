@@ -0,0 +1,259 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The latest announcement of a mapset in a channel, used to coalesce updates
+// that come in quick succession
+type Announcement struct {
+	// Latest revision announced
+	Hash string `json:"hash"`
+	// Revision the announcement's diff starts from, empty if it couldn't be
+	// coalesced with anything
+	Base string `json:"base,omitempty"`
+	// When the first update covered by the announcement came in
+	WindowStart time.Time `json:"window_start"`
+	// How many updates the announcement covers
+	Count int `json:"count"`
+
+	// Outbox message carrying the announcement
+	OutboxID uint64 `json:"outbox_id"`
+	// The discord message, once it's been sent
+	MessageID string `json:"message_id,omitempty"`
+}
+
+func getAnnouncements(tx *bolt.Tx, channelId string) *bolt.Bucket {
+	channels := tx.Bucket(CHANNELS)
+	if channels == nil {
+		return nil
+	}
+
+	channel := channels.Bucket([]byte(channelId))
+	if channel == nil {
+		return nil
+	}
+
+	return channel.Bucket(ANNOUNCEMENTS)
+}
+
+// Get the latest announcement of a mapset in a channel, if there is one
+func (db *Db) Announcement(channelId string, mapId int) (announcement Announcement, ok bool) {
+	db.DB.View(func(tx *bolt.Tx) error {
+		announcement, ok = getAnnouncement(tx, channelId, mapId)
+		return nil
+	})
+	return
+}
+
+// Save the latest announcement of a mapset in a channel
+func (db *Db) SetAnnouncement(channelId string, mapId int, announcement Announcement) (err error) {
+	err = db.DB.Update(func(tx *bolt.Tx) error {
+		return putAnnouncement(tx, channelId, mapId, announcement)
+	})
+	return
+}
+
+func getAnnouncement(tx *bolt.Tx, channelId string, mapId int) (announcement Announcement, ok bool) {
+	announcements := getAnnouncements(tx, channelId)
+	if announcements == nil {
+		return
+	}
+
+	data := announcements.Get([]byte(strconv.Itoa(mapId)))
+	if data == nil {
+		return
+	}
+
+	ok = json.Unmarshal(data, &announcement) == nil
+	return
+}
+
+func putAnnouncement(tx *bolt.Tx, channelId string, mapId int, announcement Announcement) (err error) {
+	data, err := json.Marshal(announcement)
+	if err != nil {
+		return
+	}
+
+	channels, err := tx.CreateBucketIfNotExists(CHANNELS)
+	if err != nil {
+		return
+	}
+
+	channel, err := channels.CreateBucketIfNotExists([]byte(channelId))
+	if err != nil {
+		return
+	}
+
+	announcements, err := channel.CreateBucketIfNotExists(ANNOUNCEMENTS)
+	if err != nil {
+		return
+	}
+
+	return announcements.Put([]byte(strconv.Itoa(mapId)), data)
+}
+
+// Remember which discord message an outbox message became, if it's still the
+// latest announcement of its mapset
+func (db *Db) RecordAnnouncementSent(msg OutboxMessage, messageId string) (err error) {
+	announcement, ok := db.Announcement(msg.ChannelID, msg.MapID)
+	if !ok || announcement.OutboxID != msg.ID {
+		return
+	}
+
+	announcement.MessageID = messageId
+	return db.SetAnnouncement(msg.ChannelID, msg.MapID, announcement)
+}
+
+// The latest revision and status of a mapset that every channel following it
+// was told about. It's saved before a snapshot can move the mapset on, so an
+// update that was committed but never announced is still noticed next time.
+type Announced struct {
+	Hash string `json:"hash,omitempty"`
+	// Last-Updated of the revision, which survives history being rewritten
+	LastUpdated string `json:"last_updated,omitempty"`
+	// Name of the latest status tag
+	Tag string `json:"tag,omitempty"`
+}
+
+// Get the latest revision and status announced for a mapset, if there is one
+func (db *Db) Announced(mapId int) (announced Announced, ok bool) {
+	db.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(ANNOUNCED)
+		if bucket == nil {
+			return nil
+		}
+
+		data := bucket.Get([]byte(strconv.Itoa(mapId)))
+		if data == nil {
+			return nil
+		}
+
+		ok = json.Unmarshal(data, &announced) == nil
+		return nil
+	})
+	return
+}
+
+// Save the latest revision and status announced for a mapset
+func (db *Db) SetAnnounced(mapId int, announced Announced) (err error) {
+	err = db.DB.Update(func(tx *bolt.Tx) error {
+		return putAnnounced(tx, mapId, announced)
+	})
+	return
+}
+
+func putAnnounced(tx *bolt.Tx, mapId int, announced Announced) (err error) {
+	data, err := json.Marshal(announced)
+	if err != nil {
+		return
+	}
+
+	bucket, err := tx.CreateBucketIfNotExists(ANNOUNCED)
+	if err != nil {
+		return
+	}
+
+	return bucket.Put([]byte(strconv.Itoa(mapId)), data)
+}
+
+// One channel's copy of an announcement
+type Delivery struct {
+	ChannelID string
+	// The update announced on its own
+	Message json.RawMessage
+
+	// How long to hold the announcement so later revisions can be folded
+	// into it, none to send it right away without keeping track of it
+	Window       time.Duration
+	EditPrevious bool
+	// Revision announced and the one its diff starts from
+	Hash string
+	Base string
+	// The update folded into Previous, which was the channel's latest
+	// announcement when it was worked out. Only used if it still is.
+	Coalesced json.RawMessage
+	Previous  Announcement
+}
+
+// Queue an announcement for every channel and record it as the latest one
+// announced for the mapset, all in one go, so a crash can't leave some
+// channels told and others not
+func (db *Db) Announce(mapId int, deliveries []Delivery, announced Announced) (err error) {
+	now := time.Now()
+	err = db.DB.Update(func(tx *bolt.Tx) error {
+		for _, delivery := range deliveries {
+			err := deliver(tx, mapId, delivery, now)
+			if err != nil {
+				return fmt.Errorf("couldn't announce to %s: %w", delivery.ChannelID, err)
+			}
+		}
+
+		return putAnnounced(tx, mapId, announced)
+	})
+	return
+}
+
+func deliver(tx *bolt.Tx, mapId int, delivery Delivery, now time.Time) (err error) {
+	msg := OutboxMessage{ChannelID: delivery.ChannelID, Message: delivery.Message, MapID: mapId}
+	if delivery.Window <= 0 {
+		_, err = enqueueOutbox(tx, msg)
+		return
+	}
+
+	last, ok := getAnnouncement(tx, delivery.ChannelID, mapId)
+	if ok && last.Hash == delivery.Hash {
+		// already announced
+		return
+	}
+
+	if ok && delivery.Coalesced != nil && last.OutboxID == delivery.Previous.OutboxID && last.Base == delivery.Previous.Base {
+		// replace the message while it's still in the outbox, or edit it
+		// once it's been sent
+		var coalesced bool
+		coalesced, err = replaceOutboxMessage(tx, last.OutboxID, delivery.Coalesced)
+		if err != nil {
+			return
+		}
+		if !coalesced && delivery.EditPrevious && last.MessageID != "" {
+			last.OutboxID, err = enqueueOutbox(tx, OutboxMessage{
+				ChannelID: delivery.ChannelID,
+				Message:   delivery.Coalesced,
+				MapID:     mapId,
+				EditID:    last.MessageID,
+			})
+			if err != nil {
+				return
+			}
+			coalesced = true
+		}
+		if coalesced {
+			last.Hash = delivery.Hash
+			last.Count++
+			return putAnnouncement(tx, delivery.ChannelID, mapId, last)
+		}
+	}
+
+	// hold the message back for the window so later revisions can replace
+	// it, unless the channel would rather have it edited afterwards
+	if !delivery.EditPrevious {
+		msg.NextAttempt = now.Add(delivery.Window)
+	}
+	id, err := enqueueOutbox(tx, msg)
+	if err != nil {
+		return
+	}
+
+	return putAnnouncement(tx, delivery.ChannelID, mapId, Announcement{
+		Hash:        delivery.Hash,
+		Base:        delivery.Base,
+		WindowStart: now,
+		Count:       1,
+		OutboxID:    id,
+	})
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDeliver(t *testing.T) {
+	type sent struct {
+		message string
+		editId  string
+		held    bool
+	}
+
+	tests := []struct {
+		name         string
+		editPrevious bool
+		// whether the first announcement went out before the second came in
+		sent bool
+		// the second update's revision
+		hash      string
+		coalesced bool
+		// whether the channel's announcement moved on after the second update
+		// was worked out
+		stale bool
+
+		// the outbox afterwards
+		want  []sent
+		count int
+	}{
+		{"same revision", false, false, "1", true, false, []sent{{`"one"`, "", true}}, 1},
+		{"replaced while held", false, false, "2", true, false, []sent{{`"one+two"`, "", true}}, 2},
+		{"nothing to coalesce", false, false, "2", false, false, []sent{{`"one"`, "", true}, {`"two"`, "", true}}, 1},
+		{"coalesced with an old announcement", false, false, "2", true, true, []sent{{`"one"`, "", true}, {`"two"`, "", true}}, 1},
+		{"sent without editing", false, true, "2", true, false, []sent{{`"two"`, "", true}}, 1},
+		{"edit once sent", true, true, "2", true, false, []sent{{`"one+two"`, "m1", false}}, 2},
+		{"edit before sending", true, false, "2", true, false, []sent{{`"one+two"`, "", false}}, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := openTestDb(t)
+			delivery := Delivery{
+				ChannelID:    "c",
+				Message:      json.RawMessage(`"one"`),
+				Window:       time.Hour,
+				EditPrevious: test.editPrevious,
+				Hash:         "1",
+				Base:         "0",
+			}
+			err := db.Announce(1, []Delivery{delivery}, Announced{Hash: "1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.sent {
+				msg := mustOutbox(t, db, false)[0]
+				err = db.RemoveOutboxMessage(msg, "m1")
+				if err == nil {
+					err = db.RecordAnnouncementSent(msg, "m1")
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			previous, ok := db.Announcement("c", 1)
+			if !ok {
+				t.Fatal("first announcement wasn't recorded")
+			}
+			if test.stale {
+				previous.OutboxID++
+			}
+			delivery.Message = json.RawMessage(`"two"`)
+			delivery.Hash = test.hash
+			delivery.Previous = previous
+			if test.coalesced {
+				delivery.Coalesced = json.RawMessage(`"one+two"`)
+			}
+			err = db.Announce(1, []Delivery{delivery}, Announced{Hash: test.hash})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			messages := mustOutbox(t, db, false)
+			if len(messages) != len(test.want) {
+				t.Fatalf("expected %d messages, got %+v", len(test.want), messages)
+			}
+			for i, want := range test.want {
+				msg := messages[i]
+				held := msg.NextAttempt.After(time.Now())
+				if string(msg.Message) != want.message || msg.EditID != want.editId || held != want.held {
+					t.Errorf("expected message %d to be %+v, got %+v", i, want, msg)
+				}
+			}
+
+			announcement, _ := db.Announcement("c", 1)
+			last := messages[len(messages)-1]
+			if announcement.Hash != test.hash || announcement.Count != test.count || announcement.OutboxID != last.ID {
+				t.Errorf("expected the announcement to cover %d updates up to %s in message %d, got %+v",
+					test.count, test.hash, last.ID, announcement)
+			}
+		})
+	}
+}
+
+func TestRecordAnnouncementSent(t *testing.T) {
+	db := openTestDb(t)
+	err := db.SetAnnouncement("c", 1, Announcement{Hash: "2", OutboxID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an older message going out doesn't take over
+	err = db.RecordAnnouncementSent(OutboxMessage{ID: 1, ChannelID: "c", MapID: 1}, "m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if announcement, _ := db.Announcement("c", 1); announcement.MessageID != "" {
+		t.Errorf("expected an older message to be ignored, got %+v", announcement)
+	}
+
+	err = db.RecordAnnouncementSent(OutboxMessage{ID: 2, ChannelID: "c", MapID: 1}, "m2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if announcement, _ := db.Announcement("c", 1); announcement.MessageID != "m2" || announcement.Hash != "2" {
+		t.Errorf("expected the announcement to be sent as m2, got %+v", announcement)
+	}
+
+	// a mapset that was never announced in the channel
+	err = db.RecordAnnouncementSent(OutboxMessage{ID: 3, ChannelID: "c", MapID: 2}, "m3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.Announcement("c", 2); ok {
+		t.Error("expected nothing to be recorded for a mapset that wasn't announced")
+	}
+}
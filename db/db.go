@@ -3,10 +3,24 @@ package db
 // Database is laid out like this:
 // mapper/<mapper_id>/trackers/<channel_id> -> priority
 // mapper/<mapper_id>/latestEvent
+// mapset/<mapset_id>/trackers/<channel_id> -> priority
 // channel/<channel_id>/tracks/<mapper_id> -> priority
+// channel/<channel_id>/mapsets/<mapset_id> -> priority
+// channel/<channel_id>/settings/<key> -> value
+// channel/<channel_id>/announcements/<mapset_id> -> latest announcement
+// announced/<mapset_id> -> latest revision and status announced
+// queries/<id> -> query subscription, along with its channel
+// scraper/<cursor name> -> last_updated of the last mapset handled
+// scraper/beatmapsetEvent -> id of the last nomination event handled
+// outbox/<id> -> message waiting to be sent to a channel
+// deadLetters/<id> -> message that was given up on
 
 import (
+	"errors"
+	"fmt"
+	"sort"
 	"strconv"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 
@@ -16,16 +30,64 @@ import (
 var (
 	LATEST_EVENT = []byte("latestEvent")
 	MAPPERS      = []byte("mapper")
+	MAPSETS      = []byte("mapset")
 	CHANNELS     = []byte("channels")
+	SETTINGS     = []byte("settings")
+	SCRAPER      = []byte("scraper")
+	OUTBOX       = []byte("outbox")
+	DEAD_LETTERS = []byte("deadLetters")
+	QUERIES      = []byte("queries")
+	ANNOUNCED    = []byte("announced")
+
+	ANNOUNCEMENTS   = []byte("announcements")
+	CHANNEL_MAPSETS = []byte("mapsets")
+
+	BEATMAPSET_EVENT = []byte("beatmapsetEvent")
+)
+
+const (
+	// Post a short note when a mapset is updated without any content changes
+	SETTING_TOUCH_NOTES = "touch_notes"
+	// Hold updates for this long, coalescing any more updates to the same
+	// mapset into one announcement
+	SETTING_DEBOUNCE = "debounce"
+	// Edit the announcement for a mapset instead of posting a new one when
+	// it's updated within the debounce window
+	SETTING_EDIT_PREVIOUS = "edit_previous"
 )
 
+// Every per-channel setting, along with its default value
+var ChannelSettingDefaults = map[string]string{
+	SETTING_TOUCH_NOTES:   "off",
+	SETTING_DEBOUNCE:      "0s",
+	SETTING_EDIT_PREVIOUS: "off",
+}
+
 type Db struct {
 	*bolt.DB
 	api *osuapi.Osuapi
 }
 
+// How long to wait for another process to let go of the database
+const LOCK_TIMEOUT = 10 * time.Second
+
 func OpenDb(path string, api *osuapi.Osuapi) (db *Db, err error) {
-	inner, err := bolt.Open(path, 0666, nil)
+	return openDb(path, api, &bolt.Options{Timeout: LOCK_TIMEOUT})
+}
+
+// Open the database without being able to change anything in it
+func OpenDbReadOnly(path string, api *osuapi.Osuapi) (db *Db, err error) {
+	return openDb(path, api, &bolt.Options{Timeout: LOCK_TIMEOUT, ReadOnly: true})
+}
+
+func openDb(path string, api *osuapi.Osuapi, options *bolt.Options) (db *Db, err error) {
+	inner, err := bolt.Open(path, 0666, options)
+	if errors.Is(err, bolt.ErrTimeout) {
+		err = fmt.Errorf("%s is locked, is another instance running? %w", path, err)
+		return
+	} else if err != nil {
+		return
+	}
 	db = &Db{inner, api}
 	return
 }
@@ -248,6 +310,167 @@ func (db *Db) ChannelTrackMapper(channelId string, mapperId int, priority int) (
 	return
 }
 
+// Get a channel setting, falling back to its default if it's not set
+func (db *Db) ChannelSetting(channelId string, key string) (value string) {
+	value = ChannelSettingDefaults[key]
+	db.DB.View(func(tx *bolt.Tx) error {
+		settings := getChannelSettings(tx, channelId)
+		if settings == nil {
+			return nil
+		}
+
+		if v := settings.Get([]byte(key)); v != nil {
+			value = string(v)
+		}
+		return nil
+	})
+	return
+}
+
+// Get a channel setting that's either "on" or "off"
+func (db *Db) ChannelSettingEnabled(channelId string, key string) bool {
+	return db.ChannelSetting(channelId, key) == "on"
+}
+
+// Get a channel setting that's a duration, 0 if it isn't one
+func (db *Db) ChannelSettingDuration(channelId string, key string) time.Duration {
+	d, _ := time.ParseDuration(db.ChannelSetting(channelId, key))
+	return d
+}
+
+// Change a channel setting, validating that the key is known
+func (db *Db) SetChannelSetting(channelId string, key string, value string) (err error) {
+	def, ok := ChannelSettingDefaults[key]
+	if !ok {
+		err = fmt.Errorf("unknown setting %s", key)
+		return
+	}
+	if (def == "on" || def == "off") && value != "on" && value != "off" {
+		err = fmt.Errorf("setting %s must be either on or off", key)
+		return
+	}
+	if _, err2 := time.ParseDuration(def); err2 == nil {
+		if d, err2 := time.ParseDuration(value); err2 != nil || d < 0 {
+			err = fmt.Errorf("setting %s must be a duration like 10m", key)
+			return
+		}
+	}
+
+	err = db.DB.Update(func(tx *bolt.Tx) error {
+		channels, err := tx.CreateBucketIfNotExists(CHANNELS)
+		if err != nil {
+			return err
+		}
+
+		channel, err := channels.CreateBucketIfNotExists([]byte(channelId))
+		if err != nil {
+			return err
+		}
+
+		settings, err := channel.CreateBucketIfNotExists(SETTINGS)
+		if err != nil {
+			return err
+		}
+
+		return settings.Put([]byte(key), []byte(value))
+	})
+	return
+}
+
+// Get every setting for a channel, including defaults, sorted by key
+func (db *Db) ChannelSettings(channelId string) (keys []string, values map[string]string) {
+	values = make(map[string]string)
+	for key, def := range ChannelSettingDefaults {
+		keys = append(keys, key)
+		values[key] = def
+	}
+	sort.Strings(keys)
+
+	db.DB.View(func(tx *bolt.Tx) error {
+		settings := getChannelSettings(tx, channelId)
+		if settings == nil {
+			return nil
+		}
+
+		return settings.ForEach(func(k, v []byte) error {
+			if _, ok := values[string(k)]; ok {
+				values[string(k)] = string(v)
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// Get where the scraper left off, if it's been saved
+func (db *Db) ScraperCursor(name string) (cursor time.Time, ok bool) {
+	db.DB.View(func(tx *bolt.Tx) error {
+		scraper := tx.Bucket(SCRAPER)
+		if scraper == nil {
+			return nil
+		}
+
+		value := scraper.Get([]byte(name))
+		if value == nil {
+			return nil
+		}
+
+		var err error
+		cursor, err = time.Parse(time.RFC3339Nano, string(value))
+		ok = err == nil
+		return nil
+	})
+	return
+}
+
+// Save where the scraper left off
+func (db *Db) SetScraperCursor(name string, cursor time.Time) (err error) {
+	err = db.DB.Update(func(tx *bolt.Tx) error {
+		scraper, err := tx.CreateBucketIfNotExists(SCRAPER)
+		if err != nil {
+			return err
+		}
+
+		return scraper.Put([]byte(name), []byte(cursor.UTC().Format(time.RFC3339Nano)))
+	})
+	return
+}
+
+// Get the ID of the last nomination event the scraper handled, if there was
+// one
+func (db *Db) LastBeatmapsetEvent() (id int, ok bool) {
+	db.DB.View(func(tx *bolt.Tx) error {
+		scraper := tx.Bucket(SCRAPER)
+		if scraper == nil {
+			return nil
+		}
+
+		value := scraper.Get(BEATMAPSET_EVENT)
+		if value == nil {
+			return nil
+		}
+
+		var err error
+		id, err = strconv.Atoi(string(value))
+		ok = err == nil
+		return nil
+	})
+	return
+}
+
+// Save the ID of the last nomination event the scraper handled
+func (db *Db) SetLastBeatmapsetEvent(id int) (err error) {
+	err = db.DB.Update(func(tx *bolt.Tx) error {
+		scraper, err := tx.CreateBucketIfNotExists(SCRAPER)
+		if err != nil {
+			return err
+		}
+
+		return scraper.Put(BEATMAPSET_EVENT, []byte(strconv.Itoa(id)))
+	})
+	return
+}
+
 func (db *Db) Close() {
 	db.DB.Close()
 }
@@ -279,3 +502,17 @@ func getMapperMut(tx *bolt.Tx, userId int) (mapper *bolt.Bucket, err error) {
 
 	return
 }
+
+func getChannelSettings(tx *bolt.Tx, channelId string) (settings *bolt.Bucket) {
+	channels := tx.Bucket(CHANNELS)
+	if channels == nil {
+		return nil
+	}
+
+	channel := channels.Bucket([]byte(channelId))
+	if channel == nil {
+		return nil
+	}
+
+	return channel.Bucket(SETTINGS)
+}
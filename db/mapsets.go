@@ -0,0 +1,193 @@
+package db
+
+import (
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Start tracking a single mapset, whoever's hosting it
+func (db *Db) ChannelTrackMapset(channelId string, mapId int, priority int) (err error) {
+	err = db.Batch(func(tx *bolt.Tx) error {
+		{
+			mapset, err := getMapsetMut(tx, mapId)
+			if err != nil {
+				return err
+			}
+
+			trackers, err := mapset.CreateBucketIfNotExists([]byte("trackers"))
+			if err != nil {
+				return err
+			}
+
+			err = trackers.Put([]byte(channelId), []byte(strconv.Itoa(priority)))
+			if err != nil {
+				return err
+			}
+		}
+		{
+			channels, err := tx.CreateBucketIfNotExists(CHANNELS)
+			if err != nil {
+				return err
+			}
+
+			channel, err := channels.CreateBucketIfNotExists([]byte(channelId))
+			if err != nil {
+				return err
+			}
+
+			tracks, err := channel.CreateBucketIfNotExists(CHANNEL_MAPSETS)
+			if err != nil {
+				return err
+			}
+
+			err = tracks.Put([]byte(strconv.Itoa(mapId)), []byte(strconv.Itoa(priority)))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// Stop tracking a single mapset, returning false if the channel wasn't
+func (db *Db) ChannelUntrackMapset(channelId string, mapId int) (found bool, err error) {
+	err = db.Batch(func(tx *bolt.Tx) error {
+		found = false
+		if mapset := getMapset(tx, mapId); mapset != nil {
+			if trackers := mapset.Bucket([]byte("trackers")); trackers != nil {
+				found = trackers.Get([]byte(channelId)) != nil
+				err := trackers.Delete([]byte(channelId))
+				if err != nil {
+					return err
+				}
+
+				// forget the mapset once nobody's tracking it
+				if k, _ := trackers.Cursor().First(); k == nil {
+					err = tx.Bucket(MAPSETS).DeleteBucket([]byte(strconv.Itoa(mapId)))
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if tracks := getChannelMapsets(tx, channelId); tracks != nil {
+			return tracks.Delete([]byte(strconv.Itoa(mapId)))
+		}
+		return nil
+	})
+	return
+}
+
+// Loop over channels that are tracking this specific mapset
+func (db *Db) IterMapsetTrackingChannels(mapId int, fn func(channelId string) error) (err error) {
+	err = db.DB.View(func(tx *bolt.Tx) error {
+		mapset := getMapset(tx, mapId)
+		if mapset == nil {
+			return nil
+		}
+
+		trackers := mapset.Bucket([]byte("trackers"))
+		if trackers == nil {
+			return nil
+		}
+
+		c := trackers.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			err := fn(string(k))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	return
+}
+
+// Loop over mapsets this channel tracks on their own
+func (db *Db) IterChannelTrackedMapsets(channelId string, fn func(mapId int) error) (err error) {
+	err = db.DB.View(func(tx *bolt.Tx) error {
+		tracks := getChannelMapsets(tx, channelId)
+		if tracks == nil {
+			return nil
+		}
+
+		c := tracks.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			mapId, err := strconv.Atoi(string(k))
+			if err != nil {
+				return err
+			}
+
+			err = fn(mapId)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	return
+}
+
+// Loop over every mapset tracked on its own by any channel
+func (db *Db) IterAllTrackedMapsets(fn func(mapId int) error) (err error) {
+	err = db.DB.View(func(tx *bolt.Tx) error {
+		mapsets := tx.Bucket(MAPSETS)
+		if mapsets == nil {
+			return nil
+		}
+
+		c := mapsets.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			mapId, err := strconv.Atoi(string(k))
+			if err != nil {
+				return err
+			}
+
+			err = fn(mapId)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	return
+}
+
+func getMapset(tx *bolt.Tx, mapId int) (mapset *bolt.Bucket) {
+	mapsets := tx.Bucket(MAPSETS)
+	if mapsets == nil {
+		return nil
+	}
+
+	return mapsets.Bucket([]byte(strconv.Itoa(mapId)))
+}
+
+func getMapsetMut(tx *bolt.Tx, mapId int) (mapset *bolt.Bucket, err error) {
+	mapsets, err := tx.CreateBucketIfNotExists(MAPSETS)
+	if err != nil {
+		return
+	}
+
+	mapset, err = mapsets.CreateBucketIfNotExists([]byte(strconv.Itoa(mapId)))
+	return
+}
+
+func getChannelMapsets(tx *bolt.Tx, channelId string) (tracks *bolt.Bucket) {
+	channels := tx.Bucket(CHANNELS)
+	if channels == nil {
+		return nil
+	}
+
+	channel := channels.Bucket([]byte(channelId))
+	if channel == nil {
+		return nil
+	}
+
+	return channel.Bucket(CHANNEL_MAPSETS)
+}
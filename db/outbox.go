@@ -0,0 +1,232 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A message waiting to be sent to a single channel
+type OutboxMessage struct {
+	ID        uint64    `json:"id"`
+	ChannelID string    `json:"channel_id"`
+	CreatedAt time.Time `json:"created_at"`
+	// Whatever the sender needs to send it again, opaque to the database
+	Message json.RawMessage `json:"message"`
+	// Mapset the message announces, 0 if it isn't about one
+	MapID int `json:"map_id,omitempty"`
+	// Message to edit instead of posting a new one
+	EditID string `json:"edit_id,omitempty"`
+	// Bumped every time the message is replaced
+	Version int `json:"version,omitempty"`
+
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Keys for buckets numbered by NextSequence, which sort in order
+func sequenceKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+func putOutboxMessage(bucket *bolt.Bucket, msg OutboxMessage) (err error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	return bucket.Put(sequenceKey(msg.ID), data)
+}
+
+// Queue a copy of a message for every channel at once. The ID and creation
+// time are filled in, and it's sent right away unless NextAttempt is set.
+func (db *Db) EnqueueOutbox(channels []string, msg OutboxMessage) (ids []uint64, err error) {
+	err = db.DB.Update(func(tx *bolt.Tx) error {
+		for _, channelId := range channels {
+			msg.ChannelID = channelId
+			id, err := enqueueOutbox(tx, msg)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	return
+}
+
+func enqueueOutbox(tx *bolt.Tx, msg OutboxMessage) (id uint64, err error) {
+	outbox, err := tx.CreateBucketIfNotExists(OUTBOX)
+	if err != nil {
+		return
+	}
+
+	msg.CreatedAt = time.Now()
+	if msg.NextAttempt.IsZero() {
+		msg.NextAttempt = msg.CreatedAt
+	}
+	msg.ID, err = outbox.NextSequence()
+	if err != nil {
+		return
+	}
+
+	id = msg.ID
+	err = putOutboxMessage(outbox, msg)
+	return
+}
+
+// Change what a message that hasn't been sent yet says, keeping its place in
+// the outbox. Returns false if it's already gone.
+func replaceOutboxMessage(tx *bolt.Tx, id uint64, message []byte) (replaced bool, err error) {
+	outbox := tx.Bucket(OUTBOX)
+	if outbox == nil {
+		return
+	}
+
+	data := outbox.Get(sequenceKey(id))
+	if data == nil {
+		return
+	}
+
+	var msg OutboxMessage
+	err = json.Unmarshal(data, &msg)
+	if err != nil {
+		return
+	}
+	msg.Message = message
+	msg.Version++
+
+	replaced = true
+	err = putOutboxMessage(outbox, msg)
+	return
+}
+
+// List every message in the outbox, or every dead letter, oldest first
+func (db *Db) OutboxMessages(deadLetters bool) (messages []OutboxMessage, err error) {
+	name := OUTBOX
+	if deadLetters {
+		name = DEAD_LETTERS
+	}
+
+	messages = make([]OutboxMessage, 0)
+	err = db.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(name)
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			var msg OutboxMessage
+			err := json.Unmarshal(v, &msg)
+			if err != nil {
+				return fmt.Errorf("couldn't parse outbox message %x: %w", k, err)
+			}
+			messages = append(messages, msg)
+			return nil
+		})
+	})
+	return
+}
+
+// Save a message's attempts so far, leaving it in the outbox
+func (db *Db) UpdateOutboxMessage(msg OutboxMessage) (err error) {
+	err = db.DB.Update(func(tx *bolt.Tx) error {
+		outbox, err := tx.CreateBucketIfNotExists(OUTBOX)
+		if err != nil {
+			return err
+		}
+		return putOutboxMessage(outbox, msg)
+	})
+	return
+}
+
+// Remove a message that's been sent as sentId. If it was replaced while it was
+// being sent, the new version is kept to edit what was sent instead.
+func (db *Db) RemoveOutboxMessage(msg OutboxMessage, sentId string) (err error) {
+	err = db.DB.Update(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(OUTBOX)
+		if outbox == nil {
+			return nil
+		}
+
+		data := outbox.Get(sequenceKey(msg.ID))
+		if data == nil {
+			return nil
+		}
+
+		var current OutboxMessage
+		err := json.Unmarshal(data, &current)
+		if err != nil {
+			return err
+		}
+		if current.Version != msg.Version {
+			current.EditID = sentId
+			return putOutboxMessage(outbox, current)
+		}
+
+		return outbox.Delete(sequenceKey(msg.ID))
+	})
+	return
+}
+
+// Move a message that won't ever be sent out of the outbox and into the dead
+// letters
+func (db *Db) DeadLetter(msg OutboxMessage) (err error) {
+	err = db.DB.Update(func(tx *bolt.Tx) error {
+		deadLetters, err := tx.CreateBucketIfNotExists(DEAD_LETTERS)
+		if err != nil {
+			return err
+		}
+
+		err = putOutboxMessage(deadLetters, msg)
+		if err != nil {
+			return err
+		}
+
+		if outbox := tx.Bucket(OUTBOX); outbox != nil {
+			return outbox.Delete(sequenceKey(msg.ID))
+		}
+		return nil
+	})
+	return
+}
+
+// Put a dead letter back in the outbox to be tried again from scratch
+func (db *Db) RequeueDeadLetter(id uint64) (err error) {
+	err = db.DB.Update(func(tx *bolt.Tx) error {
+		deadLetters := tx.Bucket(DEAD_LETTERS)
+		if deadLetters == nil {
+			return fmt.Errorf("no dead letter %d", id)
+		}
+
+		data := deadLetters.Get(sequenceKey(id))
+		if data == nil {
+			return fmt.Errorf("no dead letter %d", id)
+		}
+
+		var msg OutboxMessage
+		err := json.Unmarshal(data, &msg)
+		if err != nil {
+			return err
+		}
+		msg.Attempts = 0
+		msg.NextAttempt = time.Now()
+
+		outbox, err := tx.CreateBucketIfNotExists(OUTBOX)
+		if err != nil {
+			return err
+		}
+
+		err = putOutboxMessage(outbox, msg)
+		if err != nil {
+			return err
+		}
+		return deadLetters.Delete(sequenceKey(id))
+	})
+	return
+}
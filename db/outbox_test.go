@@ -0,0 +1,201 @@
+package db
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Open a fresh database that's closed when the test finishes
+func openTestDb(t *testing.T) *Db {
+	t.Helper()
+
+	db, err := OpenDb(filepath.Join(t.TempDir(), "db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func mustOutbox(t *testing.T, db *Db, deadLetters bool) []OutboxMessage {
+	t.Helper()
+
+	messages, err := db.OutboxMessages(deadLetters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+func TestEnqueueOutbox(t *testing.T) {
+	db := openTestDb(t)
+	later := time.Now().Add(time.Hour)
+
+	ids, err := db.EnqueueOutbox([]string{"a", "b"}, OutboxMessage{Message: json.RawMessage(`"one"`), MapID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.EnqueueOutbox([]string{"c"}, OutboxMessage{Message: json.RawMessage(`"two"`), NextAttempt: later})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := mustOutbox(t, db, false)
+	if len(ids) != 2 || len(messages) != 3 {
+		t.Fatalf("expected 3 messages with 2 ids from the first batch, got %v and %d", ids, len(messages))
+	}
+	for i, channel := range []string{"a", "b", "c"} {
+		msg := messages[i]
+		if msg.ChannelID != channel {
+			t.Errorf("message %d is for %s, expected %s", i, msg.ChannelID, channel)
+		}
+		if msg.CreatedAt.IsZero() || msg.NextAttempt.IsZero() {
+			t.Errorf("message %d wasn't given its times: %+v", i, msg)
+		}
+	}
+	if messages[0].ID != ids[0] || messages[1].ID != ids[1] {
+		t.Errorf("ids %v don't match the messages", ids)
+	}
+	if !messages[2].NextAttempt.Equal(later) {
+		t.Errorf("expected the held message to wait until %s, got %s", later, messages[2].NextAttempt)
+	}
+}
+
+func TestRemoveOutboxMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		replaced bool
+		// what's left in the outbox afterwards
+		remaining int
+		editId    string
+	}{
+		{"sent as it was", false, 0, ""},
+		{"replaced while sending", true, 1, "sent"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := openTestDb(t)
+			_, err := db.EnqueueOutbox([]string{"a"}, OutboxMessage{Message: json.RawMessage(`"old"`)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sending := mustOutbox(t, db, false)[0]
+
+			if test.replaced {
+				err = db.DB.Update(func(tx *bolt.Tx) error {
+					_, err := replaceOutboxMessage(tx, sending.ID, json.RawMessage(`"new"`))
+					return err
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = db.RemoveOutboxMessage(sending, "sent")
+			if err != nil {
+				t.Fatal(err)
+			}
+			messages := mustOutbox(t, db, false)
+			if len(messages) != test.remaining {
+				t.Fatalf("expected %d messages left, got %d", test.remaining, len(messages))
+			}
+			if test.remaining > 0 && (messages[0].EditID != test.editId || string(messages[0].Message) != `"new"`) {
+				t.Errorf("expected the new version to edit %s, got %+v", test.editId, messages[0])
+			}
+		})
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	db := openTestDb(t)
+	_, err := db.EnqueueOutbox([]string{"a"}, OutboxMessage{Message: json.RawMessage(`"one"`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := mustOutbox(t, db, false)[0]
+	msg.Attempts = 5
+	msg.LastError = "forbidden"
+	err = db.DeadLetter(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mustOutbox(t, db, false)) != 0 {
+		t.Error("dead letter is still in the outbox")
+	}
+	letters := mustOutbox(t, db, true)
+	if len(letters) != 1 || letters[0].LastError != "forbidden" {
+		t.Fatalf("expected the dead letter to keep its error, got %+v", letters)
+	}
+
+	err = db.RequeueDeadLetter(msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mustOutbox(t, db, true)) != 0 {
+		t.Error("requeued message is still a dead letter")
+	}
+	messages := mustOutbox(t, db, false)
+	if len(messages) != 1 || messages[0].Attempts != 0 || messages[0].NextAttempt.After(time.Now()) {
+		t.Errorf("expected the message back from scratch, got %+v", messages)
+	}
+
+	err = db.RequeueDeadLetter(msg.ID)
+	if err == nil {
+		t.Error("expected an error requeueing a dead letter that's gone")
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	db := openTestDb(t)
+	deliveries := []Delivery{
+		{ChannelID: "a", Message: json.RawMessage(`"one"`)},
+		{ChannelID: "b", Message: json.RawMessage(`"one"`), Window: time.Hour, Hash: "1"},
+	}
+	err := db.Announce(1, deliveries, Announced{Hash: "1", Tag: "pending-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := mustOutbox(t, db, false)
+	if len(messages) != 2 {
+		t.Fatalf("expected a message for each channel, got %d", len(messages))
+	}
+	if !messages[1].NextAttempt.After(time.Now()) {
+		t.Error("expected the debounced message to be held back")
+	}
+	if _, ok := db.Announcement("a", 1); ok {
+		t.Error("a channel without a window shouldn't keep track of its announcement")
+	}
+	if a, ok := db.Announcement("b", 1); !ok || a.OutboxID != messages[1].ID {
+		t.Errorf("expected the announcement to point at message %d, got %+v", messages[1].ID, a)
+	}
+	if announced, ok := db.Announced(1); !ok || announced.Hash != "1" || announced.Tag != "pending-1" {
+		t.Errorf("announced record wasn't saved: %+v", announced)
+	}
+
+	// a channel that can't be written to leaves nothing behind
+	err = db.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(CHANNELS).Put([]byte("c"), []byte("not a bucket"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveries = append(deliveries, Delivery{ChannelID: "c", Message: json.RawMessage(`"two"`), Window: time.Hour, Hash: "2"})
+	deliveries[1].Hash = "2"
+	err = db.Announce(1, deliveries, Announced{Hash: "2"})
+	if err == nil {
+		t.Fatal("expected an error announcing to a broken channel")
+	}
+	if len(mustOutbox(t, db, false)) != 2 {
+		t.Error("messages were queued for an announcement that failed")
+	}
+	if announced, _ := db.Announced(1); announced.Hash != "1" {
+		t.Errorf("announced record moved on to %s after a failure", announced.Hash)
+	}
+}
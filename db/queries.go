@@ -0,0 +1,246 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+
+	"subscribe-bot/osuapi"
+)
+
+// Values the mode filter accepts
+var QUERY_MODES = []string{"osu", "taiko", "fruits", "mania"}
+
+// Values the status filter accepts, matching the scraper's searches
+var QUERY_STATUSES = []string{"pending", "wip", "qualified", "ranked", "loved", "graveyard"}
+
+// A subscription to every mapset that matches a search, like the ones on the
+// website. Every word of the text has to be somewhere in the artist, title,
+// creator, source or tags, and every filter that's set has to match.
+type Query struct {
+	ID        uint64 `json:"id"`
+	ChannelID string `json:"channel_id"`
+
+	Text string `json:"text,omitempty"`
+	// Matches if any difficulty is in this mode
+	Mode     string   `json:"mode,omitempty"`
+	Status   string   `json:"status,omitempty"`
+	Genre    string   `json:"genre,omitempty"`
+	Language string   `json:"language,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// Parse a query written as filters like mode=mania or tag=tournament followed
+// or mixed with search text
+func ParseQuery(channelId string, text string) (query Query, err error) {
+	query.ChannelID = channelId
+	words := make([]string, 0)
+	for _, word := range strings.Fields(text) {
+		parts := strings.SplitN(word, "=", 2)
+		if len(parts) != 2 {
+			words = append(words, word)
+			continue
+		}
+
+		key, value := strings.ToLower(parts[0]), strings.ToLower(parts[1])
+		switch key {
+		case "mode":
+			if !contains(QUERY_MODES, value) {
+				err = fmt.Errorf("mode must be one of %s", strings.Join(QUERY_MODES, ", "))
+				return
+			}
+			query.Mode = value
+		case "status":
+			if !contains(QUERY_STATUSES, value) {
+				err = fmt.Errorf("status must be one of %s", strings.Join(QUERY_STATUSES, ", "))
+				return
+			}
+			query.Status = value
+		case "genre":
+			if _, ok := osuapi.GENRES[value]; !ok {
+				err = fmt.Errorf("unknown genre %s", value)
+				return
+			}
+			query.Genre = value
+		case "language":
+			if _, ok := osuapi.LANGUAGES[value]; !ok {
+				err = fmt.Errorf("unknown language %s", value)
+				return
+			}
+			query.Language = value
+		case "tag":
+			query.Tags = append(query.Tags, value)
+		default:
+			err = fmt.Errorf("unknown filter %s", key)
+			return
+		}
+	}
+	query.Text = strings.Join(words, " ")
+
+	if query.Text == "" && query.Mode == "" && query.Status == "" && query.Genre == "" && query.Language == "" && len(query.Tags) == 0 {
+		err = fmt.Errorf("query would match every mapset")
+	}
+	return
+}
+
+// The query written back out the way ParseQuery reads it
+func (query Query) String() string {
+	parts := make([]string, 0)
+	if query.Mode != "" {
+		parts = append(parts, "mode="+query.Mode)
+	}
+	if query.Status != "" {
+		parts = append(parts, "status="+query.Status)
+	}
+	if query.Genre != "" {
+		parts = append(parts, "genre="+query.Genre)
+	}
+	if query.Language != "" {
+		parts = append(parts, "language="+query.Language)
+	}
+	for _, tag := range query.Tags {
+		parts = append(parts, "tag="+tag)
+	}
+	if query.Text != "" {
+		parts = append(parts, query.Text)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Whether a mapset matches the query
+func (query Query) Matches(beatmapSet osuapi.Beatmapset) bool {
+	if query.Status != "" && beatmapSet.Status != query.Status {
+		return false
+	}
+	if query.Genre != "" && beatmapSet.GenreID != osuapi.GENRES[query.Genre] {
+		return false
+	}
+	if query.Language != "" && beatmapSet.LanguageID != osuapi.LANGUAGES[query.Language] {
+		return false
+	}
+
+	if query.Mode != "" {
+		found := false
+		for _, beatmap := range beatmapSet.Beatmaps {
+			if beatmap.Mode == query.Mode {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	tags := strings.Fields(strings.ToLower(beatmapSet.Tags))
+	for _, tag := range query.Tags {
+		if !contains(tags, tag) {
+			return false
+		}
+	}
+
+	haystack := strings.ToLower(strings.Join([]string{
+		beatmapSet.Artist,
+		beatmapSet.ArtistUnicode,
+		beatmapSet.Title,
+		beatmapSet.TitleUnicode,
+		beatmapSet.Creator,
+		beatmapSet.Source,
+		beatmapSet.Tags,
+	}, " "))
+	for _, word := range strings.Fields(strings.ToLower(query.Text)) {
+		if !strings.Contains(haystack, word) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Save a new query subscription, filling in its ID
+func (db *Db) AddQuery(query Query) (id uint64, err error) {
+	err = db.DB.Update(func(tx *bolt.Tx) error {
+		queries, err := tx.CreateBucketIfNotExists(QUERIES)
+		if err != nil {
+			return err
+		}
+
+		query.ID, err = queries.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(query)
+		if err != nil {
+			return err
+		}
+
+		id = query.ID
+		return queries.Put(sequenceKey(query.ID), data)
+	})
+	return
+}
+
+// Remove one of a channel's query subscriptions, returning false if it doesn't
+// have one with that ID
+func (db *Db) RemoveQuery(channelId string, id uint64) (found bool, err error) {
+	err = db.DB.Update(func(tx *bolt.Tx) error {
+		queries := tx.Bucket(QUERIES)
+		if queries == nil {
+			return nil
+		}
+
+		key := sequenceKey(id)
+		data := queries.Get(key)
+		if data == nil {
+			return nil
+		}
+
+		var query Query
+		err := json.Unmarshal(data, &query)
+		if err != nil {
+			return err
+		}
+		if query.ChannelID != channelId {
+			return nil
+		}
+
+		found = true
+		return queries.Delete(key)
+	})
+	return
+}
+
+// List every query subscription, or only a channel's if channelId isn't empty
+func (db *Db) Queries(channelId string) (queries []Query, err error) {
+	queries = make([]Query, 0)
+	err = db.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(QUERIES)
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			var query Query
+			err := json.Unmarshal(v, &query)
+			if err != nil {
+				return fmt.Errorf("couldn't parse query %x: %w", k, err)
+			}
+			if channelId == "" || query.ChannelID == channelId {
+				queries = append(queries, query)
+			}
+			return nil
+		})
+	})
+	return
+}
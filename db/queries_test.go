@@ -0,0 +1,148 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+
+	"subscribe-bot/osuapi"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		text string
+		want Query
+		// written back out, if it's different from text
+		str string
+		ok  bool
+	}{
+		{"camellia", Query{Text: "camellia"}, "", true},
+		{"mode=mania", Query{Mode: "mania"}, "", true},
+		{"MODE=Mania", Query{Mode: "mania"}, "mode=mania", true},
+		{"tag=tournament tag=owc", Query{Tags: []string{"tournament", "owc"}}, "", true},
+		{
+			"some song mode=osu status=pending genre=anime language=japanese",
+			Query{Text: "some song", Mode: "osu", Status: "pending", Genre: "anime", Language: "japanese"},
+			"mode=osu status=pending genre=anime language=japanese some song",
+			true,
+		},
+		{"some mode=taiko song", Query{Text: "some song", Mode: "taiko"}, "mode=taiko some song", true},
+		{"", Query{}, "", false},
+		{"   ", Query{}, "", false},
+		{"mode=std", Query{}, "", false},
+		{"status=approved", Query{}, "", false},
+		{"genre=polka", Query{}, "", false},
+		{"language=klingon", Query{}, "", false},
+		{"artist=camellia", Query{}, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.text, func(t *testing.T) {
+			query, err := ParseQuery("c", test.text)
+			if (err == nil) != test.ok {
+				t.Fatalf("expected ok to be %v, got %v", test.ok, err)
+			}
+			if !test.ok {
+				return
+			}
+
+			test.want.ChannelID = "c"
+			if !reflect.DeepEqual(query, test.want) {
+				t.Errorf("expected %+v, got %+v", test.want, query)
+			}
+			str := test.str
+			if str == "" {
+				str = test.text
+			}
+			if query.String() != str {
+				t.Errorf("expected it written as %q, got %q", str, query.String())
+			}
+			again, err := ParseQuery("c", query.String())
+			if err != nil || !reflect.DeepEqual(again, query) {
+				t.Errorf("didn't survive being written out: %+v (%v)", again, err)
+			}
+		})
+	}
+}
+
+func TestQueryMatches(t *testing.T) {
+	beatmapSet := osuapi.Beatmapset{
+		Artist:        "Camellia",
+		ArtistUnicode: "かめりあ",
+		Title:         "Some Song",
+		Creator:       "mapper",
+		Source:        "Some Game",
+		Tags:          "Tournament OWC2020 electronic",
+		Status:        "pending",
+		GenreID:       osuapi.GENRES["video-game"],
+		LanguageID:    osuapi.LANGUAGES["instrumental"],
+		Beatmaps:      []osuapi.Beatmap{{Mode: "osu"}, {Mode: "mania"}},
+	}
+
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"camellia", true},
+		{"CAMELLIA some", true},
+		{"かめりあ", true},
+		{"song game mapper", true},
+		{"electro", true},
+		{"camellia other", false},
+		{"mode=mania", true},
+		{"mode=taiko", false},
+		{"status=pending", true},
+		{"status=ranked", false},
+		{"genre=video-game", true},
+		{"genre=anime", false},
+		{"language=instrumental", true},
+		{"language=english", false},
+		{"tag=tournament", true},
+		{"tag=owc2020 tag=electronic", true},
+		{"tag=owc", false},
+		{"tag=tournament camellia mode=osu status=pending", true},
+		{"tag=tournament camellia mode=osu status=qualified", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.text, func(t *testing.T) {
+			query, err := ParseQuery("c", test.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := query.Matches(beatmapSet); got != test.want {
+				t.Errorf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestQueries(t *testing.T) {
+	db := openTestDb(t)
+	for _, channelId := range []string{"a", "b", "a"} {
+		_, err := db.AddQuery(Query{ChannelID: channelId, Text: channelId})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if queries, err := db.Queries(""); err != nil || len(queries) != 3 {
+		t.Errorf("expected 3 queries, got %v (%v)", queries, err)
+	}
+	queries, err := db.Queries("a")
+	if err != nil || len(queries) != 2 || queries[0].ID != 1 || queries[1].ID != 3 {
+		t.Fatalf("expected a's queries 1 and 3, got %v (%v)", queries, err)
+	}
+
+	if found, err := db.RemoveQuery("b", 1); err != nil || found {
+		t.Errorf("removed a's query from b: %v (%v)", found, err)
+	}
+	if found, err := db.RemoveQuery("a", 1); err != nil || !found {
+		t.Errorf("expected a's query to be removed, got %v (%v)", found, err)
+	}
+	if found, err := db.RemoveQuery("a", 1); err != nil || found {
+		t.Errorf("removed the same query twice: %v (%v)", found, err)
+	}
+	if queries, _ := db.Queries("a"); len(queries) != 1 || queries[0].ID != 3 {
+		t.Errorf("expected only query 3 left for a, got %v", queries)
+	}
+}
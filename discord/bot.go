@@ -1,12 +1,10 @@
 package discord
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"os"
-	"path"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -14,13 +12,11 @@ import (
 	"time"
 
 	"github.com/bwmarrin/discordgo"
-	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing"
-	"github.com/go-git/go-git/v5/plumbing/object"
 
 	"subscribe-bot/config"
 	"subscribe-bot/db"
 	"subscribe-bot/osuapi"
+	"subscribe-bot/repo"
 )
 
 type Bot struct {
@@ -29,6 +25,9 @@ type Bot struct {
 	db        *db.Db
 	api       *osuapi.Osuapi
 	config    *config.Config
+
+	// Announcements waiting to be sent
+	Outbox *Outbox
 }
 
 func NewBot(config *config.Config, db *db.Db, api *osuapi.Osuapi) (bot *Bot, err error) {
@@ -48,7 +47,8 @@ func NewBot(config *config.Config, db *db.Db, api *osuapi.Osuapi) (bot *Bot, err
 		return
 	}
 
-	bot = &Bot{s, re, db, api, config}
+	bot = &Bot{s, re, db, api, config, nil}
+	bot.Outbox = newOutbox(bot)
 	s.AddHandler(bot.errWrap(bot.newMessageHandler))
 	return
 }
@@ -80,172 +80,245 @@ func (bot *Bot) errWrap(fn interface{}) interface{} {
 	return newFunc.Interface()
 }
 
-func (bot *Bot) NotifyNewBeatmap(channels []string, newMaps []osuapi.Beatmapset) (err error) {
-	for _, beatmapSet := range newMaps {
-		var eventTime time.Time
-		eventTime, err = time.Parse(time.RFC3339, beatmapSet.LastUpdated)
-		if err != nil {
-			return
-		}
+// A new revision of a beatmapset, or a change to its status, ready to be
+// announced
+type BeatmapUpdate struct {
+	Beatmapset osuapi.Beatmapset
+	// Empty if only the status changed
+	Revision repo.Revision
+	// Diff against the previous revision, nil if this is the first one
+	Diff *repo.Diff
+	// Set if the mapset's status changed with this update
+	StatusTag *repo.Tag
+	// When several updates are announced together, how many there were and
+	// the revision Diff starts from. Since is also set when Diff covers
+	// revisions that were never announced.
+	Coalesced int
+	Since     string
+	// Guest difficulties to pick out, for channels that follow their mappers
+	// rather than the host
+	GuestDifficulties []int
+}
 
-		var (
-			gotDownloadedBeatmap = false
-			downloadedBeatmap    BeatmapsetDownloaded
-			// status               git.Status
+// Embed colors for each kind of update, plain updates have none
+var statusColors = map[string]int{
+	"Qualified":    0x66ccff,
+	"Disqualified": 0xff6666,
+	"Ranked":       0x66ff66,
+	"Loved":        0xff66aa,
+	"Graveyarded":  0x666666,
+	"Revived":      0xffcc66,
+}
 
-			commit     *object.Commit
-			parent     *object.Commit
-			patch      *object.Patch
-			foundPatch = false
-			// commitFiles *object.FileIter
-		)
-		// beatmapSet, err = bot.getBeatmapsetInfo(beatmap)
+// Headline for an update, naming the status the mapset moved to if it did
+func updateTitle(update BeatmapUpdate) string {
+	tag := update.StatusTag
+	if tag == nil || tag.Previous == "" {
+		return "Update"
+	}
 
-		// try to open a repo for this beatmap
-		var repo *git.Repository
-		repoDir := path.Join(bot.config.Repos, strconv.Itoa(beatmapSet.UserID), strconv.Itoa(beatmapSet.ID))
-		if _, err := os.Stat(repoDir); os.IsNotExist(err) {
-			os.MkdirAll(repoDir, 0777)
-		}
-		repo, err = git.PlainOpen(repoDir)
-		if err == git.ErrRepositoryNotExists {
-			// create a new repo
-			repo, err = git.PlainInit(repoDir, false)
-		}
-		if err != nil {
-			return
+	switch tag.Status {
+	case repo.STATUS_QUALIFIED:
+		return "Qualified"
+	case repo.STATUS_DISQUALIFIED:
+		return "Disqualified"
+	case repo.STATUS_RANKED:
+		return "Ranked"
+	case repo.STATUS_LOVED:
+		return "Loved"
+	case repo.STATUS_GRAVEYARDED:
+		return "Graveyarded"
+	case repo.STATUS_PENDING:
+		if tag.Previous == repo.STATUS_GRAVEYARDED {
+			return "Revived"
 		}
+		return "Pending"
+	}
+	return "Update"
+}
 
-		// download latest updates to the map
-		err = bot.downloadBeatmapTo(&beatmapSet, repo, repoDir)
-		if err != nil {
-			log.Println("failed to download beatmap:", err)
-		} else {
-			gotDownloadedBeatmap = true
-		}
+// The announcement for an update as it's stored in the outbox, for callers
+// that queue it themselves
+func (bot *Bot) AnnouncementMessage(update BeatmapUpdate) (message []byte, err error) {
+	embed, err := bot.updateEmbed(update)
+	if err != nil {
+		return
+	}
 
-		// create a commit
-		var (
-			worktree *git.Worktree
-			files    []os.FileInfo
-			hash     plumbing.Hash
+	return json.Marshal(&discordgo.MessageSend{Embed: embed})
+}
+
+func (bot *Bot) updateEmbed(update BeatmapUpdate) (embed *discordgo.MessageEmbed, err error) {
+	beatmapSet := update.Beatmapset
+	eventTime, err := time.Parse(time.RFC3339, beatmapSet.LastUpdated)
+	if err != nil {
+		return
+	}
+
+	embed = &discordgo.MessageEmbed{
+		URL:       fmt.Sprintf("%s/map/%d/%d/versions", bot.config.Web.ServedAt, beatmapSet.UserID, beatmapSet.ID),
+		Title:     fmt.Sprintf("%s: %s - %s", updateTitle(update), beatmapSet.Artist, beatmapSet.Title),
+		Color:     statusColors[updateTitle(update)],
+		Timestamp: eventTime.Format(time.RFC3339),
+		Author: &discordgo.MessageEmbedAuthor{
+			URL:  "https://osu.ppy.sh/u/" + strconv.Itoa(beatmapSet.UserID),
+			Name: beatmapSet.Creator,
+			IconURL: fmt.Sprintf(
+				"https://a.ppy.sh/%d?%d.png",
+				beatmapSet.UserID,
+				time.Now().Unix(),
+			),
+		},
+		Thumbnail: &discordgo.MessageEmbedThumbnail{
+			URL: beatmapSet.Covers.SlimCover2x,
+		},
+	}
+
+	if update.Revision.Hash == "" {
+		embed.Description = "No content changes since the last revision"
+	} else if update.Diff != nil && update.Coalesced > 1 {
+		embed.Description = fmt.Sprintf(
+			"Latest revision: %s\n%d updates since [%s](%s/map/%d/%d/compare/%s/%s)\n%s",
+			update.Revision.Hash,
+			update.Coalesced,
+			update.Since[:8],
+			bot.config.Web.ServedAt,
+			beatmapSet.UserID,
+			beatmapSet.ID,
+			update.Since,
+			update.Revision.Hash,
+			update.Diff.Stats.String(),
 		)
-		worktree, err = repo.Worktree()
-		if err != nil {
-			return
-		}
-		files, err = ioutil.ReadDir(repoDir)
-		if err != nil {
-			return
-		}
-		for _, f := range files {
-			if f.Name() == ".git" {
-				continue
-			}
-			worktree.Add(f.Name())
-		}
-		hash, err = worktree.Commit(
-			fmt.Sprintf("update: %d", beatmapSet.ID),
-			&git.CommitOptions{
-				Author: &object.Signature{
-					Name:  beatmapSet.Creator,
-					Email: "nobody@localhost",
-					When:  eventTime,
-				},
-			},
+	} else if update.Diff != nil {
+		embed.Description = fmt.Sprintf(
+			"Latest revision: %s\n%s",
+			update.Revision.Hash,
+			update.Diff.Stats.String(),
 		)
-		if err != nil {
-			err = fmt.Errorf("couldn't create commit for %d: %w", beatmapSet.ID, err)
-			return
-		}
+	} else {
+		embed.Description = "Newly tracked map; diff information will be reported upon next update!"
+	}
 
-		commit, err = repo.CommitObject(hash)
-		if err != nil {
-			err = fmt.Errorf("couldn't find commit with hash %s: %w", hash, err)
-			return
-		}
-		parent, err = commit.Parent(0)
-		if errors.Is(err, object.ErrParentNotFound) {
-			err = nil
-		} else if err != nil {
-			err = fmt.Errorf("couldn't retrieve commit parent: %w", err)
-			return
-		} else {
-			patch, err = parent.Patch(commit)
-			if err != nil {
-				err = fmt.Errorf("couldn't retrieve patch: %w", err)
-				return
-			}
-			foundPatch = true
-		}
+	if update.StatusTag != nil && update.StatusTag.Previous != "" {
+		embed.Description += fmt.Sprintf(
+			"\nStatus changed from **%s** to **%s**",
+			update.StatusTag.Previous,
+			update.StatusTag.Status,
+		)
+	}
 
-		embed := &discordgo.MessageEmbed{
-			URL:       fmt.Sprintf("%s/map/%d/%d/versions", bot.config.Web.ServedAt, beatmapSet.UserID, beatmapSet.ID),
-			Title:     fmt.Sprintf("Update: %s - %s", beatmapSet.Artist, beatmapSet.Title),
-			Timestamp: eventTime.Format(time.RFC3339),
-			Author: &discordgo.MessageEmbedAuthor{
-				URL:  "https://osu.ppy.sh/u/" + strconv.Itoa(beatmapSet.UserID),
-				Name: beatmapSet.Creator,
-				IconURL: fmt.Sprintf(
-					"https://a.ppy.sh/%d?%d.png",
-					beatmapSet.UserID,
-					time.Now().Unix(),
-				),
-			},
-			Thumbnail: &discordgo.MessageEmbedThumbnail{
-				URL: beatmapSet.Covers.SlimCover2x,
-			},
-		}
+	embed.Fields = guestFields(update)
+	return
+}
 
-		if gotDownloadedBeatmap {
-			log.Println(downloadedBeatmap)
-			if foundPatch {
-				embed.Description = fmt.Sprintf(
-					"Latest revision: %s\n%s",
-					hash,
-					patch.Stats().String(),
-				)
-			} else {
-				embed.Description = "Newly tracked map; diff information will be reported upon next update!"
+// A field for each guest difficulty in an update with how much of it changed
+func guestFields(update BeatmapUpdate) (fields []*discordgo.MessageEmbedField) {
+	for _, id := range update.GuestDifficulties {
+		name := strconv.Itoa(id)
+		for _, beatmap := range update.Beatmapset.Beatmaps {
+			if beatmap.ID == id {
+				name = beatmap.DifficultyName
+				break
 			}
 		}
 
-		for _, channelId := range channels {
-			_, err = bot.ChannelMessageSendEmbed(channelId, embed)
-			if err != nil {
-				err = fmt.Errorf("failed to send to %s: %w", channelId, err)
+		value := "No changes"
+		if update.Diff == nil {
+			value = "Newly tracked"
+		} else {
+			for _, stat := range update.Diff.Stats {
+				if stat.Name == fmt.Sprintf("%d.osu", id) {
+					value = fmt.Sprintf("%d additions, %d deletions", stat.Addition, stat.Deletion)
+					break
+				}
 			}
 		}
+
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:   "Guest difficulty: " + name,
+			Value:  value,
+			Inline: true,
+		})
 	}
+	return
+}
+
+// Let channels know that a mapset was re-uploaded without any content changes
+func (bot *Bot) NotifyTouched(channels []string, beatmapSet osuapi.Beatmapset) (err error) {
+	msg := fmt.Sprintf(
+		"%s - %s (%s) was touched, but no content changed since the last revision",
+		beatmapSet.Artist,
+		beatmapSet.Title,
+		beatmapSet.Creator,
+	)
 
+	_, err = bot.enqueue(channels, &discordgo.MessageSend{Content: msg}, 0)
 	return
 }
 
-type BeatmapsetDownloaded struct {
-	Path string
+// A nomination event on a tracked mapset, ready to be announced
+type NominationUpdate struct {
+	Event osuapi.BeatmapsetEvent
+	// Whoever caused the event, empty if they weren't in the reply
+	User osuapi.EventUserCompact
+	// What they said about it, if anything
+	Comment string
 }
 
-func (bot *Bot) downloadBeatmapTo(beatmapSet *osuapi.Beatmapset, repo *git.Repository, repoDir string) (err error) {
-	// clear all OSU files
-	files, err := ioutil.ReadDir(repoDir)
-	if err != nil {
-		return
+// Headlines and colors for each kind of nomination event. Disqualifications
+// and nomination resets undo progress, so they stand out.
+var nominationStyles = map[string]struct {
+	title string
+	color int
+}{
+	osuapi.EVENT_NOMINATE:         {"Nominated", 0x6699ff},
+	osuapi.EVENT_QUALIFY:          {"Qualified", statusColors["Qualified"]},
+	osuapi.EVENT_DISQUALIFY:       {"\u26a0 Disqualified", statusColors["Disqualified"]},
+	osuapi.EVENT_NOMINATION_RESET: {"\u26a0 Nomination reset", 0xff9933},
+}
+
+// Maximum length of a comment quoted in an announcement
+const MAX_COMMENT_LENGTH = 1000
+
+func (bot *Bot) NotifyNomination(channels []string, update NominationUpdate) (err error) {
+	event := update.Event
+	beatmapSet := event.Beatmapset
+	style, ok := nominationStyles[event.Type]
+	if !ok {
+		style.title = event.Type
 	}
-	for _, f := range files {
-		if !strings.HasSuffix(f.Name(), ".osu") {
-			continue
+
+	embed := &discordgo.MessageEmbed{
+		URL:   fmt.Sprintf("https://osu.ppy.sh/beatmapsets/%d/discussion", beatmapSet.ID),
+		Title: fmt.Sprintf("%s: %s - %s", style.title, beatmapSet.Artist, beatmapSet.Title),
+		Color: style.color,
+		Footer: &discordgo.MessageEmbedFooter{
+			Text: "Mapped by " + beatmapSet.Creator,
+		},
+		Thumbnail: &discordgo.MessageEmbedThumbnail{
+			URL: beatmapSet.Covers.SlimCover2x,
+		},
+	}
+	if eventTime, err := time.Parse(time.RFC3339, event.CreatedAt); err == nil {
+		embed.Timestamp = eventTime.Format(time.RFC3339)
+	}
+	if update.User.Username != "" {
+		embed.Author = &discordgo.MessageEmbedAuthor{
+			URL:     "https://osu.ppy.sh/u/" + strconv.Itoa(event.UserID),
+			Name:    update.User.Username,
+			IconURL: update.User.AvatarURL,
 		}
-		os.Remove(f.Name())
 	}
 
-	for _, beatmap := range beatmapSet.Beatmaps {
-		path := path.Join(repoDir, fmt.Sprintf("%d.osu", beatmap.ID))
-
-		err = bot.api.DownloadSingleBeatmap(beatmap.ID, path)
-		if err != nil {
-			return
+	if update.Comment != "" {
+		comment := update.Comment
+		if len(comment) > MAX_COMMENT_LENGTH {
+			comment = strings.ToValidUTF8(comment[:MAX_COMMENT_LENGTH], "") + "\u2026"
 		}
+		embed.Description = comment
 	}
+
+	_, err = bot.enqueue(channels, &discordgo.MessageSend{Embed: embed}, event.Beatmapset.ID)
 	return
 }
 
@@ -264,6 +337,21 @@ func (bot *Bot) getBeatmapsetInfo(event osuapi.Event) (beatmapSet osuapi.Beatmap
 	return
 }
 
+var mapsetLinkRe = regexp.MustCompile(`(?:beatmapsets|/s)/(\d+)`)
+
+// Mapset IDs can be given as is or as a link to the mapset
+func parseMapsetId(arg string) (mapId int, err error) {
+	if match := mapsetLinkRe.FindStringSubmatch(arg); match != nil {
+		arg = match[1]
+	}
+
+	mapId, err = strconv.Atoi(arg)
+	if err != nil {
+		err = fmt.Errorf("%s isn't a mapset id or link", arg)
+	}
+	return
+}
+
 func (bot *Bot) newMessageHandler(s *discordgo.Session, m *discordgo.MessageCreate) (err error) {
 	mentionsMe := false
 	for _, user := range m.Mentions {
@@ -303,6 +391,112 @@ func (bot *Bot) newMessageHandler(s *discordgo.Session, m *discordgo.MessageCrea
 
 		bot.ChannelMessageSend(m.ChannelID, fmt.Sprintf("subscribed to %+v", mapper))
 
+	case "trackset":
+		if len(parts) != 2 {
+			err = errors.New("usage: trackset <mapset id or link>")
+			return
+		}
+
+		var mapId int
+		mapId, err = parseMapsetId(parts[1])
+		if err != nil {
+			return
+		}
+
+		var beatmapSet osuapi.Beatmapset
+		beatmapSet, err = bot.api.GetBeatmapSet(mapId)
+		if err != nil {
+			return
+		}
+
+		err = bot.db.ChannelTrackMapset(m.ChannelID, mapId, 3)
+		if err != nil {
+			return
+		}
+
+		bot.ChannelMessageSend(m.ChannelID, fmt.Sprintf("subscribed to %s - %s (%s)", beatmapSet.Artist, beatmapSet.Title, beatmapSet.Creator))
+
+	case "untrackset":
+		if len(parts) != 2 {
+			err = errors.New("usage: untrackset <mapset id or link>")
+			return
+		}
+
+		var mapId int
+		mapId, err = parseMapsetId(parts[1])
+		if err != nil {
+			return
+		}
+
+		var found bool
+		found, err = bot.db.ChannelUntrackMapset(m.ChannelID, mapId)
+		if err != nil {
+			return
+		}
+
+		if found {
+			bot.ChannelMessageSend(m.ChannelID, fmt.Sprintf("unsubscribed from mapset %d", mapId))
+		} else {
+			bot.ChannelMessageSend(m.ChannelID, fmt.Sprintf("not subscribed to mapset %d", mapId))
+		}
+
+	case "query":
+		if len(parts) < 2 {
+			err = errors.New("usage: query [mode=..] [status=..] [genre=..] [language=..] [tag=..] [search text]")
+			return
+		}
+
+		var query db.Query
+		query, err = db.ParseQuery(m.ChannelID, strings.Join(parts[1:], " "))
+		if err != nil {
+			return
+		}
+
+		var id uint64
+		id, err = bot.db.AddQuery(query)
+		if err != nil {
+			return
+		}
+
+		bot.ChannelMessageSend(m.ChannelID, fmt.Sprintf("subscribed to query %d: %s", id, query))
+
+	case "queries":
+		var queries []db.Query
+		queries, err = bot.db.Queries(m.ChannelID)
+		if err != nil {
+			return
+		}
+
+		lines := make([]string, 0, len(queries))
+		for _, query := range queries {
+			lines = append(lines, fmt.Sprintf("%d: %s", query.ID, query))
+		}
+		bot.ChannelMessageSend(m.ChannelID, "queries:\n"+strings.Join(lines, "\n"))
+
+	case "unquery":
+		if len(parts) != 2 {
+			err = errors.New("usage: unquery <id>")
+			return
+		}
+
+		var id uint64
+		id, err = strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return
+		}
+
+		var found bool
+		found, err = bot.db.RemoveQuery(m.ChannelID, id)
+		if err != nil {
+			return
+		}
+
+		if found {
+			bot.ChannelMessageSend(m.ChannelID, fmt.Sprintf("unsubscribed from query %d", id))
+		} else {
+			bot.ChannelMessageSend(m.ChannelID, fmt.Sprintf("no query %d in this channel", id))
+		}
+
 	case "list":
 		mappers := make([]string, 0)
 		bot.db.IterChannelTrackedMappers(m.ChannelID, func(userId int) error {
@@ -316,12 +510,45 @@ func (bot *Bot) newMessageHandler(s *discordgo.Session, m *discordgo.MessageCrea
 			return nil
 		})
 
-		bot.ChannelMessageSend(m.ChannelID, "tracking: "+strings.Join(mappers, ", "))
+		mapsets := make([]string, 0)
+		bot.db.IterChannelTrackedMapsets(m.ChannelID, func(mapId int) error {
+			mapsets = append(mapsets, strconv.Itoa(mapId))
+			return nil
+		})
+
+		reply := "tracking: " + strings.Join(mappers, ", ")
+		if len(mapsets) > 0 {
+			reply += "\nmapsets: " + strings.Join(mapsets, ", ")
+		}
+		bot.ChannelMessageSend(m.ChannelID, reply)
+
+	case "settings":
+		keys, values := bot.db.ChannelSettings(m.ChannelID)
+		lines := make([]string, 0, len(keys))
+		for _, key := range keys {
+			lines = append(lines, fmt.Sprintf("%s = %s", key, values[key]))
+		}
+
+		bot.ChannelMessageSend(m.ChannelID, "settings:\n"+strings.Join(lines, "\n"))
+
+	case "set":
+		if len(parts) != 3 {
+			err = errors.New("usage: set <setting> <value>")
+			return
+		}
+
+		err = bot.db.SetChannelSetting(m.ChannelID, parts[1], parts[2])
+		if err != nil {
+			return
+		}
+
+		bot.ChannelMessageSend(m.ChannelID, fmt.Sprintf("set %s to %s", parts[1], parts[2]))
 	}
 
 	return
 }
 
 func (bot *Bot) Close() {
+	bot.Outbox.Stop()
 	bot.Session.Close()
 }
@@ -0,0 +1,253 @@
+package discord
+
+// Announcements aren't sent to discord directly. They're written to an outbox
+// in the database first, one message per channel, and the outbox is drained
+// in the background. A message that fails to send is retried with
+// exponential backoff, holding back later messages to the same channel so
+// they arrive in order, and is moved to the dead letters once it's clear it
+// won't ever be sent.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"subscribe-bot/db"
+)
+
+const (
+	OUTBOX_POLL_INTERVAL = 5 * time.Second
+	OUTBOX_FIRST_RETRY   = 30 * time.Second
+	OUTBOX_MAX_RETRY     = time.Hour
+	OUTBOX_MAX_ATTEMPTS  = 10
+)
+
+var errUnreadable = errors.New("message in outbox can't be read")
+
+type Outbox struct {
+	bot *Bot
+
+	wake   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+	mutex  sync.Mutex
+}
+
+func newOutbox(bot *Bot) *Outbox {
+	return &Outbox{
+		bot:  bot,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Write a message for every channel to the outbox, to be sent as soon as
+// possible. mapId is the mapset it announces, if any.
+func (bot *Bot) enqueue(channels []string, message *discordgo.MessageSend, mapId int) (ids []uint64, err error) {
+	if len(channels) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+
+	ids, err = bot.db.EnqueueOutbox(channels, db.OutboxMessage{Message: data, MapID: mapId})
+	if err != nil {
+		err = fmt.Errorf("couldn't add to outbox: %w", err)
+		return
+	}
+
+	bot.Outbox.Wake()
+	return
+}
+
+// Start sending messages from the outbox until ctx is done or Stop is called.
+// Does nothing if it's already running.
+func (outbox *Outbox) Start(ctx context.Context) {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+	if outbox.done != nil {
+		return
+	}
+
+	ctx, outbox.cancel = context.WithCancel(ctx)
+	outbox.done = make(chan struct{})
+	go outbox.run(ctx, outbox.done)
+}
+
+// Stop sending messages, waiting for the one in progress to finish
+func (outbox *Outbox) Stop() {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+	if outbox.done == nil {
+		return
+	}
+
+	outbox.cancel()
+	<-outbox.done
+	outbox.cancel, outbox.done = nil, nil
+}
+
+// Look for messages to send right away instead of at the next poll
+func (outbox *Outbox) Wake() {
+	select {
+	case outbox.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (outbox *Outbox) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	for {
+		outbox.drain(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-outbox.wake:
+		case <-time.After(OUTBOX_POLL_INTERVAL):
+		}
+	}
+}
+
+// Try every message that's due, oldest first
+func (outbox *Outbox) drain(ctx context.Context) {
+	messages, err := outbox.bot.db.OutboxMessages(false)
+	if err != nil {
+		log.Println("error reading outbox:", err)
+		return
+	}
+
+	// channels with an earlier message still waiting to be sent
+	blocked := make(map[string]bool)
+	now := time.Now()
+	for _, msg := range messages {
+		if ctx.Err() != nil {
+			return
+		}
+		if blocked[msg.ChannelID] {
+			continue
+		}
+		if msg.NextAttempt.After(now) {
+			// messages held back on purpose don't hold up anything else,
+			// only ones waiting for a retry do
+			if msg.Attempts > 0 {
+				blocked[msg.ChannelID] = true
+			}
+			continue
+		}
+
+		sentId, err := outbox.send(msg)
+		if err == nil {
+			err = outbox.bot.db.RemoveOutboxMessage(msg, sentId)
+			if err != nil {
+				log.Printf("error removing sent message %d from outbox: %s\n", msg.ID, err)
+			}
+			if msg.MapID != 0 {
+				err = outbox.bot.db.RecordAnnouncementSent(msg, sentId)
+				if err != nil {
+					log.Printf("error recording announcement %d: %s\n", msg.ID, err)
+				}
+			}
+			continue
+		}
+
+		msg.Attempts++
+		msg.LastError = err.Error()
+		if isPermanent(err) || msg.Attempts >= OUTBOX_MAX_ATTEMPTS {
+			log.Printf("giving up on message %d to %s after %d attempts: %s\n", msg.ID, msg.ChannelID, msg.Attempts, err)
+			err = outbox.bot.db.DeadLetter(msg)
+			if err != nil {
+				log.Printf("error moving message %d to dead letters: %s\n", msg.ID, err)
+				blocked[msg.ChannelID] = true
+			}
+			continue
+		}
+
+		msg.NextAttempt = now.Add(retryDelay(msg.Attempts))
+		log.Printf("error sending message %d to %s (attempt %d), retrying at %s: %s\n", msg.ID, msg.ChannelID, msg.Attempts, msg.NextAttempt, err)
+		err = outbox.bot.db.UpdateOutboxMessage(msg)
+		if err != nil {
+			log.Printf("error saving attempt at message %d: %s\n", msg.ID, err)
+		}
+		blocked[msg.ChannelID] = true
+	}
+}
+
+// Send a message, or edit the one it replaces, returning the ID of the
+// discord message
+func (outbox *Outbox) send(msg db.OutboxMessage) (sentId string, err error) {
+	var message discordgo.MessageSend
+	err = json.Unmarshal(msg.Message, &message)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", errUnreadable, err)
+		return
+	}
+
+	var sent *discordgo.Message
+	if msg.EditID != "" {
+		edit := discordgo.NewMessageEdit(msg.ChannelID, msg.EditID)
+		if message.Content != "" {
+			edit.SetContent(message.Content)
+		}
+		if message.Embed != nil {
+			edit.SetEmbed(message.Embed)
+		}
+
+		sent, err = outbox.bot.ChannelMessageEditComplex(edit)
+		if err == nil || !isPermanent(err) {
+			return messageId(sent), err
+		}
+
+		// the message is probably gone, so post a new one
+		log.Printf("couldn't edit %s in %s, posting instead: %s\n", msg.EditID, msg.ChannelID, err)
+	}
+
+	sent, err = outbox.bot.ChannelMessageSendComplex(msg.ChannelID, &message)
+	return messageId(sent), err
+}
+
+func messageId(message *discordgo.Message) string {
+	if message == nil {
+		return ""
+	}
+	return message.ID
+}
+
+// How long to wait before trying a message again after it failed some number
+// of times
+func retryDelay(attempts int) time.Duration {
+	delay := OUTBOX_FIRST_RETRY
+	for i := 1; i < attempts && delay < OUTBOX_MAX_RETRY; i++ {
+		delay *= 2
+	}
+	if delay > OUTBOX_MAX_RETRY {
+		delay = OUTBOX_MAX_RETRY
+	}
+	return delay
+}
+
+// Whether an error means the message will never be sent, like the channel
+// being deleted or the bot not being allowed in it anymore
+func isPermanent(err error) bool {
+	if errors.Is(err, errUnreadable) {
+		return true
+	}
+
+	var restErr *discordgo.RESTError
+	if !errors.As(err, &restErr) || restErr.Response == nil {
+		return false
+	}
+
+	code := restErr.Response.StatusCode
+	return code >= 400 && code < 500 && code != http.StatusTooManyRequests
+}
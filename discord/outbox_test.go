@@ -0,0 +1,310 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"subscribe-bot/config"
+	"subscribe-bot/db"
+)
+
+// Answers discord's REST API with whatever status respond gives each request,
+// remembering every request made
+type fakeDiscord struct {
+	respond func(req *http.Request) int
+
+	mutex    sync.Mutex
+	requests []string
+}
+
+func (fake *fakeDiscord) RoundTrip(req *http.Request) (*http.Response, error) {
+	fake.mutex.Lock()
+	fake.requests = append(fake.requests, req.Method+" "+strings.TrimPrefix(req.URL.Path, "/api/v"+discordgo.APIVersion))
+	fake.mutex.Unlock()
+
+	status := fake.respond(req)
+	body := "{}"
+	if status == http.StatusOK {
+		body = `{"id": "sent"}`
+	}
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// A bot that talks to a fake discord and a fresh database
+func newTestBot(t *testing.T, respond func(req *http.Request) int) (bot *Bot, fake *fakeDiscord) {
+	t.Helper()
+
+	database, err := db.OpenDb(filepath.Join(t.TempDir(), "db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(database.Close)
+
+	session, err := discordgo.New("Bot test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake = &fakeDiscord{respond: respond}
+	session.Client = &http.Client{Transport: fake}
+
+	bot = &Bot{Session: session, db: database, config: &config.Config{}}
+	bot.Outbox = newOutbox(bot)
+	return
+}
+
+// Fail requests for paths ending in any of the given suffixes with status,
+// and let everything else through
+func failing(status int, suffixes ...string) func(req *http.Request) int {
+	return func(req *http.Request) int {
+		for _, suffix := range suffixes {
+			if strings.HasSuffix(req.URL.Path, suffix) {
+				return status
+			}
+		}
+		return http.StatusOK
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, OUTBOX_FIRST_RETRY},
+		{2, 2 * OUTBOX_FIRST_RETRY},
+		{3, 4 * OUTBOX_FIRST_RETRY},
+		{7, 64 * OUTBOX_FIRST_RETRY},
+		{8, OUTBOX_MAX_RETRY},
+		{100, OUTBOX_MAX_RETRY},
+	}
+
+	for _, test := range tests {
+		if got := retryDelay(test.attempts); got != test.want {
+			t.Errorf("after %d attempts, expected %s, got %s", test.attempts, test.want, got)
+		}
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	restError := func(status int) error {
+		return &discordgo.RESTError{Response: &http.Response{StatusCode: status}}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"unreadable", fmt.Errorf("%w: bad json", errUnreadable), true},
+		{"forbidden", restError(http.StatusForbidden), true},
+		{"not found", restError(http.StatusNotFound), true},
+		{"wrapped", fmt.Errorf("couldn't send: %w", restError(http.StatusForbidden)), true},
+		{"rate limited", restError(http.StatusTooManyRequests), false},
+		{"server error", restError(http.StatusInternalServerError), false},
+		{"no response", &discordgo.RESTError{}, false},
+		{"network", errors.New("connection reset"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isPermanent(test.err); got != test.want {
+				t.Errorf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestDrain(t *testing.T) {
+	message := json.RawMessage(`{"content": "hello"}`)
+	future := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		respond func(req *http.Request) int
+		// outbox beforehand, in order
+		outbox []db.OutboxMessage
+		// requests made, and what's left of the outbox and dead letters by
+		// channel
+		requests    []string
+		remaining   []string
+		deadLetters []string
+	}{
+		{
+			"sent",
+			failing(http.StatusInternalServerError),
+			[]db.OutboxMessage{{ChannelID: "a", Message: message}, {ChannelID: "b", Message: message}},
+			[]string{"POST /channels/a/messages", "POST /channels/b/messages"},
+			nil,
+			nil,
+		},
+		{
+			"server error holds back the channel",
+			failing(http.StatusInternalServerError, "/a/messages"),
+			[]db.OutboxMessage{
+				{ChannelID: "a", Message: message},
+				{ChannelID: "a", Message: message},
+				{ChannelID: "b", Message: message},
+			},
+			[]string{"POST /channels/a/messages", "POST /channels/b/messages"},
+			[]string{"a", "a"},
+			nil,
+		},
+		{
+			"forbidden gives up",
+			failing(http.StatusForbidden, "/a/messages"),
+			[]db.OutboxMessage{{ChannelID: "a", Message: message}, {ChannelID: "a", Message: message}},
+			[]string{"POST /channels/a/messages", "POST /channels/a/messages"},
+			nil,
+			[]string{"a", "a"},
+		},
+		{
+			"out of attempts",
+			failing(http.StatusInternalServerError, "/a/messages"),
+			[]db.OutboxMessage{{ChannelID: "a", Message: message, Attempts: OUTBOX_MAX_ATTEMPTS - 1}},
+			[]string{"POST /channels/a/messages"},
+			nil,
+			[]string{"a"},
+		},
+		{
+			"unreadable",
+			failing(http.StatusInternalServerError),
+			[]db.OutboxMessage{{ChannelID: "a", Message: json.RawMessage(`"hello"`)}, {ChannelID: "a", Message: message}},
+			[]string{"POST /channels/a/messages"},
+			nil,
+			[]string{"a"},
+		},
+		{
+			"held back on purpose",
+			failing(http.StatusInternalServerError),
+			[]db.OutboxMessage{{ChannelID: "a", Message: message, NextAttempt: future}, {ChannelID: "a", Message: message}},
+			[]string{"POST /channels/a/messages"},
+			[]string{"a"},
+			nil,
+		},
+		{
+			"waiting for a retry",
+			failing(http.StatusInternalServerError),
+			[]db.OutboxMessage{
+				{ChannelID: "a", Message: message, NextAttempt: future, Attempts: 1},
+				{ChannelID: "a", Message: message},
+			},
+			nil,
+			[]string{"a", "a"},
+			nil,
+		},
+		{
+			"edit",
+			failing(http.StatusInternalServerError),
+			[]db.OutboxMessage{{ChannelID: "a", Message: message, EditID: "m1"}},
+			[]string{"PATCH /channels/a/messages/m1"},
+			nil,
+			nil,
+		},
+		{
+			"edited message is gone",
+			failing(http.StatusNotFound, "/m1"),
+			[]db.OutboxMessage{{ChannelID: "a", Message: message, EditID: "m1"}},
+			[]string{"PATCH /channels/a/messages/m1", "POST /channels/a/messages"},
+			nil,
+			nil,
+		},
+		{
+			"edit fails for now",
+			failing(http.StatusInternalServerError, "/m1"),
+			[]db.OutboxMessage{{ChannelID: "a", Message: message, EditID: "m1"}},
+			[]string{"PATCH /channels/a/messages/m1"},
+			[]string{"a"},
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bot, fake := newTestBot(t, test.respond)
+			for _, msg := range test.outbox {
+				_, err := bot.db.EnqueueOutbox([]string{msg.ChannelID}, msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			started := time.Now()
+			bot.Outbox.drain(context.Background())
+
+			if fmt.Sprint(fake.requests) != fmt.Sprint(test.requests) {
+				t.Errorf("expected requests %v, got %v", test.requests, fake.requests)
+			}
+
+			remaining, err := bot.db.OutboxMessages(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			channels := make([]string, len(remaining))
+			for i, msg := range remaining {
+				channels[i] = msg.ChannelID
+				if msg.Attempts == 1 && msg.NextAttempt.Before(future) {
+					// failed just now
+					retry := msg.NextAttempt.Sub(started)
+					if retry < OUTBOX_FIRST_RETRY || retry > OUTBOX_FIRST_RETRY+time.Minute || msg.LastError == "" {
+						t.Errorf("expected a retry in %s with the error, got %+v", OUTBOX_FIRST_RETRY, msg)
+					}
+				}
+			}
+			if fmt.Sprint(channels) != fmt.Sprint(test.remaining) {
+				t.Errorf("expected %v left in the outbox, got %v", test.remaining, channels)
+			}
+
+			letters, err := bot.db.OutboxMessages(true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			channels = make([]string, len(letters))
+			for i, msg := range letters {
+				channels[i] = msg.ChannelID
+				if msg.LastError == "" {
+					t.Errorf("dead letter %d doesn't say why", msg.ID)
+				}
+			}
+			if fmt.Sprint(channels) != fmt.Sprint(test.deadLetters) {
+				t.Errorf("expected dead letters for %v, got %v", test.deadLetters, channels)
+			}
+		})
+	}
+}
+
+func TestDrainRecordsAnnouncements(t *testing.T) {
+	bot, _ := newTestBot(t, failing(http.StatusInternalServerError))
+	err := bot.db.Announce(1, []db.Delivery{{
+		ChannelID:    "a",
+		Message:      json.RawMessage(`{"content": "update"}`),
+		Window:       time.Hour,
+		EditPrevious: true,
+		Hash:         "1",
+	}}, db.Announced{Hash: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bot.Outbox.drain(context.Background())
+	announcement, ok := bot.db.Announcement("a", 1)
+	if !ok || announcement.MessageID != "sent" {
+		t.Errorf("expected the announcement to know it was sent as message sent, got %+v", announcement)
+	}
+}
@@ -16,4 +16,5 @@ require (
 	github.com/kofalt/go-memoize v0.0.0-20200917044458-9b55a8d73e1c
 	go.etcd.io/bbolt v1.3.5
 	golang.org/x/sync v0.0.0-20201008141435-b3e1573b7520
+	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e
 )
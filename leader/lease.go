@@ -0,0 +1,187 @@
+package leader
+
+// Leader election for running several instances against the same database
+// and repositories, where only one of them may write. The leader holds a lease
+// written to a file on storage they all share, and renews it well before it
+// expires. Everyone else checks it every so often and takes it over once it
+// runs out. Taking it over is a plain write, so whoever wrote last wins, and
+// everyone reads it back after a moment to find out if it was them.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	DEFAULT_TTL = 30 * time.Second
+	// how long to wait before reading a lease back after writing it, long
+	// enough for anyone else who wrote at the same time to have done so
+	SETTLE_TIME = time.Second
+)
+
+var ErrLost = errors.New("lease was taken over")
+
+// What's written to the lease file
+type state struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+type Lease struct {
+	path   string
+	holder string
+	ttl    time.Duration
+}
+
+// A lease stored at path, held under the name holder, which has to be unique
+// between instances. A ttl of 0 uses the default.
+func New(path string, holder string, ttl time.Duration) *Lease {
+	if ttl <= 0 {
+		ttl = DEFAULT_TTL
+	}
+	return &Lease{path, holder, ttl}
+}
+
+// Campaign for the lease until ctx is done, calling lead whenever it's won.
+// The context lead gets is done as soon as the lease is lost or ctx is done,
+// and lead has to return once it is. The lease is given up after lead returns,
+// so someone else can take over right away.
+func (lease *Lease) Run(ctx context.Context, lead func(ctx context.Context)) {
+	for ctx.Err() == nil {
+		won, err := lease.acquire(ctx)
+		if err != nil {
+			log.Println("error acquiring lease:", err)
+		}
+		if !won {
+			select {
+			case <-ctx.Done():
+			case <-time.After(lease.ttl / 3):
+			}
+			continue
+		}
+
+		log.Printf("%s is now the leader\n", lease.holder)
+		leadCtx, cancel := context.WithCancel(ctx)
+		renewed := make(chan struct{})
+		go func() {
+			defer close(renewed)
+			lease.keepRenewed(leadCtx)
+			cancel()
+		}()
+
+		lead(leadCtx)
+		cancel()
+		<-renewed
+
+		err = lease.release()
+		if err != nil {
+			log.Println("error releasing lease:", err)
+		}
+		log.Printf("%s stepped down\n", lease.holder)
+	}
+}
+
+// Renew the lease every third of its ttl until ctx is done or it can't be
+// renewed
+func (lease *Lease) keepRenewed(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(lease.ttl / 3):
+		}
+
+		err := lease.renew()
+		if err != nil {
+			log.Println("couldn't renew lease, stepping down:", err)
+			return
+		}
+	}
+}
+
+// Take the lease if nobody holds it or it's expired. Returns whether it's ours
+// now.
+func (lease *Lease) acquire(ctx context.Context) (won bool, err error) {
+	current, err := lease.read()
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	if err == nil && current.Holder != lease.holder && time.Now().Before(current.Expires) {
+		return false, nil
+	}
+
+	err = lease.write()
+	if err != nil {
+		return
+	}
+
+	// someone else might have written at the same time
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-time.After(SETTLE_TIME):
+	}
+
+	current, err = lease.read()
+	if err != nil {
+		return
+	}
+	won = current.Holder == lease.holder
+	return
+}
+
+// Push back the expiry of a lease we hold
+func (lease *Lease) renew() (err error) {
+	current, err := lease.read()
+	if err != nil {
+		return
+	}
+	if current.Holder != lease.holder {
+		return fmt.Errorf("%w by %s", ErrLost, current.Holder)
+	}
+	return lease.write()
+}
+
+// Let the lease expire right away, if we still hold it
+func (lease *Lease) release() (err error) {
+	current, err := lease.read()
+	if err != nil || current.Holder != lease.holder {
+		return
+	}
+	return os.Remove(lease.path)
+}
+
+func (lease *Lease) read() (current state, err error) {
+	data, err := ioutil.ReadFile(lease.path)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &current)
+	if err != nil {
+		err = fmt.Errorf("couldn't parse lease %s: %w", lease.path, err)
+	}
+	return
+}
+
+// Write the lease as ours, replacing the file in one go so nobody reads half
+// of it
+func (lease *Lease) write() (err error) {
+	data, err := json.Marshal(state{lease.holder, time.Now().Add(lease.ttl)})
+	if err != nil {
+		return
+	}
+
+	tmp := fmt.Sprintf("%s.%s.tmp", lease.path, lease.holder)
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp, lease.path)
+}
@@ -0,0 +1,147 @@
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Write a lease file as if holder wrote it
+func writeState(t *testing.T, path string, holder string, expires time.Time) {
+	t.Helper()
+
+	data, err := json.Marshal(state{holder, expires})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	tests := []struct {
+		name string
+		// what's in the lease file beforehand, if there is one
+		setup func(t *testing.T, path string)
+		won   bool
+	}{
+		{"nobody holds it", nil, true},
+		{"held by us", func(t *testing.T, path string) {
+			writeState(t, path, "a", time.Now().Add(time.Minute))
+		}, true},
+		{"held by someone else", func(t *testing.T, path string) {
+			writeState(t, path, "b", time.Now().Add(time.Minute))
+		}, false},
+		{"someone else's expired", func(t *testing.T, path string) {
+			writeState(t, path, "b", time.Now().Add(-time.Second))
+		}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "lease")
+			if test.setup != nil {
+				test.setup(t, path)
+			}
+
+			won, err := New(path, "a", time.Minute).acquire(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if won != test.won {
+				t.Errorf("expected won to be %v", test.won)
+			}
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "lease")
+	err := ioutil.WriteFile(path, []byte("not json"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	won, err := New(path, "a", time.Minute).acquire(context.Background())
+	if err == nil || won {
+		t.Errorf("expected a broken lease file to be an error, got %v (%v)", won, err)
+	}
+}
+
+func TestRenew(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease")
+	lease := New(path, "a", time.Minute)
+	writeState(t, path, "a", time.Now().Add(time.Second))
+
+	err := lease.renew()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := lease.read()
+	if err != nil || current.Holder != "a" || !current.Expires.After(time.Now().Add(30*time.Second)) {
+		t.Errorf("lease wasn't pushed back: %+v (%v)", current, err)
+	}
+
+	writeState(t, path, "b", time.Now().Add(time.Minute))
+	err = lease.renew()
+	if !errors.Is(err, ErrLost) {
+		t.Errorf("expected ErrLost after being taken over, got %v", err)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease")
+
+	writeState(t, path, "b", time.Now().Add(time.Minute))
+	err := New(path, "a", time.Minute).release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("someone else's lease was released: %v", err)
+	}
+
+	writeState(t, path, "a", time.Now().Add(time.Minute))
+	err = New(path, "a", time.Minute).release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the lease to be gone, got %v", err)
+	}
+}
+
+func TestRunStepsDown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease")
+	lease := New(path, "a", 300*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	led := make(chan error, 1)
+	go lease.Run(ctx, func(leadCtx context.Context) {
+		// someone else takes over while we're leading
+		writeState(t, path, "b", time.Now().Add(time.Minute))
+		<-leadCtx.Done()
+		led <- ctx.Err()
+		cancel()
+	})
+
+	select {
+	case err := <-led:
+		if err != nil {
+			t.Errorf("lead only stopped when the test timed out: %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("never became the leader")
+	}
+
+	current, err := lease.read()
+	if err != nil || current.Holder != "b" {
+		t.Errorf("stepping down took the lease back from b: %+v (%v)", current, err)
+	}
+}
@@ -1,16 +1,27 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
+	bolt "go.etcd.io/bbolt"
+
+	"subscribe-bot/backup"
 	"subscribe-bot/config"
 	"subscribe-bot/db"
 	"subscribe-bot/discord"
+	"subscribe-bot/leader"
+	"subscribe-bot/maintenance"
 	"subscribe-bot/osuapi"
+	"subscribe-bot/repo"
 	"subscribe-bot/scrape"
 	"subscribe-bot/web"
 )
@@ -29,31 +40,132 @@ func main() {
 	}
 
 	api := osuapi.New(&config)
-
-	db, err := db.OpenDb(config.DatabasePath, api)
+	repos, err := repo.New(config.Storage, config.Repos)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Println("opened db")
 
-	bot, err := discord.NewBot(&config, db, api)
-	if err != nil {
-		log.Fatal(err)
+	switch flag.Arg(0) {
+	case "":
+	case "maintain":
+		report, err := maintenance.Run(&config, repos)
+		if err != nil {
+			log.Fatal(err)
+		}
+		report.Print(os.Stdout)
+		return
+	case "migrate-storage":
+		migrateStorage(&config, flag.Arg(1), flag.Arg(2))
+		return
+	case "migrate-layout":
+		migrateLayout(repos)
+		return
+	case "backup":
+		writeBackup(&config, repos, flag.Arg(1))
+		return
+	case "restore":
+		restoreBackup(&config, flag.Arg(1))
+		return
+	case "dry-run":
+		dryRun(&config, api, repos, flag.Args()[1:])
+		return
+	default:
+		log.Fatalf("unknown command %s", flag.Arg(0))
 	}
 
-	go scrape.RunScraper(&config, bot, db, api)
-	go web.RunWeb(&config, api, GitCommit)
+	ctx, cancel := context.WithCancel(context.Background())
+	server := web.New(&config, api, repos, GitCommit)
+	go server.Run()
+
+	// set while this instance leads, for SIGUSR1
+	var leading *scrape.Scraper
+	var leadingMutex sync.Mutex
+	setLeading := func(scraper *scrape.Scraper) {
+		leadingMutex.Lock()
+		defer leadingMutex.Unlock()
+		leading = scraper
+	}
+
+	lead := func(ctx context.Context) (err error) {
+		db, err := db.OpenDb(config.DatabasePath, api)
+		if err != nil {
+			return
+		}
+		defer db.Close()
+		log.Println("opened db")
+
+		bot, err := discord.NewBot(&config, db, api)
+		if err != nil {
+			return
+		}
+		defer bot.Close()
+		bot.Outbox.Start(ctx)
+
+		scraper, err := scrape.New(&config, bot, db, api, repos, GitCommit)
+		if err != nil {
+			return
+		}
+		scraper.Start(ctx)
+		defer scraper.Stop()
+		maintained := make(chan struct{})
+		go func() {
+			defer close(maintained)
+			maintenance.RunPeriodically(ctx, &config, repos)
+		}()
+		// nothing may be written once the lease is given up
+		defer func() { <-maintained }()
+
+		setLeading(scraper)
+		server.Attach(db, scraper)
+		<-ctx.Done()
+		server.Detach()
+		setLeading(nil)
+		return
+	}
+
+	done := make(chan struct{})
+	if config.Leader.LeasePath == "" {
+		go func() {
+			defer close(done)
+			err := lead(ctx)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}()
+	} else {
+		lease := leader.New(config.Leader.LeasePath, instanceId(&config), config.Leader.Ttl.Duration)
+		go func() {
+			defer close(done)
+			lease.Run(ctx, func(ctx context.Context) {
+				err := lead(ctx)
+				if err != nil {
+					log.Println("couldn't lead:", err)
+				}
+			})
+		}()
+	}
 
 	signal_chan := make(chan os.Signal, 1)
 	signal.Notify(signal_chan,
 		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM,
-		syscall.SIGQUIT)
+		syscall.SIGQUIT,
+		syscall.SIGUSR1)
 	go func() {
 		for {
 			s := <-signal_chan
 			switch s {
+			case syscall.SIGUSR1:
+				leadingMutex.Lock()
+				scraper := leading
+				leadingMutex.Unlock()
+				if scraper == nil {
+					log.Println("not the leader, not scraping")
+					continue
+				}
+				log.Println("scraping now")
+				scraper.ScrapeNow()
 			case syscall.SIGHUP:
 				fallthrough
 			case syscall.SIGINT:
@@ -69,8 +181,182 @@ func main() {
 	}()
 	code := <-exit_chan
 
-	db.Close()
-	bot.Close()
-	scrape.Ticker.Stop()
+	cancel()
+	<-done
 	os.Exit(code)
 }
+
+// The name this instance holds the lease under
+func instanceId(config *config.Config) string {
+	if config.Leader.ID != "" {
+		return config.Leader.ID
+	}
+
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// Copy every repository between two storage backends rooted at the same
+// repos directory
+func migrateStorage(config *config.Config, fromKind string, toKind string) {
+	if fromKind == "" || toKind == "" || fromKind == toKind {
+		log.Fatal("usage: subscribe-bot migrate-storage <from> <to>, with two different backends out of dir and packed")
+	}
+
+	from, err := repo.New(fromKind, config.Repos)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	to, err := repo.New(toKind, config.Repos)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := 0
+	err = repo.Migrate(from, to, func(key repo.Key, err error) {
+		if err != nil {
+			failed++
+			log.Printf("couldn't migrate %d: %s\n", key.MapID, err)
+			return
+		}
+		log.Printf("migrated %d\n", key.MapID)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("done, %d failed. set storage = %q in the config to use the new backend\n", failed, toKind)
+}
+
+// Move repositories from the old layout keyed by mapper and mapset into the
+// one keyed by mapset alone
+func migrateLayout(repos repo.Backend) {
+	failed := 0
+	err := repo.MigrateLayout(repos, func(mapId int, hosts []int, err error) {
+		if err != nil {
+			failed++
+			log.Printf("couldn't migrate %d: %s\n", mapId, err)
+			return
+		}
+		if len(hosts) > 1 {
+			log.Printf("migrated %d, joined the history of hosts %v\n", mapId, hosts)
+			return
+		}
+		log.Printf("migrated %d\n", mapId)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("done, %d failed\n", failed)
+}
+
+// Back up the database and repositories while the bot isn't running. A
+// running bot keeps the database locked, so backups have to be downloaded from
+// /admin/backup instead.
+func writeBackup(config *config.Config, repos repo.Backend, out string) {
+	if out == "" {
+		out = backup.FileName(time.Now())
+	}
+
+	database, err := bolt.Open(config.DatabasePath, 0666, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		log.Fatal("the database is in use, download a backup from /admin/backup instead")
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	defer database.Close()
+
+	file, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = backup.Write(file, database, repos, config, GitCommit)
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(out)
+		log.Fatal(err)
+	}
+
+	log.Println("wrote backup to", out)
+}
+
+func restoreBackup(config *config.Config, in string) {
+	if in == "" {
+		log.Fatal("usage: subscribe-bot restore <backup.tar.gz>")
+	}
+
+	file, err := os.Open(in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	manifest, err := backup.Restore(file, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("restored %d files from a backup made at %s\n", len(manifest.Files), manifest.CreatedAt.Format(time.RFC3339))
+}
+
+// Print what a scrape would do without writing anything or posting to
+// discord, optionally against recorded API responses or a range of time
+func dryRun(config *config.Config, api *osuapi.Osuapi, repos repo.Backend, args []string) {
+	flags := flag.NewFlagSet("dry-run", flag.ExitOnError)
+	replay := flags.String("replay", "", "Directory of recorded API responses to use instead of the API")
+	from := flags.String("from", "", "Only look at updates after this time (RFC3339), instead of since the saved cursors")
+	to := flags.String("to", "", "Only look at updates up to this time (RFC3339), instead of up to now")
+	format := flags.String("format", "text", "Output format, text or json")
+	flags.Parse(args)
+	if *format != "text" && *format != "json" {
+		log.Fatalf("unknown format %s", *format)
+	}
+
+	var opts scrape.DryRunOptions
+	var err error
+	if *from != "" {
+		opts.From, err = time.Parse(time.RFC3339, *from)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *to != "" {
+		opts.To, err = time.Parse(time.RFC3339, *to)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *replay != "" {
+		api.ReplayFrom(*replay)
+	}
+
+	database, err := db.OpenDbReadOnly(config.DatabasePath, api)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer database.Close()
+
+	scraper, err := scrape.New(config, nil, database, api, repos, GitCommit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	report := scraper.DryRun(opts)
+
+	if *format == "text" {
+		report.Print(os.Stdout)
+		return
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(report)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
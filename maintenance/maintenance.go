@@ -0,0 +1,189 @@
+package maintenance
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"subscribe-bot/config"
+	"subscribe-bot/repo"
+)
+
+type MapsetUsage struct {
+	repo.Key
+	Bytes     int64
+	Revisions int
+	Status    string
+	// Revisions dropped by this run to stay under quota
+	Removed int
+}
+
+type MapperUsage struct {
+	UserID  int
+	Bytes   int64
+	Mapsets int
+}
+
+type Report struct {
+	Mapsets []MapsetUsage
+	Mappers []MapperUsage
+	Total   int64
+	Errors  []error
+}
+
+// Enforce quotas on every repository, repack it and measure how big it is
+// afterwards. Errors with individual repositories are collected in the report
+// rather than stopping the run.
+func Run(config *config.Config, repos repo.Backend) (report Report, err error) {
+	keys, err := repos.List()
+	if err != nil {
+		return
+	}
+
+	mappers := make(map[int]*MapperUsage)
+	for _, key := range keys {
+		usage, err := maintain(config, repos, key)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Errorf("%d: %w", key.MapID, err))
+			continue
+		}
+		report.Mapsets = append(report.Mapsets, usage)
+		report.Total += usage.Bytes
+
+		mapper, ok := mappers[key.UserID]
+		if !ok {
+			mapper = &MapperUsage{UserID: key.UserID}
+			mappers[key.UserID] = mapper
+		}
+		mapper.Bytes += usage.Bytes
+		mapper.Mapsets++
+	}
+
+	err = repos.Gc()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("couldn't clean up shared storage: %w", err))
+		err = nil
+	}
+
+	for _, mapper := range mappers {
+		report.Mappers = append(report.Mappers, *mapper)
+	}
+	sort.Slice(report.Mappers, func(i, j int) bool {
+		return report.Mappers[i].Bytes > report.Mappers[j].Bytes
+	})
+	sort.Slice(report.Mapsets, func(i, j int) bool {
+		return report.Mapsets[i].Bytes > report.Mapsets[j].Bytes
+	})
+	return
+}
+
+func maintain(config *config.Config, repos repo.Backend, key repo.Key) (usage MapsetUsage, err error) {
+	unlock := repos.Lock(key.MapID)
+	defer unlock()
+
+	usage.Key = key
+	r, err := repos.Open(key.MapID)
+	if err != nil {
+		return
+	}
+
+	usage.Status, err = r.LastStatus()
+	if err != nil {
+		return
+	}
+
+	keep := config.Maintenance.MaxRevisions
+	if usage.Status == repo.STATUS_GRAVEYARDED && config.Maintenance.GraveyardRevisions > 0 {
+		keep = config.Maintenance.GraveyardRevisions
+	}
+	if keep > 0 {
+		usage.Removed, err = r.Truncate(keep)
+		if err != nil {
+			err = fmt.Errorf("couldn't truncate: %w", err)
+			return
+		}
+	}
+
+	err = r.Repack()
+	if err != nil {
+		return
+	}
+
+	usage.Revisions, err = r.CountRevisions()
+	if err != nil {
+		return
+	}
+
+	usage.Bytes, err = r.DiskUsage()
+	return
+}
+
+// Write a human readable version of the report
+func (report *Report) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "total\t%s\n\n", humanize.Bytes(uint64(report.Total)))
+
+	fmt.Fprintln(tw, "mapper\tsize\tmapsets")
+	for _, mapper := range report.Mappers {
+		fmt.Fprintf(tw, "%d\t%s\t%d\n", mapper.UserID, humanize.Bytes(uint64(mapper.Bytes)), mapper.Mapsets)
+	}
+
+	fmt.Fprintln(tw, "\nmapset\tmapper\tsize\trevisions\tremoved\tstatus")
+	for _, mapset := range report.Mapsets {
+		fmt.Fprintf(
+			tw, "%d\t%d\t%s\t%d\t%d\t%s\n",
+			mapset.MapID,
+			mapset.UserID,
+			humanize.Bytes(uint64(mapset.Bytes)),
+			mapset.Revisions,
+			mapset.Removed,
+			mapset.Status,
+		)
+	}
+	tw.Flush()
+
+	for _, err := range report.Errors {
+		fmt.Fprintln(w, "error:", err)
+	}
+}
+
+// Run maintenance on the configured interval until ctx is done
+func RunPeriodically(ctx context.Context, config *config.Config, repos repo.Backend) {
+	interval := config.Maintenance.Interval.Duration
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		report, err := Run(config, repos)
+		if err != nil {
+			log.Println("maintenance failed:", err)
+			continue
+		}
+
+		log.Printf(
+			"maintenance done: %d repos, %s total, %d errors\n",
+			len(report.Mapsets),
+			humanize.Bytes(uint64(report.Total)),
+			len(report.Errors),
+		)
+		for _, err := range report.Errors {
+			log.Println("maintenance error:", err)
+		}
+	}
+}
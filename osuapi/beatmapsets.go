@@ -1,16 +1,43 @@
 package osuapi
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+)
+
+const (
+	SORT_UPDATED_DESC = "updated_desc"
+	SORT_RANKED_DESC  = "ranked_desc"
 )
 
 func (api *Osuapi) SearchBeatmaps(rankStatus string) (beatmapSearch BeatmapSearch, err error) {
+	return api.SearchBeatmapsPage(rankStatus, SORT_UPDATED_DESC, nil)
+}
+
+// Search for mapsets with the given status in the given order. Pass the
+// previous page to get the one after it.
+func (api *Osuapi) SearchBeatmapsPage(rankStatus string, sort string, previous *BeatmapSearch) (beatmapSearch BeatmapSearch, err error) {
 	values := url.Values{}
 	values.Set("s", rankStatus)
+	values.Set("sort", sort)
+	if previous != nil {
+		if previous.CursorString != "" {
+			values.Set("cursor_string", previous.CursorString)
+		}
+		for key, raw := range previous.Cursor {
+			var value string
+			if json.Unmarshal(raw, &value) != nil {
+				value = string(raw)
+			}
+			values.Set("cursor["+key+"]", value)
+		}
+	}
 	query := values.Encode()
 	url := "/beatmapsets/search?" + query
 	err = api.Request("GET", url, &beatmapSearch)
@@ -21,18 +48,32 @@ func (api *Osuapi) SearchBeatmaps(rankStatus string) (beatmapSearch BeatmapSearc
 	return
 }
 
+// Download a single difficulty's .osu file to path. Nothing is left at path if
+// the download fails partway.
 func (api *Osuapi) DownloadSingleBeatmap(beatmapId int, path string) (err error) {
 	url := fmt.Sprintf("https://osu.ppy.sh/osu/%d", beatmapId)
 	resp, err := api.httpClient.Get(url)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("not 200: %s", resp.Status)
+		return
+	}
 
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return
 	}
 
 	_, err = io.Copy(file, resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		return
+		os.Remove(path)
 	}
 	return
 }
@@ -47,12 +88,15 @@ func (api *Osuapi) GetBeatmapSet(beatmapSetId int) (beatmapSet Beatmapset, err e
 	return
 }
 
+// Download a whole mapset as an .osz into a temporary file. The caller is
+// responsible for removing it.
 func (api *Osuapi) BeatmapsetDownload(beatmapSetId int) (path string, err error) {
 	url := fmt.Sprintf("/beatmapsets/%d/download", beatmapSetId)
 	resp, err := api.Request0("GET", url)
 	if err != nil {
 		return
 	}
+	defer resp.Body.Close()
 
 	file, err := ioutil.TempFile(os.TempDir(), "beatmapsetDownload")
 	if err != nil {
@@ -60,36 +104,46 @@ func (api *Osuapi) BeatmapsetDownload(beatmapSetId int) (path string, err error)
 	}
 
 	_, err = io.Copy(file, resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		os.Remove(file.Name())
 		return
 	}
-	file.Close()
 
 	path = file.Name()
 	return
 }
 
+const (
+	EVENT_NOMINATE         = "nominate"
+	EVENT_QUALIFY          = "qualify"
+	EVENT_DISQUALIFY       = "disqualify"
+	EVENT_NOMINATION_RESET = "nomination_reset"
+)
+
 type GetBeatmapsetEventsOptions struct {
 	User  string
 	Types []string
+	// Page to fetch, starting from 1. Left out if it's 0, which is the first
+	// page too.
+	Page int
 }
 
-func (api *Osuapi) GetBeatmapsetEvents(opts *GetBeatmapsetEventsOptions) (events []BeatmapsetEvent, err error) {
+// Get the most recent beatmapset events, newest first, along with everyone who
+// caused them
+func (api *Osuapi) GetBeatmapsetEvents(opts *GetBeatmapsetEventsOptions) (reply BeatmapsetEvents, err error) {
 	values := url.Values{}
 	values.Set("user", opts.User)
 	query := values.Encode()
 	for _, t := range opts.Types {
 		query += "&types[]=" + t
 	}
+	if opts.Page > 0 {
+		query += "&page=" + strconv.Itoa(opts.Page)
+	}
 	url := "/beatmapsets/events?" + query
-	fmt.Println("URL IS", url)
-
-	var reply BeatmapsetEvents
 	err = api.Request("GET", url, &reply)
-	if err != nil {
-		return
-	}
-
-	events = reply.Events
 	return
 }
@@ -1,5 +1,7 @@
 package osuapi
 
+import "encoding/json"
+
 type User struct {
 	ID          int    `json:"id"`
 	Username    string `json:"username"`
@@ -15,16 +17,30 @@ type Beatmapset struct {
 	TitleUnicode  string `json:"title_unicode"`
 	Creator       string `json:"creator"`
 	UserID        int    `json:"user_id"`
+	Status        string `json:"status"`
+	Source        string `json:"source"`
+	// Space separated
+	Tags       string `json:"tags"`
+	GenreID    int    `json:"genre_id"`
+	LanguageID int    `json:"language_id"`
 
 	Covers      BeatmapCovers `json:"covers"`
 	Beatmaps    []Beatmap     `json:"beatmaps,omitempty"`
 	LastUpdated string        `json:"last_updated,omitempty"`
+	// When the mapset was qualified, ranked or loved, depending on its status
+	RankedDate string `json:"ranked_date,omitempty"`
 }
 
 type Beatmap struct {
 	ID               int     `json:"id"`
 	DifficultyRating float64 `json:"difficulty_rating"`
 	DifficultyName   string  `json:"version"`
+	Checksum         string  `json:"checksum"`
+	// One of osu, taiko, fruits or mania
+	Mode string `json:"mode"`
+	// Creator of this difficulty, which differs from the mapset's for guest
+	// difficulties
+	UserID int `json:"user_id"`
 }
 
 type BeatmapCovers struct {
@@ -62,10 +78,20 @@ type EventUser struct {
 
 type BeatmapSearch struct {
 	Beatmapsets []Beatmapset `json:"beatmapsets"`
+	// Where the next page starts, both empty on the last page. Values are kept
+	// raw since they can be big numbers.
+	Cursor       map[string]json.RawMessage `json:"cursor"`
+	CursorString string                     `json:"cursor_string"`
+}
+
+func (search *BeatmapSearch) HasNextPage() bool {
+	return len(search.Cursor) > 0 || search.CursorString != ""
 }
 
 type BeatmapsetEvents struct {
 	Events []BeatmapsetEvent `json:"events"`
+	// Everyone who caused one of the events
+	Users []EventUserCompact `json:"users"`
 }
 
 type BeatmapsetEvent struct {
@@ -73,4 +99,59 @@ type BeatmapsetEvent struct {
 	Type       string     `json:"type"`
 	Beatmapset Beatmapset `json:"beatmapset"`
 	UserID     int        `json:"user_id"`
+	CreatedAt  string     `json:"created_at"`
+	// Depends on the type, a plain string for some and an object for others
+	Comment json.RawMessage `json:"comment,omitempty"`
+	// The discussion that caused a disqualification or nomination reset
+	Discussion *EventDiscussion `json:"discussion,omitempty"`
+}
+
+type EventUserCompact struct {
+	ID        int    `json:"id"`
+	Username  string `json:"username"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+type EventDiscussion struct {
+	ID           int                  `json:"id"`
+	StartingPost *EventDiscussionPost `json:"starting_post,omitempty"`
+}
+
+type EventDiscussionPost struct {
+	Message string `json:"message"`
+}
+
+// Genre IDs by the name the website uses for them
+var GENRES = map[string]int{
+	"unspecified": 1,
+	"video-game":  2,
+	"anime":       3,
+	"rock":        4,
+	"pop":         5,
+	"other":       6,
+	"novelty":     7,
+	"hip-hop":     9,
+	"electronic":  10,
+	"metal":       11,
+	"classical":   12,
+	"folk":        13,
+	"jazz":        14,
+}
+
+// Language IDs by the name the website uses for them
+var LANGUAGES = map[string]int{
+	"unspecified":  1,
+	"english":      2,
+	"japanese":     3,
+	"chinese":      4,
+	"instrumental": 5,
+	"korean":       6,
+	"french":       7,
+	"german":       8,
+	"swedish":      9,
+	"spanish":      10,
+	"italian":      11,
+	"russian":      12,
+	"polish":       13,
+	"other":        14,
 }
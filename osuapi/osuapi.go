@@ -2,13 +2,18 @@ package osuapi
 
 import (
 	"context"
+	"crypto/sha1"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sync/semaphore"
@@ -16,35 +21,61 @@ import (
 	"subscribe-bot/config"
 )
 
-const BASE_URL = "https://osu.ppy.sh/api/v2"
+const (
+	BASE_URL = "https://osu.ppy.sh/api/v2"
+
+	// want to cap at around 1000 requests a minute, OSU cap is 1200
+	REQUESTS_PER_MINUTE = 1000
+)
 
 type Osuapi struct {
 	httpClient *http.Client
 	lock       *semaphore.Weighted
-	token      string
-	expires    time.Time
-	config     *config.Config
+	// requests made in the last minute
+	used    int64
+	token   string
+	expires time.Time
+	config  *config.Config
 
 	tokenLock       sync.RWMutex
 	isFetchingToken bool
+
+	// directory responses are saved to, if any
+	record string
+	// directory responses are read back from instead of making requests
+	replay string
 }
 
+var ErrNotRecorded = errors.New("no recorded response")
+
 func New(config *config.Config) *Osuapi {
 	client := &http.Client{
 		Timeout: 9 * time.Second,
 	}
 
-	// want to cap at around 1000 requests a minute, OSU cap is 1200
-	lock := semaphore.NewWeighted(1000)
+	lock := semaphore.NewWeighted(REQUESTS_PER_MINUTE)
 
 	return &Osuapi{
 		httpClient: client,
 		lock:       lock,
 		expires:    time.Now(),
 		config:     config,
+		record:     config.RecordApi,
 	}
 }
 
+// Answer requests with the responses recorded in dir instead of asking the
+// API. Requests that weren't recorded fail with ErrNotRecorded.
+func (api *Osuapi) ReplayFrom(dir string) {
+	api.replay = dir
+}
+
+// Recorded responses are named after a hash of the request, and only the
+// latest response to each request is kept
+func recordingPath(dir string, action string, url string) string {
+	return filepath.Join(dir, fmt.Sprintf("%x.json", sha1.Sum([]byte(action+" "+url))))
+}
+
 func (api *Osuapi) Token() (token string, err error) {
 	if time.Now().Before(api.expires) {
 		token = api.token
@@ -96,30 +127,46 @@ func (api *Osuapi) Token() (token string, err error) {
 	return
 }
 
+// How many more requests can be made right away before hitting the cap
+func (api *Osuapi) BudgetRemaining() int {
+	return REQUESTS_PER_MINUTE - int(atomic.LoadInt64(&api.used))
+}
+
 func (api *Osuapi) Request0(action string, url string) (resp *http.Response, err error) {
 	err = api.lock.Acquire(context.TODO(), 1)
 	if err != nil {
 		return
 	}
+	atomic.AddInt64(&api.used, 1)
+
+	// release the lock after 1 minute, since the request counts against the
+	// cap whether it works or not
+	go func() {
+		time.Sleep(time.Minute)
+		atomic.AddInt64(&api.used, -1)
+		api.lock.Release(1)
+	}()
+
 	apiUrl := BASE_URL + url
 	req, err := http.NewRequest(action, apiUrl, nil)
-
-	token, err := api.Token()
 	if err != nil {
 		return
 	}
 
-	req.Header.Add("Authorization", "Bearer "+token)
+	token, err := api.Token()
 	if err != nil {
 		return
 	}
 
+	req.Header.Add("Authorization", "Bearer "+token)
+
 	resp, err = api.httpClient.Do(req)
 	if err != nil {
 		return
 	}
 
 	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
 		var respBody []byte
 		respBody, err = ioutil.ReadAll(resp.Body)
 		if err != nil {
@@ -130,25 +177,38 @@ func (api *Osuapi) Request0(action string, url string) (resp *http.Response, err
 		return
 	}
 
-	// release the lock after 1 minute
-	go func() {
-		time.Sleep(time.Minute)
-		api.lock.Release(1)
-	}()
 	return
 }
 
 func (api *Osuapi) Request(action string, url string, result interface{}) (err error) {
+	if api.replay != "" {
+		data, err := ioutil.ReadFile(recordingPath(api.replay, action, url))
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w for %s %s", ErrNotRecorded, action, url)
+		} else if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, result)
+	}
+
 	resp, err := api.Request0(action, url)
 	if err != nil {
 		return
 	}
+	defer resp.Body.Close()
 
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return
 	}
 
+	if api.record != "" {
+		recordErr := ioutil.WriteFile(recordingPath(api.record, action, url), data, 0644)
+		if recordErr != nil {
+			log.Printf("couldn't record response to %s %s: %s\n", action, url, recordErr)
+		}
+	}
+
 	err = json.Unmarshal(data, result)
 	if err != nil {
 		return
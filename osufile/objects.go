@@ -0,0 +1,126 @@
+package osufile
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	SECTION_TIMING_POINTS = "TimingPoints"
+	SECTION_HIT_OBJECTS   = "HitObjects"
+)
+
+// Hit object type bits
+const (
+	typeCircle   = 1
+	typeSlider   = 2
+	typeNewCombo = 4
+	typeSpinner  = 8
+	typeHold     = 128
+)
+
+// When a timing point or hit object line happens, in milliseconds
+func LineTime(section string, line string) (ms float64, ok bool) {
+	fields := strings.Split(line, ",")
+	var field int
+	switch section {
+	case SECTION_TIMING_POINTS:
+		field = 0
+	case SECTION_HIT_OBJECTS:
+		field = 2
+	default:
+		return
+	}
+	if len(fields) <= field {
+		return
+	}
+
+	ms, err := strconv.ParseFloat(strings.TrimSpace(fields[field]), 64)
+	ok = err == nil
+	return
+}
+
+// A short human readable summary of a timing point or hit object line
+func DescribeLine(section string, line string) string {
+	fields := strings.Split(line, ",")
+	switch section {
+	case SECTION_TIMING_POINTS:
+		return describeTimingPoint(fields)
+	case SECTION_HIT_OBJECTS:
+		return describeHitObject(fields)
+	}
+	return ""
+}
+
+func describeTimingPoint(fields []string) (desc string) {
+	if len(fields) < 2 {
+		return "timing point"
+	}
+
+	beatLength, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return "timing point"
+	}
+
+	// uninherited defaults to true for old files that don't have the field
+	uninherited := len(fields) < 7 || fields[6] == "1"
+	if uninherited && beatLength > 0 {
+		desc = fmt.Sprintf("timing, %s BPM", strconv.FormatFloat(60000/beatLength, 'f', -1, 64))
+	} else if beatLength < 0 {
+		desc = fmt.Sprintf("inherited, %sx SV", strconv.FormatFloat(-100/beatLength, 'f', 2, 64))
+	} else {
+		desc = "timing point"
+	}
+
+	if len(fields) >= 8 {
+		effects, _ := strconv.Atoi(fields[7])
+		if effects&1 != 0 {
+			desc += ", kiai"
+		}
+	}
+	return
+}
+
+func describeHitObject(fields []string) (desc string) {
+	if len(fields) < 4 {
+		return "hit object"
+	}
+
+	objType, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return "hit object"
+	}
+
+	switch {
+	case objType&typeCircle != 0:
+		desc = "circle"
+	case objType&typeSlider != 0:
+		desc = "slider"
+	case objType&typeSpinner != 0:
+		desc = "spinner"
+	case objType&typeHold != 0:
+		desc = "hold note"
+	default:
+		desc = "hit object"
+	}
+
+	if objType&typeSpinner == 0 {
+		desc += fmt.Sprintf(" at %s,%s", fields[0], fields[1])
+	}
+	if objType&typeNewCombo != 0 {
+		desc += ", new combo"
+	}
+	return
+}
+
+// Format a time the way the editor shows it, like 01:23:456
+func FormatTime(ms float64) string {
+	total := int(ms)
+	sign := ""
+	if total < 0 {
+		sign = "-"
+		total = -total
+	}
+	return fmt.Sprintf("%s%02d:%02d:%03d", sign, total/60000, total/1000%60, total%1000)
+}
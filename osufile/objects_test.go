@@ -0,0 +1,78 @@
+package osufile
+
+import "testing"
+
+func TestLineTime(t *testing.T) {
+	tests := []struct {
+		section string
+		line    string
+		ms      float64
+		ok      bool
+	}{
+		{SECTION_TIMING_POINTS, "1000,500,4,2,0,50,1,0", 1000, true},
+		{SECTION_TIMING_POINTS, "1234.5,-100,4,2,0,50,0,0", 1234.5, true},
+		{SECTION_TIMING_POINTS, "later,500", 0, false},
+		{SECTION_HIT_OBJECTS, "256,192,1500,1,0,0:0:0:0:", 1500, true},
+		{SECTION_HIT_OBJECTS, "256,192", 0, false},
+		{SECTION_HIT_OBJECTS, "256,192, 2000 ,1,0", 2000, true},
+		{"Events", "0,0,\"bg.jpg\",0,0", 0, false},
+	}
+
+	for _, test := range tests {
+		ms, ok := LineTime(test.section, test.line)
+		if ok != test.ok || (ok && ms != test.ms) {
+			t.Errorf("%s %q: expected %v %v, got %v %v", test.section, test.line, test.ms, test.ok, ms, ok)
+		}
+	}
+}
+
+func TestDescribeLine(t *testing.T) {
+	tests := []struct {
+		section string
+		line    string
+		want    string
+	}{
+		{SECTION_TIMING_POINTS, "0,500,4,2,0,50,1,0", "timing, 120 BPM"},
+		{SECTION_TIMING_POINTS, "0,500,4,2,0,50,1,1", "timing, 120 BPM, kiai"},
+		{SECTION_TIMING_POINTS, "0,500", "timing, 120 BPM"},
+		{SECTION_TIMING_POINTS, "0,-50,4,2,0,50,0,0", "inherited, 2.00x SV"},
+		{SECTION_TIMING_POINTS, "0,-100,4,2,0,50,0,1", "inherited, 1.00x SV, kiai"},
+		{SECTION_TIMING_POINTS, "0,0,4,2,0,50,1,0", "timing point"},
+		{SECTION_TIMING_POINTS, "0", "timing point"},
+		{SECTION_TIMING_POINTS, "0,fast", "timing point"},
+		{SECTION_HIT_OBJECTS, "256,192,1000,1,0", "circle at 256,192"},
+		{SECTION_HIT_OBJECTS, "256,192,1000,5,0", "circle at 256,192, new combo"},
+		{SECTION_HIT_OBJECTS, "100,100,1000,2,0,B|200:200,1,100", "slider at 100,100"},
+		{SECTION_HIT_OBJECTS, "256,192,1000,12,0,2000", "spinner, new combo"},
+		{SECTION_HIT_OBJECTS, "64,192,1000,128,0,1500:0:0:0:0:", "hold note at 64,192"},
+		{SECTION_HIT_OBJECTS, "256,192,1000,0,0", "hit object at 256,192"},
+		{SECTION_HIT_OBJECTS, "256,192,1000", "hit object"},
+		{SECTION_HIT_OBJECTS, "256,192,1000,circle", "hit object"},
+		{"Events", "0,0,\"bg.jpg\",0,0", ""},
+	}
+
+	for _, test := range tests {
+		if got := DescribeLine(test.section, test.line); got != test.want {
+			t.Errorf("%s %q: expected %q, got %q", test.section, test.line, test.want, got)
+		}
+	}
+}
+
+func TestFormatTime(t *testing.T) {
+	tests := []struct {
+		ms   float64
+		want string
+	}{
+		{0, "00:00:000"},
+		{83456, "01:23:456"},
+		{83456.9, "01:23:456"},
+		{3600000, "60:00:000"},
+		{-1500, "-00:01:500"},
+	}
+
+	for _, test := range tests {
+		if got := FormatTime(test.ms); got != test.want {
+			t.Errorf("%v: expected %q, got %q", test.ms, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package osufile
+
+// Just enough of the .osu format to name files and look at hit objects.
+// Sections are kept as raw lines, anything that needs more parses them itself.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type File struct {
+	// From the "osu file format v14" header, 0 if it's missing
+	FormatVersion int
+	// Lines of every section by name, without blank lines and comments
+	Sections map[string][]string
+}
+
+type Metadata struct {
+	Artist       string
+	Title        string
+	Creator      string
+	Version      string
+	BeatmapID    int
+	BeatmapSetID int
+}
+
+const formatHeader = "osu file format v"
+
+func Parse(r io.Reader) (file *File, err error) {
+	file = &File{Sections: make(map[string][]string)}
+	section := ""
+
+	scanner := bufio.NewScanner(r)
+	// storyboard lines can get long
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	first := true
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if first {
+			line = strings.TrimPrefix(line, "\ufeff")
+			first = false
+			if strings.HasPrefix(line, formatHeader) {
+				file.FormatVersion, _ = strconv.Atoi(strings.TrimPrefix(line, formatHeader))
+				continue
+			}
+		}
+
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line[1 : len(line)-1]
+			continue
+		}
+
+		file.Sections[section] = append(file.Sections[section], line)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		err = fmt.Errorf("couldn't read .osu file: %w", err)
+	}
+	return
+}
+
+// Read a section made of "Key: Value" lines
+func (file *File) Values(section string) (values map[string]string) {
+	values = make(map[string]string)
+	for _, line := range file.Sections[section] {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		values[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return
+}
+
+func (file *File) Metadata() (meta Metadata) {
+	values := file.Values("Metadata")
+	meta.Artist = values["Artist"]
+	meta.Title = values["Title"]
+	meta.Creator = values["Creator"]
+	meta.Version = values["Version"]
+	meta.BeatmapID, _ = strconv.Atoi(values["BeatmapID"])
+	meta.BeatmapSetID, _ = strconv.Atoi(values["BeatmapSetID"])
+	return
+}
+
+// The name osu! gives this difficulty's file
+func (meta *Metadata) FileName() string {
+	return SanitizeFileName(fmt.Sprintf("%s - %s (%s) [%s].osu", meta.Artist, meta.Title, meta.Creator, meta.Version))
+}
+
+// Drop characters that can't appear in file names on Windows, the same way
+// osu! does
+func SanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return -1
+		}
+		return r
+	}, name)
+}
@@ -0,0 +1,156 @@
+package osufile
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		version int
+		// lines of each section expected
+		sections map[string][]string
+	}{
+		{
+			"header",
+			"osu file format v14\n\n[General]\nMode: 0\n",
+			14,
+			map[string][]string{"General": {"Mode: 0"}},
+		},
+		{
+			"byte order mark",
+			"\ufeffosu file format v12\n[General]\nMode: 1\n",
+			12,
+			map[string][]string{"General": {"Mode: 1"}},
+		},
+		{
+			"no header",
+			"[General]\nMode: 0\n",
+			0,
+			map[string][]string{"General": {"Mode: 0"}},
+		},
+		{
+			"blank lines and comments",
+			"osu file format v14\n[Events]\n// Background\n\n0,0,\"bg.jpg\",0,0\n   \n",
+			14,
+			map[string][]string{"Events": {"0,0,\"bg.jpg\",0,0"}},
+		},
+		{
+			"surrounding whitespace",
+			"osu file format v14\r\n  [HitObjects]  \r\n  256,192,1000,1,0  \r\n",
+			14,
+			map[string][]string{"HitObjects": {"256,192,1000,1,0"}},
+		},
+		{
+			"several sections",
+			"osu file format v14\n[General]\nMode: 0\n[TimingPoints]\n0,500,4,2,0,50,1,0\n[HitObjects]\n256,192,1000,1,0\n256,192,1500,1,0\n",
+			14,
+			map[string][]string{
+				"General":      {"Mode: 0"},
+				"TimingPoints": {"0,500,4,2,0,50,1,0"},
+				"HitObjects":   {"256,192,1000,1,0", "256,192,1500,1,0"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, err := Parse(strings.NewReader(test.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if file.FormatVersion != test.version {
+				t.Errorf("expected format version %d, got %d", test.version, file.FormatVersion)
+			}
+			if len(file.Sections) != len(test.sections) {
+				t.Errorf("expected %d sections, got %v", len(test.sections), file.Sections)
+			}
+			for name, lines := range test.sections {
+				if strings.Join(file.Sections[name], "\n") != strings.Join(lines, "\n") {
+					t.Errorf("expected [%s] to be %q, got %q", name, lines, file.Sections[name])
+				}
+			}
+		})
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	file, err := Parse(strings.NewReader(`osu file format v14
+
+[Metadata]
+Title:Some Song
+TitleUnicode:Some Song
+Artist: Someone
+Creator:mapper
+Version:Insane: Extra
+BeatmapID:101
+BeatmapSetID:1
+not a value
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := file.Values("Metadata")
+	if values["Version"] != "Insane: Extra" {
+		t.Errorf("expected values to split on the first colon only, got %q", values["Version"])
+	}
+	if _, ok := values["not a value"]; ok || len(values) != 7 {
+		t.Errorf("expected only key value lines, got %v", values)
+	}
+	if len(file.Values("Difficulty")) != 0 {
+		t.Error("expected a missing section to have no values")
+	}
+
+	meta := file.Metadata()
+	want := Metadata{
+		Artist:       "Someone",
+		Title:        "Some Song",
+		Creator:      "mapper",
+		Version:      "Insane: Extra",
+		BeatmapID:    101,
+		BeatmapSetID: 1,
+	}
+	if meta != want {
+		t.Errorf("expected %+v, got %+v", want, meta)
+	}
+}
+
+func TestFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		meta Metadata
+		want string
+	}{
+		{
+			"plain",
+			Metadata{Artist: "Someone", Title: "Some Song", Creator: "mapper", Version: "Insane"},
+			"Someone - Some Song (mapper) [Insane].osu",
+		},
+		{
+			"reserved characters",
+			Metadata{Artist: "AC/DC", Title: "What?", Creator: "<mapper>", Version: "Extra: \"Final\" *|\\"},
+			"ACDC - What (mapper) [Extra Final ].osu",
+		},
+		{
+			"control characters",
+			Metadata{Artist: "Some\tone", Title: "Song\x00", Creator: "mapper", Version: "Hard"},
+			"Someone - Song (mapper) [Hard].osu",
+		},
+		{
+			"unicode",
+			Metadata{Artist: "ア", Title: "曲", Creator: "mapper", Version: "Normal"},
+			"ア - 曲 (mapper) [Normal].osu",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.meta.FileName(); got != test.want {
+				t.Errorf("expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
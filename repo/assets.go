@@ -0,0 +1,253 @@
+package repo
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"subscribe-bot/osufile"
+)
+
+var ErrNoAssets = errors.New("no assets archived")
+
+// Store every file under src except .osu files as the mapset's assets. Only
+// the latest assets are kept, each archive replaces the last one instead of
+// adding to its history, since audio and backgrounds are big and rarely worth
+// going back to. Returns false if they're identical to what's already stored.
+func (repo *Repo) StoreAssets(src string, when time.Time) (changed bool, err error) {
+	treeHash, empty, err := repo.writeAssetTree(src)
+	if err != nil {
+		err = fmt.Errorf("couldn't store assets from %s: %w", src, err)
+		return
+	}
+	if empty {
+		return
+	}
+
+	current, err := repo.assetsTree()
+	if err == nil && current.Hash == treeHash {
+		return
+	} else if err != nil && err != ErrNoAssets {
+		return
+	}
+
+	signature := object.Signature{Name: "subscribe-bot", When: when}
+	hash, err := repo.writeObject(&object.Commit{
+		Author:    signature,
+		Committer: signature,
+		Message:   "Archive assets\n",
+		TreeHash:  treeHash,
+	})
+	if err != nil {
+		return
+	}
+
+	err = repo.git.Storer.SetReference(plumbing.NewHashReference(repo.assets, hash))
+	changed = err == nil
+	return
+}
+
+// Like writeTree, but goes into subdirectories, since storyboards often keep
+// their images in folders
+func (repo *Repo) writeAssetTree(dir string) (hash plumbing.Hash, empty bool, err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	tree := &object.Tree{}
+	for _, f := range files {
+		filePath := path.Join(dir, f.Name())
+		if f.IsDir() {
+			var subtree plumbing.Hash
+			var subEmpty bool
+			subtree, subEmpty, err = repo.writeAssetTree(filePath)
+			if err != nil {
+				return
+			}
+			if !subEmpty {
+				tree.Entries = append(tree.Entries, object.TreeEntry{Name: f.Name(), Mode: filemode.Dir, Hash: subtree})
+			}
+			continue
+		}
+
+		if !f.Mode().IsRegular() || isOsuFile(f.Name()) {
+			continue
+		}
+
+		var blobHash plumbing.Hash
+		blobHash, err = repo.writeBlob(filePath)
+		if err != nil {
+			return
+		}
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: f.Name(), Mode: filemode.Regular, Hash: blobHash})
+	}
+
+	// git sorts directories as if their names ended with a slash
+	sortName := func(entry object.TreeEntry) string {
+		if entry.Mode == filemode.Dir {
+			return entry.Name + "/"
+		}
+		return entry.Name
+	}
+	sort.Slice(tree.Entries, func(i, j int) bool {
+		return sortName(tree.Entries[i]) < sortName(tree.Entries[j])
+	})
+
+	empty = len(tree.Entries) == 0
+	hash, err = repo.writeObject(tree)
+	return
+}
+
+// Whether any assets have been archived for this mapset
+func (repo *Repo) HasAssets() (ok bool, err error) {
+	_, err = repo.git.Storer.Reference(repo.assets)
+	if err == plumbing.ErrReferenceNotFound {
+		err = nil
+		return
+	}
+
+	ok = err == nil
+	return
+}
+
+func (repo *Repo) assetsTree() (tree *object.Tree, err error) {
+	ref, err := repo.git.Storer.Reference(repo.assets)
+	if err == plumbing.ErrReferenceNotFound {
+		err = ErrNoAssets
+		return
+	} else if err != nil {
+		return
+	}
+
+	commit, err := repo.git.CommitObject(ref.Hash())
+	if err != nil {
+		return
+	}
+
+	return commit.Tree()
+}
+
+func isOsuFile(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".osu")
+}
+
+// A mapset put back together from one revision's difficulties and the
+// archived assets, ready to be written out as an .osz
+type Osz struct {
+	Artist string
+	Title  string
+
+	entries []oszEntry
+}
+
+type oszEntry struct {
+	name string
+	file *object.File
+}
+
+// Gather everything needed to rebuild the mapset as it was at a revision.
+// Difficulties are renamed to what osu! would call them, going by their own
+// metadata. Returns ErrNoAssets if no assets were archived for this mapset.
+func (repo *Repo) Osz(hash string) (osz *Osz, err error) {
+	commit, err := repo.resolve(hash)
+	if err != nil {
+		return
+	}
+
+	assets, err := repo.assetsTree()
+	if err != nil {
+		return
+	}
+
+	osz = &Osz{}
+	taken := make(map[string]bool)
+	add := func(name string, file *object.File) {
+		taken[strings.ToLower(name)] = true
+		osz.entries = append(osz.entries, oszEntry{name, file})
+	}
+
+	files, err := commit.Files()
+	if err != nil {
+		return
+	}
+	err = files.ForEach(func(file *object.File) error {
+		name := file.Name
+		if isOsuFile(name) {
+			reader, err := file.Reader()
+			if err != nil {
+				return err
+			}
+			parsed, err := osufile.Parse(reader)
+			reader.Close()
+			if err != nil {
+				return fmt.Errorf("couldn't parse %s: %w", file.Name, err)
+			}
+
+			meta := parsed.Metadata()
+			if osz.Artist == "" && osz.Title == "" {
+				osz.Artist, osz.Title = meta.Artist, meta.Title
+			}
+			// two difficulties with the same name keep their ids instead of
+			// overwriting each other
+			if meta.Version != "" && !taken[strings.ToLower(meta.FileName())] {
+				name = meta.FileName()
+			}
+		}
+
+		add(name, file)
+		return nil
+	})
+	files.Close()
+	if err != nil {
+		return
+	}
+
+	assetFiles := assets.Files()
+	defer assetFiles.Close()
+	err = assetFiles.ForEach(func(file *object.File) error {
+		if !isOsuFile(file.Name) && !taken[strings.ToLower(file.Name)] {
+			add(file.Name, file)
+		}
+		return nil
+	})
+	return
+}
+
+// Write the mapset out as a zip, which is all an .osz is
+func (osz *Osz) Write(w io.Writer) (err error) {
+	ar := zip.NewWriter(w)
+	for _, entry := range osz.entries {
+		err = func() error {
+			reader, err := entry.file.Reader()
+			if err != nil {
+				return err
+			}
+			defer reader.Close()
+
+			dest, err := ar.Create(entry.name)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(dest, reader)
+			return err
+		}()
+		if err != nil {
+			err = fmt.Errorf("couldn't write %s: %w", entry.name, err)
+			return
+		}
+	}
+
+	return ar.Close()
+}
@@ -0,0 +1,186 @@
+package repo
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Build a .osu file with just enough metadata to be named
+func difficulty(version string, id int) string {
+	return "osu file format v14\n\n[Metadata]\nTitle:Some Song\nArtist:Someone\nCreator:mapper\n" +
+		"Version:" + version + "\nBeatmapID:" + strconv.Itoa(id) + "\nBeatmapSetID:1\n"
+}
+
+// Write files into a fresh directory, making subdirectories as needed
+func writeDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, contents := range files {
+		filePath := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(filePath, []byte(contents), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestStoreAssets(t *testing.T) {
+	eachBackend(t, func(t *testing.T, r *Repo) {
+		if ok, err := r.HasAssets(); err != nil || ok {
+			t.Fatalf("expected no assets yet, got %v (%v)", ok, err)
+		}
+
+		changed, err := r.StoreAssets(writeDir(t, map[string]string{"1.osu": "one"}), testEpoch)
+		if err != nil || changed {
+			t.Errorf("expected only difficulties to store nothing, got %v (%v)", changed, err)
+		}
+
+		assets := map[string]string{"1.osu": "one", "bg.jpg": "bg", "sb/img.png": "img", "empty/1.osu": "one"}
+		changed, err = r.StoreAssets(writeDir(t, assets), testEpoch)
+		if err != nil || !changed {
+			t.Fatalf("expected assets to be stored, got %v (%v)", changed, err)
+		}
+		if ok, err := r.HasAssets(); err != nil || !ok {
+			t.Errorf("expected assets to be there, got %v (%v)", ok, err)
+		}
+
+		changed, err = r.StoreAssets(writeDir(t, assets), testEpoch.Add(time.Hour))
+		if err != nil || changed {
+			t.Errorf("expected the same assets to be left alone, got %v (%v)", changed, err)
+		}
+
+		tree, err := r.assetsTree()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		tree.Files().ForEach(func(file *object.File) error {
+			names = append(names, file.Name)
+			return nil
+		})
+		if strings.Join(names, " ") != "bg.jpg sb/img.png" {
+			t.Errorf("expected only bg.jpg and sb/img.png, got %v", names)
+		}
+	})
+}
+
+func TestOsz(t *testing.T) {
+	tests := []struct {
+		name string
+		// difficulties in the revision
+		files map[string]string
+		// archived assets, nil if none were
+		assets map[string]string
+		// the title the .osz is named after
+		title string
+		// what should end up in the .osz
+		want map[string]string
+	}{
+		{
+			"difficulties and assets",
+			map[string]string{"1.osu": difficulty("Easy", 1), "2.osu": difficulty("Hard", 2)},
+			map[string]string{"bg.jpg": "bg", "sb/img.png": "img", "audio.mp3": "audio"},
+			"Some Song",
+			map[string]string{
+				"Someone - Some Song (mapper) [Easy].osu": difficulty("Easy", 1),
+				"Someone - Some Song (mapper) [Hard].osu": difficulty("Hard", 2),
+				"bg.jpg":     "bg",
+				"sb/img.png": "img",
+				"audio.mp3":  "audio",
+			},
+		},
+		{
+			"same difficulty name",
+			map[string]string{"1.osu": difficulty("Insane", 1), "2.osu": difficulty("insane", 2)},
+			map[string]string{"bg.jpg": "bg"},
+			"Some Song",
+			map[string]string{
+				"Someone - Some Song (mapper) [Insane].osu": difficulty("Insane", 1),
+				"2.osu":  difficulty("insane", 2),
+				"bg.jpg": "bg",
+			},
+		},
+		{
+			"no difficulty name",
+			map[string]string{"1.osu": "osu file format v14\n"},
+			map[string]string{"bg.jpg": "bg"},
+			"",
+			map[string]string{"1.osu": "osu file format v14\n", "bg.jpg": "bg"},
+		},
+		{
+			"no assets",
+			map[string]string{"1.osu": difficulty("Easy", 1)},
+			nil,
+			"",
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			eachBackend(t, func(t *testing.T, r *Repo) {
+				rev := mustSnapshot(t, r, 1, test.files)
+				if test.assets != nil {
+					_, err := r.StoreAssets(writeDir(t, test.assets), testEpoch)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				osz, err := r.Osz(rev.Hash)
+				if test.want == nil {
+					if !errors.Is(err, ErrNoAssets) {
+						t.Errorf("expected ErrNoAssets, got %v", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if osz.Title != test.title {
+					t.Errorf("expected the title %q, got %q", test.title, osz.Title)
+				}
+
+				var buf bytes.Buffer
+				err = osz.Write(&buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(zr.File) != len(test.want) {
+					t.Errorf("expected %d files, got %d", len(test.want), len(zr.File))
+				}
+				for _, f := range zr.File {
+					rc, err := f.Open()
+					if err != nil {
+						t.Fatal(err)
+					}
+					data, err := ioutil.ReadAll(rc)
+					rc.Close()
+					want, ok := test.want[f.Name]
+					if err != nil || !ok || string(data) != want {
+						t.Errorf("expected %s to contain %q, got %q (%v)", f.Name, want, data, err)
+					}
+				}
+			})
+		})
+	}
+}
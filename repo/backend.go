@@ -0,0 +1,49 @@
+package repo
+
+import "fmt"
+
+const (
+	BACKEND_DIR    = "dir"
+	BACKEND_PACKED = "packed"
+)
+
+// Storage for the revision history of every tracked mapset
+type Backend interface {
+	// Open an existing repository, returning ErrNotExist if it hasn't been
+	// created
+	Open(mapId int) (*Repo, error)
+	// Open a repository, creating an empty one if it doesn't exist yet
+	OpenOrInit(mapId int) (*Repo, error)
+	// List every repository along with its current mapper, sorted by mapper
+	// then mapset
+	List() ([]Key, error)
+	// The user currently hosting a mapset, according to the mapper index
+	Mapper(mapId int) (userId int, ok bool)
+	// Record who's hosting a mapset in the mapper index, returning who was
+	// before, or 0 if it wasn't known
+	SetMapper(mapId int, userId int) (previous int, err error)
+	// Take the lock for a single repository, so that snapshots and
+	// maintenance never touch the same repository at the same time. Call the
+	// returned function to release it.
+	Lock(mapId int) (unlock func())
+	// Wait for every repository lock to be released and stop new ones from
+	// being taken, so the whole store can be copied consistently. Call the
+	// returned function to let writes continue.
+	Freeze() (unfreeze func())
+	// Housekeeping for storage shared between repositories, run after every
+	// repository has been maintained
+	Gc() error
+}
+
+// Open the backend of the given kind, storing everything under root
+func New(kind string, root string) (backend Backend, err error) {
+	switch kind {
+	case "", BACKEND_DIR:
+		backend, err = NewDirBackend(root)
+	case BACKEND_PACKED:
+		backend, err = NewPackedBackend(root)
+	default:
+		err = fmt.Errorf("unknown storage backend %s", kind)
+	}
+	return
+}
@@ -0,0 +1,120 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"subscribe-bot/osufile"
+)
+
+var ErrFileNotFound = errors.New("file not found in revision")
+
+// Sections of a .osu file whose lines are attributed to revisions
+var BlameSections = []string{osufile.SECTION_TIMING_POINTS, osufile.SECTION_HIT_OBJECTS}
+
+// A single timing point or hit object, along with the revision that added it
+// in its current form
+type BlameEntry struct {
+	Section string
+	Line    string
+	Hash    string
+	Date    time.Time
+}
+
+// Read the blamed sections of a .osu file as of a commit
+func blameLines(commit *object.Commit, name string) (file *osufile.File, err error) {
+	f, err := commit.File(name)
+	if err == object.ErrFileNotFound {
+		err = ErrFileNotFound
+		return
+	} else if err != nil {
+		return
+	}
+
+	reader, err := f.Reader()
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+
+	return osufile.Parse(reader)
+}
+
+// Attribute every timing point and hit object in a .osu file to the oldest
+// revision it's been unchanged since. Objects are matched by their whole
+// line rather than by position, since moving anything in time shifts every
+// line after it.
+func (repo *Repo) Blame(hash string, name string) (entries []BlameEntry, err error) {
+	commit, err := repo.resolve(hash)
+	if err != nil {
+		return
+	}
+
+	file, err := blameLines(commit, name)
+	if err != nil {
+		return
+	}
+
+	// indices of entries that every revision walked so far still has, keyed
+	// by their section and line
+	type key struct{ section, line string }
+	alive := make(map[key][]int)
+	for _, section := range BlameSections {
+		for _, line := range file.Sections[section] {
+			alive[key{section, line}] = append(alive[key{section, line}], len(entries))
+			entries = append(entries, BlameEntry{
+				Section: section,
+				Line:    line,
+				Hash:    commit.Hash.String(),
+				Date:    commit.Author.When,
+			})
+		}
+	}
+
+	for len(alive) > 0 && commit.NumParents() > 0 {
+		commit, err = commit.Parent(0)
+		if err != nil {
+			err = fmt.Errorf("couldn't retrieve commit parent: %w", err)
+			return
+		}
+
+		file, err = blameLines(commit, name)
+		if err == ErrFileNotFound {
+			// the difficulty was added after this
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+
+		counts := make(map[key]int)
+		for _, section := range BlameSections {
+			for _, line := range file.Sections[section] {
+				counts[key{section, line}]++
+			}
+		}
+
+		stillAlive := make(map[key][]int)
+		for k, indices := range alive {
+			n := counts[k]
+			if n > len(indices) {
+				n = len(indices)
+			}
+			if n == 0 {
+				continue
+			}
+
+			for _, i := range indices[:n] {
+				entries[i].Hash = commit.Hash.String()
+				entries[i].Date = commit.Author.When
+			}
+			stillAlive[k] = indices[:n]
+		}
+		alive = stillAlive
+	}
+
+	return
+}
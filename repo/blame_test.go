@@ -0,0 +1,115 @@
+package repo
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Build a .osu file with the given timing points and hit objects
+func osuFile(timingPoints []string, hitObjects []string) string {
+	return "osu file format v14\n\n[General]\nMode: 0\n\n[TimingPoints]\n" +
+		strings.Join(timingPoints, "\n") + "\n\n[HitObjects]\n" +
+		strings.Join(hitObjects, "\n") + "\n"
+}
+
+func TestBlame(t *testing.T) {
+	timing := []string{"0,500,4,2,0,50,1,0"}
+	tests := []struct {
+		name string
+		// versions of 1.osu, one per revision
+		versions []string
+		// which revision each line of the last version should be blamed on,
+		// timing points first
+		want []int
+	}{
+		{
+			"single revision",
+			[]string{osuFile(timing, []string{"1,1,0,1,0", "2,2,500,1,0"})},
+			[]int{0, 0, 0},
+		},
+		{
+			"added and changed objects",
+			[]string{
+				osuFile(timing, []string{"1,1,0,1,0", "2,2,500,1,0"}),
+				osuFile(timing, []string{"1,1,0,1,0", "2,2,500,1,0", "3,3,1000,1,0"}),
+				osuFile(timing, []string{"1,1,0,1,0", "9,9,500,1,0", "3,3,1000,1,0"}),
+			},
+			[]int{0, 0, 2, 1},
+		},
+		{
+			"timing change keeps objects",
+			[]string{
+				osuFile(timing, []string{"1,1,0,1,0"}),
+				osuFile([]string{"0,400,4,2,0,50,1,0"}, []string{"1,1,0,1,0"}),
+			},
+			[]int{1, 0},
+		},
+		{
+			"duplicate lines",
+			[]string{
+				osuFile(timing, []string{"1,1,0,1,0"}),
+				osuFile(timing, []string{"1,1,0,1,0", "1,1,0,1,0"}),
+			},
+			[]int{0, 0, 1},
+		},
+		{
+			"line that comes back",
+			[]string{
+				osuFile(timing, []string{"1,1,0,1,0"}),
+				osuFile(timing, []string{"2,2,0,1,0"}),
+				osuFile(timing, []string{"1,1,0,1,0"}),
+			},
+			[]int{0, 2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			eachBackend(t, func(t *testing.T, r *Repo) {
+				hashes := make([]string, len(test.versions))
+				for i, version := range test.versions {
+					hashes[i] = mustSnapshot(t, r, i, map[string]string{"1.osu": version}).Hash
+				}
+
+				entries, err := r.Blame("HEAD", "1.osu")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(entries) != len(test.want) {
+					t.Fatalf("expected %d entries, got %d", len(test.want), len(entries))
+				}
+				for i, entry := range entries {
+					if entry.Hash != hashes[test.want[i]] {
+						t.Errorf("%s %q blamed on %s, expected revision %d (%s)", entry.Section, entry.Line, entry.Hash, test.want[i], hashes[test.want[i]])
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestBlameAddedDifficulty(t *testing.T) {
+	eachBackend(t, func(t *testing.T, r *Repo) {
+		mustSnapshot(t, r, 0, map[string]string{"1.osu": osuFile(nil, []string{"1,1,0,1,0"})})
+		second := mustSnapshot(t, r, 1, map[string]string{
+			"1.osu": osuFile(nil, []string{"1,1,0,1,0"}),
+			"2.osu": osuFile(nil, []string{"1,1,0,1,0"}),
+		})
+
+		entries, err := r.Blame("HEAD", "2.osu")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if entry.Hash != second.Hash {
+				t.Errorf("%q blamed on %s, before the difficulty existed", entry.Line, entry.Hash)
+			}
+		}
+
+		_, err = r.Blame("HEAD", "3.osu")
+		if !errors.Is(err, ErrFileNotFound) {
+			t.Errorf("expected ErrFileNotFound, got %v", err)
+		}
+	})
+}
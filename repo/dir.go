@@ -0,0 +1,135 @@
+package repo
+
+// The dir backend keeps one repository per mapset, laid out like this:
+// <root>/sets/<mapset_id>/ -> git repository
+// <root>/sets/<mapset_id>/<beatmap_id>.osu -> one per difficulty
+// refs/assets in each of them points at the archived assets, if there are any
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+const SETS_DIR = "sets"
+
+type DirBackend struct {
+	*mapperIndex
+	root  string
+	locks keyedLocks
+}
+
+func NewDirBackend(root string) (backend *DirBackend, err error) {
+	index, err := loadMapperIndex(root)
+	if err != nil {
+		return
+	}
+
+	backend = &DirBackend{mapperIndex: index, root: root}
+	return
+}
+
+func (backend *DirBackend) path(mapId int) string {
+	return path.Join(backend.root, SETS_DIR, strconv.Itoa(mapId))
+}
+
+func (backend *DirBackend) wrap(inner *git.Repository, repoDir string) *Repo {
+	return &Repo{
+		git:       inner,
+		dir:       repoDir,
+		branch:    plumbing.Master,
+		tagPrefix: "refs/tags/",
+		assets:    "refs/assets",
+	}
+}
+
+func (backend *DirBackend) openDir(repoDir string) (repo *Repo, err error) {
+	inner, err := git.PlainOpen(repoDir)
+	if err == git.ErrRepositoryNotExists {
+		err = ErrNotExist
+		return
+	} else if err != nil {
+		err = fmt.Errorf("couldn't open repo %s: %w", repoDir, err)
+		return
+	}
+
+	repo = backend.wrap(inner, repoDir)
+	return
+}
+
+func (backend *DirBackend) Open(mapId int) (repo *Repo, err error) {
+	return backend.openDir(backend.path(mapId))
+}
+
+func (backend *DirBackend) OpenOrInit(mapId int) (repo *Repo, err error) {
+	repo, err = backend.Open(mapId)
+	if err != ErrNotExist {
+		return
+	}
+
+	repoDir := backend.path(mapId)
+	err = os.MkdirAll(repoDir, 0777)
+	if err != nil {
+		return
+	}
+
+	inner, err := git.PlainInit(repoDir, false)
+	if err != nil {
+		err = fmt.Errorf("couldn't init repo %s: %w", repoDir, err)
+		return
+	}
+
+	repo = backend.wrap(inner, repoDir)
+	return
+}
+
+func (backend *DirBackend) List() (keys []Key, err error) {
+	keys = make([]Key, 0)
+	maps, err := ioutil.ReadDir(path.Join(backend.root, SETS_DIR))
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+
+	for _, mapDir := range maps {
+		mapId, err2 := strconv.Atoi(mapDir.Name())
+		if err2 != nil || !mapDir.IsDir() {
+			continue
+		}
+
+		keys = append(keys, backend.key(mapId))
+	}
+
+	sortKeys(keys)
+	return
+}
+
+func (backend *DirBackend) Lock(mapId int) (unlock func()) {
+	return backend.locks.lock(backend.path(mapId))
+}
+
+func (backend *DirBackend) Freeze() (unfreeze func()) {
+	return backend.locks.freeze()
+}
+
+// Every repository is packed on its own, so there's nothing shared to clean
+func (backend *DirBackend) Gc() error {
+	return nil
+}
+
+func sortKeys(keys []Key) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].UserID != keys[j].UserID {
+			return keys[i].UserID < keys[j].UserID
+		}
+		return keys[i].MapID < keys[j].MapID
+	})
+}
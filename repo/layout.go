@@ -0,0 +1,440 @@
+package repo
+
+// Repositories used to be keyed by mapper and mapset, at <root>/<mapper_id>/
+// <mapset_id> for the dir backend and under refs/maps/<mapper_id>/<mapset_id>/
+// for the packed one. A mapset changing hosts started over in a new
+// repository, leaving its history behind in the old one.
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+type legacyLayout interface {
+	legacyList() ([]Key, error)
+	legacyOpen(key Key) (*Repo, error)
+	legacyRemove(key Key) error
+}
+
+func (backend *DirBackend) legacyPath(key Key) string {
+	return path.Join(backend.root, strconv.Itoa(key.UserID), strconv.Itoa(key.MapID))
+}
+
+func (backend *DirBackend) legacyList() (keys []Key, err error) {
+	users, err := ioutil.ReadDir(backend.root)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+
+	for _, user := range users {
+		userId, err2 := strconv.Atoi(user.Name())
+		if err2 != nil || !user.IsDir() {
+			continue
+		}
+
+		var maps []os.FileInfo
+		maps, err = ioutil.ReadDir(path.Join(backend.root, user.Name()))
+		if err != nil {
+			return
+		}
+
+		for _, mapDir := range maps {
+			mapId, err2 := strconv.Atoi(mapDir.Name())
+			if err2 != nil || !mapDir.IsDir() {
+				continue
+			}
+
+			keys = append(keys, Key{userId, mapId})
+		}
+	}
+	return
+}
+
+func (backend *DirBackend) legacyOpen(key Key) (*Repo, error) {
+	return backend.openDir(backend.legacyPath(key))
+}
+
+func (backend *DirBackend) legacyRemove(key Key) (err error) {
+	err = os.RemoveAll(backend.legacyPath(key))
+	if err != nil {
+		return
+	}
+
+	// only succeeds once the mapper has nothing left
+	os.Remove(path.Dir(backend.legacyPath(key)))
+	return
+}
+
+func legacyPackedPrefix(key Key) string {
+	return fmt.Sprintf("refs/maps/%d/%d/", key.UserID, key.MapID)
+}
+
+func (backend *PackedBackend) legacyList() (keys []Key, err error) {
+	repo, err := backend.openPrefix("")
+	if err != nil {
+		return
+	}
+
+	refs, err := repo.git.Storer.IterReferences()
+	if err != nil {
+		return
+	}
+	defer refs.Close()
+
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		parts := strings.Split(ref.Name().String(), "/")
+		if len(parts) != 5 || parts[1] != "maps" || parts[4] != "head" {
+			return nil
+		}
+
+		userId, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil
+		}
+		mapId, err := strconv.Atoi(parts[3])
+		if err != nil {
+			return nil
+		}
+
+		keys = append(keys, Key{userId, mapId})
+		return nil
+	})
+	return
+}
+
+func (backend *PackedBackend) legacyOpen(key Key) (*Repo, error) {
+	return backend.openPrefix(legacyPackedPrefix(key))
+}
+
+// Objects are left for Gc to clean up
+func (backend *PackedBackend) legacyRemove(key Key) (err error) {
+	repo, err := backend.openPrefix("")
+	if err != nil {
+		return
+	}
+
+	refs, err := repo.git.Storer.IterReferences()
+	if err != nil {
+		return
+	}
+	defer refs.Close()
+
+	prefix := legacyPackedPrefix(key)
+	names := make([]plumbing.ReferenceName, 0)
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if strings.HasPrefix(ref.Name().String(), prefix) {
+			names = append(names, ref.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	for _, name := range names {
+		err = repo.git.Storer.RemoveReference(name)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// One host's worth of history for a mapset
+type legacyChain struct {
+	key     Key
+	repo    *Repo
+	commits []*object.Commit // oldest first
+	tags    []Tag
+	assets  *plumbing.Reference
+}
+
+func loadLegacyChain(layout legacyLayout, key Key) (chain legacyChain, err error) {
+	chain.key = key
+	chain.repo, err = layout.legacyOpen(key)
+	if err != nil {
+		return
+	}
+
+	logIter, err := chain.repo.log()
+	if err == plumbing.ErrReferenceNotFound {
+		// nothing was ever committed
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	defer logIter.Close()
+
+	for {
+		var commit *object.Commit
+		commit, err = logIter.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+		chain.commits = append([]*object.Commit{commit}, chain.commits...)
+	}
+
+	chain.tags, err = chain.repo.Tags()
+	if err != nil {
+		return
+	}
+
+	chain.assets, err = chain.repo.git.Storer.Reference(chain.repo.assets)
+	if err == plumbing.ErrReferenceNotFound {
+		err = nil
+	}
+	return
+}
+
+// Move every repository from the old layout into one keyed by mapset alone,
+// recording the most recent host in the mapper index. Mapsets that changed
+// hosts have their histories stitched together in the order they were
+// committed, so every revision after the first host change gets a new hash.
+// The old repositories are removed once their mapset has been moved. progress
+// is called with every host a mapset had in the order it had them, including
+// any it went back to.
+func MigrateLayout(backend Backend, progress func(mapId int, hosts []int, err error)) (err error) {
+	layout, ok := backend.(legacyLayout)
+	if !ok {
+		err = fmt.Errorf("%T has no old layout to migrate from", backend)
+		return
+	}
+
+	keys, err := layout.legacyList()
+	if err != nil {
+		return
+	}
+
+	byMap := make(map[int][]Key)
+	mapIds := make([]int, 0)
+	for _, key := range keys {
+		if _, ok := byMap[key.MapID]; !ok {
+			mapIds = append(mapIds, key.MapID)
+		}
+		byMap[key.MapID] = append(byMap[key.MapID], key)
+	}
+	sort.Ints(mapIds)
+
+	for _, mapId := range mapIds {
+		hosts, err := migrateLayoutOne(backend, layout, mapId, byMap[mapId])
+		progress(mapId, hosts, err)
+	}
+	return
+}
+
+func migrateLayoutOne(backend Backend, layout legacyLayout, mapId int, keys []Key) (hosts []int, err error) {
+	unlock := backend.Lock(mapId)
+	defer unlock()
+
+	dst, err := backend.OpenOrInit(mapId)
+	if err != nil {
+		return
+	}
+	if _, err = dst.head(); err == nil {
+		err = fmt.Errorf("%d already has revisions in the new layout, skipping", mapId)
+		return
+	} else if err != plumbing.ErrReferenceNotFound {
+		return
+	}
+	err = nil
+
+	chains := make([]legacyChain, 0, len(keys))
+	for _, key := range keys {
+		var chain legacyChain
+		chain, err = loadLegacyChain(layout, key)
+		if err != nil {
+			err = fmt.Errorf("couldn't read %d/%d: %w", key.UserID, key.MapID, err)
+			return
+		}
+		if len(chain.commits) > 0 {
+			chains = append(chains, chain)
+		}
+	}
+
+	if len(chains) > 0 {
+		hosts, err = stitchChains(dst, chains)
+		if err != nil {
+			return
+		}
+
+		_, err = backend.SetMapper(mapId, hosts[len(hosts)-1])
+		if err != nil {
+			return
+		}
+	}
+
+	for _, key := range keys {
+		err = layout.legacyRemove(key)
+		if err != nil {
+			err = fmt.Errorf("couldn't remove %d/%d: %w", key.UserID, key.MapID, err)
+			return
+		}
+	}
+	return
+}
+
+// A commit from one of the chains
+type chainCommit struct {
+	chain  int
+	commit *object.Commit
+}
+
+// Every chain's commits in the order they were committed, keeping each
+// chain's own order. A mapset that went back to an earlier host has both
+// stretches of history in that host's chain, with someone else's in between.
+func interleaveChains(chains []legacyChain) (commits []chainCommit) {
+	next := make([]int, len(chains))
+	for {
+		earliest := -1
+		for i, chain := range chains {
+			if next[i] == len(chain.commits) {
+				continue
+			}
+			when := chain.commits[next[i]].Committer.When
+			if earliest < 0 || when.Before(chains[earliest].commits[next[earliest]].Committer.When) {
+				earliest = i
+			}
+		}
+		if earliest < 0 {
+			return
+		}
+
+		commits = append(commits, chainCommit{earliest, chains[earliest].commits[next[earliest]]})
+		next[earliest]++
+	}
+}
+
+// Write every chain's commits into dst in the order they were committed,
+// renumbering tags as if they had always been in one repository. Returns the
+// host of each stretch of history, oldest first.
+func stitchChains(dst *Repo, chains []legacyChain) (hosts []int, err error) {
+	for _, chain := range chains {
+		roots := []plumbing.Hash{chain.commits[len(chain.commits)-1].Hash}
+		for _, tag := range chain.tags {
+			roots = append(roots, plumbing.NewHash(tag.Hash))
+		}
+		if chain.assets != nil {
+			roots = append(roots, chain.assets.Hash())
+		}
+		err = copyObjects(chain.repo, dst, roots)
+		if err != nil {
+			return
+		}
+	}
+
+	rewritten := make(map[plumbing.Hash]plumbing.Hash)
+	var head plumbing.Hash
+	var assets *plumbing.Reference
+	for _, c := range interleaveChains(chains) {
+		chain := chains[c.chain]
+		if len(hosts) == 0 || hosts[len(hosts)-1] != chain.key.UserID {
+			hosts = append(hosts, chain.key.UserID)
+		}
+		// the assets of whoever committed last
+		if chain.assets != nil {
+			assets = chain.assets
+		}
+
+		// history that already follows on from what's been written, like the
+		// first host's, doesn't need to change at all
+		old := c.commit
+		if (head.IsZero() && len(old.ParentHashes) == 0) || (len(old.ParentHashes) == 1 && old.ParentHashes[0] == head) {
+			rewritten[old.Hash] = old.Hash
+			head = old.Hash
+			continue
+		}
+
+		head, err = dst.writeObject(&object.Commit{
+			Author:       old.Author,
+			Committer:    old.Committer,
+			Message:      old.Message,
+			TreeHash:     old.TreeHash,
+			ParentHashes: []plumbing.Hash{head},
+		})
+		if err != nil {
+			return
+		}
+		rewritten[old.Hash] = head
+	}
+
+	err = dst.git.Storer.SetReference(plumbing.NewHashReference(dst.branch, head))
+	if err != nil {
+		return
+	}
+
+	if assets != nil {
+		err = dst.git.Storer.SetReference(plumbing.NewHashReference(dst.assets, assets.Hash()))
+		if err != nil {
+			return
+		}
+	}
+
+	err = stitchTags(dst, chains, rewritten)
+	if err != nil {
+		return
+	}
+
+	if dst.dir != "" {
+		err = dst.checkout(head)
+	}
+	return
+}
+
+func stitchTags(dst *Repo, chains []legacyChain, rewritten map[plumbing.Hash]plumbing.Hash) (err error) {
+	type stitchedTag struct {
+		Tag
+		obj *object.Tag
+	}
+
+	tags := make([]stitchedTag, 0)
+	for _, chain := range chains {
+		for _, tag := range chain.tags {
+			var obj *object.Tag
+			obj, err = chain.repo.tagObject(tag.Name)
+			if err != nil {
+				return
+			}
+			tags = append(tags, stitchedTag{tag, obj})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].Date.Before(tags[j].Date)
+	})
+
+	counts := make(map[string]int)
+	previous := ""
+	for _, tag := range tags {
+		target, ok := rewritten[plumbing.NewHash(tag.Hash)]
+		status := followingStatus(previous, tag.Status)
+		// a new host picking up where the last one left off isn't a status
+		// change
+		if !ok || status == previous {
+			continue
+		}
+
+		counts[status]++
+		previous = status
+		name := status + "-" + strconv.Itoa(counts[status])
+		err = dst.createTag(name, target, tag.obj.Tagger, tag.obj.Message)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,190 @@
+package repo
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// Open a repository in the old layout, creating it if it's not there yet
+func legacyRepo(t *testing.T, backend Backend, key Key) *Repo {
+	t.Helper()
+
+	switch backend := backend.(type) {
+	case *DirBackend:
+		repoDir := backend.legacyPath(key)
+		_, err := git.PlainInit(repoDir, false)
+		if err != nil && err != git.ErrRepositoryAlreadyExists {
+			t.Fatal(err)
+		}
+		r, err := backend.legacyOpen(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	case *PackedBackend:
+		r, err := backend.legacyOpen(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	t.Fatalf("%T has no old layout", backend)
+	return nil
+}
+
+func TestMigrateLayout(t *testing.T) {
+	tests := []struct {
+		name string
+		// who hosted each revision, one per hour
+		hosts []int
+		// every host the mapset had, in order
+		want []int
+		// how many revisions keep their hash
+		unchanged int
+	}{
+		{"one host", []int{10, 10, 10}, []int{10}, 3},
+		{"host change", []int{10, 10, 20, 20}, []int{10, 20}, 2},
+		{"host change and back", []int{10, 10, 20, 20, 10, 10}, []int{10, 20, 10}, 2},
+		{"back and forth", []int{20, 10, 20, 10}, []int{20, 10, 20, 10}, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			eachBackendOf(t, func(t *testing.T, backend Backend) {
+				// each host's revisions carry on from their own last one
+				hashes := make([]string, len(test.hosts))
+				for n, host := range test.hosts {
+					r := legacyRepo(t, backend, Key{host, 1})
+					contents := fmt.Sprintf("revision %d by %d", n, host)
+					hashes[n] = mustSnapshot(t, r, n, map[string]string{"1.osu": contents}).Hash
+				}
+				// and a mapset that never had anything committed
+				legacyRepo(t, backend, Key{10, 2})
+
+				var hosts []int
+				err := MigrateLayout(backend, func(mapId int, mapHosts []int, err error) {
+					if err != nil {
+						t.Errorf("couldn't migrate %d: %s", mapId, err)
+					}
+					if mapId == 1 {
+						hosts = mapHosts
+					}
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fmt.Sprint(hosts) != fmt.Sprint(test.want) {
+					t.Errorf("expected hosts %v, got %v", test.want, hosts)
+				}
+				if mapper, _ := backend.Mapper(1); mapper != test.want[len(test.want)-1] {
+					t.Errorf("expected the mapper index to have %d, got %d", test.want[len(test.want)-1], mapper)
+				}
+
+				r, err := backend.Open(1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				revs, err := r.Log(len(test.hosts) + 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(revs) != len(test.hosts) {
+					t.Fatalf("expected %d revisions, got %d", len(test.hosts), len(revs))
+				}
+				for i, rev := range revs {
+					n := len(revs) - 1 - i
+					data, err := r.FileAt(rev.Hash, "1.osu")
+					want := fmt.Sprintf("revision %d by %d", n, test.hosts[n])
+					if err != nil || string(data) != want {
+						t.Errorf("revision %d has %q, expected %q (%v)", n, data, want, err)
+					}
+					if unchanged := rev.Hash == hashes[n]; unchanged != (n < test.unchanged) {
+						t.Errorf("expected revision %d keeping its hash to be %v", n, !unchanged)
+					}
+				}
+
+				legacy, err := backend.(legacyLayout).legacyList()
+				if err != nil || len(legacy) != 0 {
+					t.Errorf("expected the old layout to be gone, found %v (%v)", legacy, err)
+				}
+			})
+		})
+	}
+}
+
+func TestMigrateStorage(t *testing.T) {
+	// the mapper index ends up with the latest host, after a host change and
+	// a change back
+	hosts := []int{10, 20, 10}
+
+	from, err := NewDirBackend(filepath.Join(t.TempDir(), "dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := from.OpenOrInit(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revs := make([]Revision, len(hosts))
+	for n, host := range hosts {
+		revs[n] = mustSnapshot(t, r, n, map[string]string{"1.osu": fmt.Sprintf("revision %d", n)})
+		_, err = from.SetMapper(1, host)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = r.RecordStatus("pending", testEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to, err := NewPackedBackend(filepath.Join(t.TempDir(), "packed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := NewDirBackend(filepath.Join(t.TempDir(), "back"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// there and back again
+	for _, pair := range [][2]Backend{{from, to}, {to, back}} {
+		err = Migrate(pair[0], pair[1], func(key Key, err error) {
+			if err != nil {
+				t.Errorf("couldn't migrate %d: %s", key.MapID, err)
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if mapper, _ := pair[1].Mapper(1); mapper != 10 {
+			t.Errorf("expected the mapper index to have 10, got %d", mapper)
+		}
+		migrated, err := pair[1].Open(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		log, err := migrated.Log(len(revs) + 1)
+		if err != nil || len(log) != len(revs) || log[0].Hash != revs[len(revs)-1].Hash {
+			t.Errorf("history wasn't copied as-is: %v (%v)", log, err)
+		}
+		tags, err := migrated.Tags()
+		if err != nil || len(tags) != 1 || tags[0].Name != "pending-1" || tags[0].Hash != revs[len(revs)-1].Hash {
+			t.Errorf("tags weren't copied: %v (%v)", tags, err)
+		}
+	}
+
+	// a second run leaves what's there alone
+	err = Migrate(from, to, func(key Key, err error) {
+		if err == nil {
+			t.Errorf("%d was migrated again", key.MapID)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
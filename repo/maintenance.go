@@ -0,0 +1,238 @@
+package repo
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+)
+
+// Per repository locks, keyed by whatever the backend uses to tell them
+// apart. Every repository lock also holds the store-wide lock for reading, so
+// that taking it for writing freezes the whole store.
+type keyedLocks struct {
+	locks sync.Map
+	store sync.RWMutex
+}
+
+func (kl *keyedLocks) lock(key string) (unlock func()) {
+	kl.store.RLock()
+	lock, _ := kl.locks.LoadOrStore(key, &sync.Mutex{})
+	mutex := lock.(*sync.Mutex)
+	mutex.Lock()
+	return func() {
+		mutex.Unlock()
+		kl.store.RUnlock()
+	}
+}
+
+func (kl *keyedLocks) freeze() (unfreeze func()) {
+	kl.store.Lock()
+	return kl.store.Unlock
+}
+
+// Size on disk of the repository. Repositories in shared storage report the
+// uncompressed size of every object reachable from them instead.
+func (repo *Repo) DiskUsage() (size int64, err error) {
+	if repo.dir != "" {
+		err = filepath.Walk(repo.dir, func(_ string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				size += info.Size()
+			}
+			return nil
+		})
+		return
+	}
+
+	roots := make([]plumbing.Hash, 0)
+	head, err := repo.head()
+	if err == plumbing.ErrReferenceNotFound {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	roots = append(roots, head)
+
+	objects, err := revlist.Objects(repo.git.Storer, roots, nil)
+	if err != nil {
+		return
+	}
+	for _, hash := range objects {
+		var obj plumbing.EncodedObject
+		obj, err = repo.git.Storer.EncodedObject(plumbing.AnyObject, hash)
+		if err != nil {
+			return
+		}
+		size += obj.Size()
+	}
+	return
+}
+
+// Number of revisions reachable from the latest one
+func (repo *Repo) CountRevisions() (count int, err error) {
+	logIter, err := repo.log()
+	if err == plumbing.ErrReferenceNotFound {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+
+	err = logIter.ForEach(func(*object.Commit) error {
+		count++
+		return nil
+	})
+	return
+}
+
+// The status that the mapset was last seen in, according to its tags
+func (repo *Repo) LastStatus() (status string, err error) {
+	tags, err := repo.Tags()
+	if err != nil || len(tags) == 0 {
+		return
+	}
+
+	status = tags[len(tags)-1].Status
+	return
+}
+
+// Delete unreachable objects and pack everything else into a single pack.
+// Repositories in shared storage are packed by their backend's Gc instead.
+func (repo *Repo) Repack() (err error) {
+	if repo.dir == "" {
+		return
+	}
+
+	if _, err = repo.head(); err == plumbing.ErrReferenceNotFound {
+		// nothing to pack
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+
+	return repack(repo.git)
+}
+
+func repack(inner *git.Repository) (err error) {
+	err = inner.Prune(git.PruneOptions{Handler: inner.DeleteObject})
+	if err != nil {
+		err = fmt.Errorf("couldn't prune: %w", err)
+		return
+	}
+
+	err = inner.RepackObjects(&git.RepackConfig{})
+	if err != nil {
+		err = fmt.Errorf("couldn't repack: %w", err)
+		return
+	}
+	return
+}
+
+// Rewrite history so that only the latest keep revisions remain, the oldest
+// of them becoming the new first revision. Tags on dropped revisions are
+// deleted, except for the most recent one which moves to the new first
+// revision so the last known status isn't lost. Run Repack afterwards to
+// actually free the space.
+func (repo *Repo) Truncate(keep int) (removed int, err error) {
+	if keep < 1 {
+		err = fmt.Errorf("must keep at least one revision, got %d", keep)
+		return
+	}
+
+	logIter, err := repo.log()
+	if err == plumbing.ErrReferenceNotFound {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+
+	commits := make([]*object.Commit, 0)
+	for {
+		var commit *object.Commit
+		commit, err = logIter.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+		commits = append(commits, commit)
+	}
+	if len(commits) <= keep {
+		return
+	}
+
+	// rewrite the kept commits oldest first, chaining them onto each other
+	rewritten := make(map[plumbing.Hash]plumbing.Hash)
+	var parent plumbing.Hash
+	for i := keep - 1; i >= 0; i-- {
+		old := commits[i]
+		commit := &object.Commit{
+			Author:    old.Author,
+			Committer: old.Committer,
+			Message:   old.Message,
+			TreeHash:  old.TreeHash,
+		}
+		if !parent.IsZero() {
+			commit.ParentHashes = []plumbing.Hash{parent}
+		}
+
+		parent, err = repo.writeObject(commit)
+		if err != nil {
+			return
+		}
+		rewritten[old.Hash] = parent
+	}
+	newRoot := rewritten[commits[keep-1].Hash]
+
+	err = repo.git.Storer.SetReference(plumbing.NewHashReference(repo.branch, parent))
+	if err != nil {
+		return
+	}
+
+	tags, err := repo.Tags()
+	if err != nil {
+		return
+	}
+	for i, tag := range tags {
+		tagObj, err2 := repo.tagObject(tag.Name)
+		if err2 != nil {
+			err = err2
+			return
+		}
+
+		target, ok := rewritten[plumbing.NewHash(tag.Hash)]
+		if !ok && i == len(tags)-1 {
+			target, ok = newRoot, true
+		}
+
+		if !ok {
+			err = repo.deleteTag(tag.Name)
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		// moved over in one go, so it's never missing
+		err = repo.setTag(tag.Name, target, tagObj.Tagger, tagObj.Message)
+		if err != nil {
+			return
+		}
+	}
+
+	removed = len(commits) - keep
+	return
+}
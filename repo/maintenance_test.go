@@ -0,0 +1,122 @@
+package repo
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name string
+		// API status recorded after each revision, if any
+		statuses []string
+		keep     int
+		removed  int
+		// where each tag should end up, as the index of the original
+		// revision, or -1 if it should be gone
+		tags map[string]int
+	}{
+		{
+			"latest tag moves to the new first revision",
+			[]string{"pending", "qualified", "", ""},
+			2, 2,
+			map[string]int{"pending-1": -1, "qualified-1": 2},
+		},
+		{
+			"tags on kept revisions follow them",
+			[]string{"pending", "", "qualified", "pending"},
+			2, 2,
+			map[string]int{"pending-1": -1, "qualified-1": 2, "disqualified-1": 3},
+		},
+		{
+			"only the latest dropped tag is kept",
+			[]string{"pending", "qualified", "pending", "", ""},
+			1, 4,
+			map[string]int{"pending-1": -1, "qualified-1": -1, "disqualified-1": 4},
+		},
+		{
+			"nothing to drop",
+			[]string{"pending", "qualified"},
+			5, 0,
+			map[string]int{"pending-1": 0, "qualified-1": 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			eachBackend(t, func(t *testing.T, r *Repo) {
+				revs := make([]Revision, len(test.statuses))
+				for i, status := range test.statuses {
+					revs[i] = mustSnapshot(t, r, i, map[string]string{"1.osu": fmt.Sprintf("revision %d", i)})
+					_, err := r.RecordStatus(status, testEpoch.Add(time.Duration(i)*time.Hour))
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				removed, err := r.Truncate(test.keep)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if removed != test.removed {
+					t.Errorf("expected %d revisions removed, got %d", test.removed, removed)
+				}
+
+				// revisions are rewritten, so they're matched up by their
+				// metadata
+				log, err := r.Log(len(revs) + 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(log) != len(revs)-test.removed {
+					t.Fatalf("expected %d revisions left, got %d", len(revs)-test.removed, len(log))
+				}
+				if oldest := log[len(log)-1]; oldest.HasParent {
+					t.Errorf("oldest revision %s still has a parent", oldest.Hash)
+				}
+				original := make(map[string]int)
+				for i, rev := range log {
+					j := len(revs) - 1 - i
+					if rev.Metadata == nil || rev.Metadata.LastUpdated != revs[j].Metadata.LastUpdated {
+						t.Errorf("revision %d has the wrong metadata: %+v", i, rev.Metadata)
+					}
+					data, err := r.FileAt(rev.Hash, "1.osu")
+					if err != nil || string(data) != fmt.Sprintf("revision %d", j) {
+						t.Errorf("revision %d has the wrong contents: %q (%v)", i, data, err)
+					}
+					original[rev.Hash] = j
+				}
+
+				tags, err := r.Tags()
+				if err != nil {
+					t.Fatal(err)
+				}
+				found := make(map[string]bool)
+				for _, tag := range tags {
+					found[tag.Name] = true
+					want, ok := test.tags[tag.Name]
+					if !ok || want < 0 {
+						t.Errorf("%s should have been deleted", tag.Name)
+						continue
+					}
+					if got, ok := original[tag.Hash]; !ok || got != want {
+						t.Errorf("%s points at %s, expected what was revision %d", tag.Name, tag.Hash, want)
+					}
+				}
+				for name, want := range test.tags {
+					if want >= 0 && !found[name] {
+						t.Errorf("%s is missing", name)
+					}
+				}
+			})
+		})
+	}
+
+	eachBackend(t, func(t *testing.T, r *Repo) {
+		_, err := r.Truncate(0)
+		if err == nil {
+			t.Error("expected an error when keeping no revisions")
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+)
+
+// Repositories are keyed by mapset alone, so they survive host changes. Who
+// currently hosts each mapset is kept in a separate index at
+// <root>/mappers.json, shared by every backend.
+const MAPPER_INDEX = "mappers.json"
+
+type mapperIndex struct {
+	path    string
+	mutex   sync.Mutex
+	mappers map[int]int
+}
+
+func loadMapperIndex(root string) (index *mapperIndex, err error) {
+	index = &mapperIndex{
+		path:    path.Join(root, MAPPER_INDEX),
+		mappers: make(map[int]int),
+	}
+
+	data, err := ioutil.ReadFile(index.path)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &index.mappers)
+	if err != nil {
+		err = fmt.Errorf("couldn't parse mapper index %s: %w", index.path, err)
+	}
+	return
+}
+
+// The user currently hosting a mapset
+func (index *mapperIndex) Mapper(mapId int) (userId int, ok bool) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	userId, ok = index.mappers[mapId]
+	return
+}
+
+// Record who's hosting a mapset, returning who was before, or 0 if it wasn't
+// known
+func (index *mapperIndex) SetMapper(mapId int, userId int) (previous int, err error) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	previous = index.mappers[mapId]
+	if previous == userId {
+		return
+	}
+
+	index.mappers[mapId] = userId
+	err = index.save()
+	if err != nil {
+		index.mappers[mapId] = previous
+	}
+	return
+}
+
+// Write the index to a temporary file first, so a crash never leaves it half
+// written
+func (index *mapperIndex) save() (err error) {
+	data, err := json.MarshalIndent(index.mappers, "", "  ")
+	if err != nil {
+		return
+	}
+
+	err = os.MkdirAll(path.Dir(index.path), 0777)
+	if err != nil {
+		return
+	}
+
+	tmp := index.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmp, index.path)
+}
+
+func (index *mapperIndex) key(mapId int) Key {
+	userId, _ := index.Mapper(mapId)
+	return Key{UserID: userId, MapID: mapId}
+}
@@ -0,0 +1,169 @@
+package repo
+
+// Revisions carry their metadata as trailers at the end of the commit message:
+//
+//   Update Artist - Title (123)
+//
+//   Beatmapset-Id: 123
+//   Status: pending
+//   Last-Updated: 2020-10-10T12:00:00Z
+//   Difficulty: 456 <md5 checksum> Insane
+//   Difficulty-Mapper: 456 321
+//   Event-Id: 789
+//   Bot-Version: abcdef0
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	TRAILER_BEATMAPSET = "Beatmapset-Id"
+	TRAILER_STATUS     = "Status"
+	TRAILER_UPDATED    = "Last-Updated"
+	TRAILER_DIFFICULTY = "Difficulty"
+	// Only written for guest difficulties
+	TRAILER_DIFFICULTY_MAPPER = "Difficulty-Mapper"
+	TRAILER_EVENT             = "Event-Id"
+	TRAILER_BOT_VERSION       = "Bot-Version"
+)
+
+var ErrNoMetadata = errors.New("commit message has no metadata")
+
+type Metadata struct {
+	BeatmapsetID int
+	Status       string
+	LastUpdated  string
+	Difficulties []Difficulty
+	// ID of the event that triggered this revision, 0 if there wasn't one
+	EventID    int
+	BotVersion string
+}
+
+type Difficulty struct {
+	ID       int
+	Name     string
+	Checksum string
+	// Guest mapper who made this difficulty, 0 if it was the mapset's host
+	Mapper int
+}
+
+// Build a full commit message out of a subject line and metadata trailers
+func FormatMessage(subject string, meta *Metadata) string {
+	var b strings.Builder
+	b.WriteString(subject)
+	b.WriteString("\n\n")
+
+	trailer := func(key string, value interface{}) {
+		fmt.Fprintf(&b, "%s: %v\n", key, value)
+	}
+
+	trailer(TRAILER_BEATMAPSET, meta.BeatmapsetID)
+	if meta.Status != "" {
+		trailer(TRAILER_STATUS, meta.Status)
+	}
+	if meta.LastUpdated != "" {
+		trailer(TRAILER_UPDATED, meta.LastUpdated)
+	}
+	for _, diff := range meta.Difficulties {
+		checksum := diff.Checksum
+		if checksum == "" {
+			checksum = "-"
+		}
+		value := fmt.Sprintf("%d %s %s", diff.ID, checksum, diff.Name)
+		trailer(TRAILER_DIFFICULTY, strings.TrimSpace(value))
+	}
+	for _, diff := range meta.Difficulties {
+		if diff.Mapper != 0 {
+			trailer(TRAILER_DIFFICULTY_MAPPER, fmt.Sprintf("%d %d", diff.ID, diff.Mapper))
+		}
+	}
+	if meta.EventID != 0 {
+		trailer(TRAILER_EVENT, meta.EventID)
+	}
+	if meta.BotVersion != "" {
+		trailer(TRAILER_BOT_VERSION, meta.BotVersion)
+	}
+
+	return b.String()
+}
+
+// Read the metadata trailers back out of a commit message. Commits made
+// before metadata was recorded return ErrNoMetadata.
+func ParseMessage(message string) (meta Metadata, err error) {
+	paragraphs := strings.Split(strings.TrimSpace(message), "\n\n")
+	if len(paragraphs) < 2 {
+		err = ErrNoMetadata
+		return
+	}
+
+	found := false
+	mappers := make(map[int]int)
+	for _, line := range strings.Split(paragraphs[len(paragraphs)-1], "\n") {
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := parts[0], strings.TrimSpace(parts[1])
+
+		switch key {
+		case TRAILER_BEATMAPSET:
+			meta.BeatmapsetID, err = strconv.Atoi(value)
+		case TRAILER_STATUS:
+			meta.Status = value
+		case TRAILER_UPDATED:
+			meta.LastUpdated = value
+		case TRAILER_DIFFICULTY:
+			var diff Difficulty
+			diff, err = parseDifficulty(value)
+			meta.Difficulties = append(meta.Difficulties, diff)
+		case TRAILER_DIFFICULTY_MAPPER:
+			var diffId, mapper int
+			_, err = fmt.Sscanf(value, "%d %d", &diffId, &mapper)
+			mappers[diffId] = mapper
+		case TRAILER_EVENT:
+			meta.EventID, err = strconv.Atoi(value)
+		case TRAILER_BOT_VERSION:
+			meta.BotVersion = value
+		default:
+			continue
+		}
+
+		if err != nil {
+			err = fmt.Errorf("couldn't parse trailer %q: %w", line, err)
+			return
+		}
+		found = true
+	}
+
+	if !found {
+		err = ErrNoMetadata
+	}
+	for i := range meta.Difficulties {
+		meta.Difficulties[i].Mapper = mappers[meta.Difficulties[i].ID]
+	}
+	return
+}
+
+func parseDifficulty(value string) (diff Difficulty, err error) {
+	parts := strings.SplitN(value, " ", 3)
+	if len(parts) < 2 {
+		err = errors.New("expected an id and a checksum")
+		return
+	}
+
+	diff.ID, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return
+	}
+
+	if parts[1] != "-" {
+		diff.Checksum = parts[1]
+	}
+	if len(parts) == 3 {
+		diff.Name = parts[2]
+	}
+	return
+}
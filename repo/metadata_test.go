@@ -0,0 +1,93 @@
+package repo
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		meta Metadata
+	}{
+		{"minimal", Metadata{BeatmapsetID: 123}},
+		{"full", Metadata{
+			BeatmapsetID: 123,
+			Status:       "pending",
+			LastUpdated:  "2020-10-10T12:00:00Z",
+			Difficulties: []Difficulty{
+				{ID: 456, Name: "Insane", Checksum: "0123456789abcdef0123456789abcdef"},
+				{ID: 457, Name: "Someone's Extra", Checksum: "fedcba9876543210fedcba9876543210", Mapper: 321},
+			},
+			EventID:    789,
+			BotVersion: "abcdef0",
+		}},
+		{"difficulty without a checksum", Metadata{
+			BeatmapsetID: 123,
+			Difficulties: []Difficulty{{ID: 456, Name: "Hard"}},
+		}},
+		{"difficulty without a name", Metadata{
+			BeatmapsetID: 123,
+			Difficulties: []Difficulty{{ID: 456, Checksum: "0123456789abcdef0123456789abcdef"}},
+		}},
+		{"name with colons and spaces", Metadata{
+			BeatmapsetID: 123,
+			Difficulties: []Difficulty{{ID: 456, Name: "Collab: A & B's  Insane", Checksum: "-x"}},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := FormatMessage("Update Artist - Title (123)", &test.meta)
+			parsed, err := ParseMessage(message)
+			if err != nil {
+				t.Fatalf("couldn't parse %q: %s", message, err)
+			}
+			if !reflect.DeepEqual(parsed, test.meta) {
+				t.Errorf("round trip changed metadata\nwant %+v\ngot  %+v\nmessage:\n%s", test.meta, parsed, message)
+			}
+		})
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		err     error
+		meta    Metadata
+	}{
+		{"subject only", "Update Artist - Title (123)", ErrNoMetadata, Metadata{}},
+		{"no trailers", "Update Artist - Title (123)\n\nSome description", ErrNoMetadata, Metadata{}},
+		{
+			"unknown trailers are ignored",
+			"Update\n\nSigned-off-by: someone\nBeatmapset-Id: 5\n",
+			nil,
+			Metadata{BeatmapsetID: 5},
+		},
+		{
+			"only the last paragraph counts",
+			"Update\n\nBeatmapset-Id: 5\n\nStatus: ranked\n",
+			nil,
+			Metadata{Status: "ranked"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			meta, err := ParseMessage(test.message)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if err == nil && !reflect.DeepEqual(meta, test.meta) {
+				t.Errorf("want %+v, got %+v", test.meta, meta)
+			}
+		})
+	}
+
+	_, err := ParseMessage("Update\n\nBeatmapset-Id: abc\n")
+	if err == nil || errors.Is(err, ErrNoMetadata) {
+		t.Errorf("expected a parse error for a bad trailer, got %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package repo
+
+import (
+	"fmt"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+)
+
+// Copy every repository from one backend into another. Objects are copied
+// as-is, so revision hashes stay the same. Repositories that already have
+// revisions in the destination are skipped.
+func Migrate(from Backend, to Backend, progress func(key Key, err error)) (err error) {
+	keys, err := from.List()
+	if err != nil {
+		return
+	}
+
+	for _, key := range keys {
+		err = migrateOne(from, to, key.MapID)
+		if err == nil && key.UserID != 0 {
+			_, err = to.SetMapper(key.MapID, key.UserID)
+		}
+		progress(key, err)
+	}
+	err = nil
+	return
+}
+
+func migrateOne(from Backend, to Backend, mapId int) (err error) {
+	unlockSrc := from.Lock(mapId)
+	defer unlockSrc()
+	unlockDst := to.Lock(mapId)
+	defer unlockDst()
+
+	src, err := from.Open(mapId)
+	if err != nil {
+		return
+	}
+
+	dst, err := to.OpenOrInit(mapId)
+	if err != nil {
+		return
+	}
+
+	if _, err = dst.head(); err == nil {
+		err = fmt.Errorf("%d already has revisions, skipping", mapId)
+		return
+	} else if err != plumbing.ErrReferenceNotFound {
+		return
+	}
+
+	head, err := src.head()
+	if err != nil {
+		return
+	}
+
+	names, err := src.tagNames()
+	if err != nil {
+		return
+	}
+	tags := make(map[string]plumbing.Hash)
+	roots := []plumbing.Hash{head}
+	for _, name := range names {
+		var ref *plumbing.Reference
+		ref, err = src.git.Storer.Reference(plumbing.ReferenceName(src.tagPrefix + name))
+		if err != nil {
+			return
+		}
+		tags[name] = ref.Hash()
+		roots = append(roots, ref.Hash())
+	}
+
+	assets, err := src.git.Storer.Reference(src.assets)
+	if err == nil {
+		roots = append(roots, assets.Hash())
+	} else if err != plumbing.ErrReferenceNotFound {
+		return
+	}
+
+	err = copyObjects(src, dst, roots)
+	if err != nil {
+		return
+	}
+
+	for name, hash := range tags {
+		err = dst.git.Storer.SetReference(plumbing.NewHashReference(plumbing.ReferenceName(dst.tagPrefix+name), hash))
+		if err != nil {
+			return
+		}
+	}
+
+	if assets != nil {
+		err = dst.git.Storer.SetReference(plumbing.NewHashReference(dst.assets, assets.Hash()))
+		if err != nil {
+			return
+		}
+	}
+
+	err = dst.git.Storer.SetReference(plumbing.NewHashReference(dst.branch, head))
+	if err != nil {
+		return
+	}
+
+	if dst.dir != "" {
+		err = dst.checkout(head)
+	}
+	return
+}
+
+// Copy everything reachable from roots that dst doesn't have yet
+func copyObjects(src *Repo, dst *Repo, roots []plumbing.Hash) (err error) {
+	objects, err := revlist.Objects(src.git.Storer, roots, nil)
+	if err != nil {
+		return
+	}
+
+	for _, hash := range objects {
+		if dst.git.Storer.HasEncodedObject(hash) == nil {
+			continue
+		}
+
+		var obj plumbing.EncodedObject
+		obj, err = src.git.Storer.EncodedObject(plumbing.AnyObject, hash)
+		if err != nil {
+			return
+		}
+
+		_, err = dst.git.Storer.SetEncodedObject(obj)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
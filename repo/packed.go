@@ -0,0 +1,137 @@
+package repo
+
+// The packed backend keeps every mapset in a single bare repository at
+// <root>/packed.git, with references laid out like this:
+// refs/sets/<mapset_id>/head -> latest revision
+// refs/sets/<mapset_id>/tags/<name> -> status tag
+// refs/sets/<mapset_id>/assets -> archived assets
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+const PACKED_REPO = "packed.git"
+
+type PackedBackend struct {
+	*mapperIndex
+	dir   string
+	locks keyedLocks
+}
+
+func NewPackedBackend(root string) (backend *PackedBackend, err error) {
+	dir := path.Join(root, PACKED_REPO)
+	_, err = git.PlainOpen(dir)
+	if err == git.ErrRepositoryNotExists {
+		_, err = git.PlainInit(dir, true)
+	}
+	if err != nil {
+		err = fmt.Errorf("couldn't open packed repo %s: %w", dir, err)
+		return
+	}
+
+	index, err := loadMapperIndex(root)
+	if err != nil {
+		return
+	}
+
+	backend = &PackedBackend{mapperIndex: index, dir: dir}
+	return
+}
+
+func packedPrefix(mapId int) string {
+	return fmt.Sprintf("refs/sets/%d/", mapId)
+}
+
+// Every repo gets its own handle, since go-git's aren't safe to share between
+// goroutines
+func (backend *PackedBackend) openPrefix(prefix string) (repo *Repo, err error) {
+	inner, err := git.PlainOpen(backend.dir)
+	if err != nil {
+		return
+	}
+
+	repo = &Repo{
+		git:       inner,
+		branch:    plumbing.ReferenceName(prefix + "head"),
+		tagPrefix: prefix + "tags/",
+		assets:    plumbing.ReferenceName(prefix + "assets"),
+	}
+	return
+}
+
+func (backend *PackedBackend) OpenOrInit(mapId int) (repo *Repo, err error) {
+	return backend.openPrefix(packedPrefix(mapId))
+}
+
+func (backend *PackedBackend) Open(mapId int) (repo *Repo, err error) {
+	repo, err = backend.OpenOrInit(mapId)
+	if err != nil {
+		return
+	}
+
+	_, err = repo.head()
+	if err == plumbing.ErrReferenceNotFound {
+		err = ErrNotExist
+	}
+	return
+}
+
+func (backend *PackedBackend) List() (keys []Key, err error) {
+	keys = make([]Key, 0)
+	inner, err := git.PlainOpen(backend.dir)
+	if err != nil {
+		return
+	}
+
+	refs, err := inner.Storer.IterReferences()
+	if err != nil {
+		return
+	}
+	defer refs.Close()
+
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		parts := strings.Split(ref.Name().String(), "/")
+		if len(parts) != 4 || parts[1] != "sets" || parts[3] != "head" {
+			return nil
+		}
+
+		mapId, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil
+		}
+
+		keys = append(keys, backend.key(mapId))
+		return nil
+	})
+
+	sortKeys(keys)
+	return
+}
+
+func (backend *PackedBackend) Lock(mapId int) (unlock func()) {
+	return backend.locks.lock(packedPrefix(mapId))
+}
+
+func (backend *PackedBackend) Freeze() (unfreeze func()) {
+	return backend.locks.freeze()
+}
+
+// Prune and repack the shared repository. Pruning can't run while new
+// objects are being written, so this freezes the whole store.
+func (backend *PackedBackend) Gc() (err error) {
+	unfreeze := backend.Freeze()
+	defer unfreeze()
+
+	inner, err := git.PlainOpen(backend.dir)
+	if err != nil {
+		return
+	}
+
+	return repack(inner)
+}
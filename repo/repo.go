@@ -0,0 +1,559 @@
+package repo
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+var (
+	ErrNotExist         = errors.New("repository doesn't exist")
+	ErrRevisionNotFound = errors.New("revision not found")
+	ErrNoParent         = errors.New("revision has no parent")
+	ErrNoChange         = errors.New("nothing changed since the last revision")
+	ErrReadOnly         = errors.New("repository view is read-only")
+)
+
+// A mapset repository, along with the mapper currently hosting it. UserID is 0
+// if the mapper isn't known.
+type Key struct {
+	UserID int
+	MapID  int
+}
+
+// The revision history of a single mapset. Every backend keeps history in git
+// objects; they only differ in where the references live.
+type Repo struct {
+	git *git.Repository
+	// worktree kept in sync with the latest revision, empty for bare storage
+	dir string
+	// reference pointing at the latest revision
+	branch plumbing.ReferenceName
+	// prefix of the references pointing at status tags
+	tagPrefix string
+	// reference pointing at the archived assets
+	assets plumbing.ReferenceName
+}
+
+type Revision struct {
+	Hash      string
+	Date      time.Time
+	Message   string
+	Summary   string
+	HasParent bool
+	// Hash of the previous revision, empty if this is the first one
+	Parent string
+	// Parsed trailers, nil for revisions made before they were recorded
+	Metadata *Metadata
+}
+
+type Diff struct {
+	Stats object.FileStats
+	Patch string
+}
+
+type SnapshotOptions struct {
+	Subject   string
+	Metadata  Metadata
+	Author    object.Signature
+	Committer object.Signature
+}
+
+// The underlying object and reference storage, for serving the repository
+// over git's own protocols. References are presented as if this mapset had a
+// repository to itself.
+func (repo *Repo) Storer() storer.Storer {
+	if repo.branch == plumbing.Master {
+		return repo.git.Storer
+	}
+
+	return &refView{repo.git.Storer, repo}
+}
+
+// Hash of the latest revision, plumbing.ErrReferenceNotFound if there's none
+func (repo *Repo) head() (hash plumbing.Hash, err error) {
+	ref, err := repo.git.Storer.Reference(repo.branch)
+	if err != nil {
+		return
+	}
+
+	hash = ref.Hash()
+	return
+}
+
+// Commit every file in src as a new revision, replacing whatever was in the
+// previous one. If the files are identical to the latest revision, nothing is
+// committed and ErrNoChange is returned.
+func (repo *Repo) Snapshot(src string, opts *SnapshotOptions) (rev Revision, err error) {
+	treeHash, empty, err := repo.writeTree(src)
+	if err != nil {
+		err = fmt.Errorf("couldn't store files from %s: %w", src, err)
+		return
+	}
+
+	commit := &object.Commit{
+		Author:    opts.Author,
+		Committer: opts.Committer,
+		Message:   FormatMessage(opts.Subject, &opts.Metadata),
+		TreeHash:  treeHash,
+	}
+
+	parentHash, err := repo.head()
+	if err == plumbing.ErrReferenceNotFound {
+		err = nil
+		if empty {
+			err = ErrNoChange
+			return
+		}
+	} else if err != nil {
+		return
+	} else {
+		var parent *object.Commit
+		parent, err = repo.git.CommitObject(parentHash)
+		if err != nil {
+			return
+		}
+		if parent.TreeHash == treeHash {
+			err = ErrNoChange
+			return
+		}
+		commit.ParentHashes = []plumbing.Hash{parentHash}
+	}
+
+	hash, err := repo.writeObject(commit)
+	if err != nil {
+		err = fmt.Errorf("couldn't create commit: %w", err)
+		return
+	}
+
+	err = repo.git.Storer.SetReference(plumbing.NewHashReference(repo.branch, hash))
+	if err != nil {
+		return
+	}
+
+	if repo.dir != "" {
+		err = repo.checkout(hash)
+		if err != nil {
+			// put the branch back so it doesn't point at a revision the
+			// worktree never got
+			if len(commit.ParentHashes) > 0 {
+				repo.git.Storer.SetReference(plumbing.NewHashReference(repo.branch, parentHash))
+				repo.checkout(parentHash)
+			} else {
+				repo.git.Storer.RemoveReference(repo.branch)
+			}
+			err = fmt.Errorf("couldn't update worktree: %w", err)
+			return
+		}
+	}
+
+	return repo.Revision(hash.String())
+}
+
+// Make the worktree match a revision exactly
+func (repo *Repo) checkout(hash plumbing.Hash) (err error) {
+	worktree, err := repo.git.Worktree()
+	if err != nil {
+		return
+	}
+
+	return worktree.Reset(&git.ResetOptions{Commit: hash, Mode: git.HardReset})
+}
+
+type encodable interface {
+	Encode(plumbing.EncodedObject) error
+}
+
+func (repo *Repo) writeObject(obj encodable) (hash plumbing.Hash, err error) {
+	encoded := repo.git.Storer.NewEncodedObject()
+	err = obj.Encode(encoded)
+	if err != nil {
+		return
+	}
+
+	return repo.git.Storer.SetEncodedObject(encoded)
+}
+
+// Store every regular file directly inside dir as blobs, and a tree holding
+// all of them
+func (repo *Repo) writeTree(dir string) (hash plumbing.Hash, empty bool, err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	tree := &object.Tree{}
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+
+		var blobHash plumbing.Hash
+		blobHash, err = repo.writeBlob(path.Join(dir, f.Name()))
+		if err != nil {
+			return
+		}
+
+		tree.Entries = append(tree.Entries, object.TreeEntry{
+			Name: f.Name(),
+			Mode: filemode.Regular,
+			Hash: blobHash,
+		})
+	}
+	sort.Slice(tree.Entries, func(i, j int) bool {
+		return tree.Entries[i].Name < tree.Entries[j].Name
+	})
+
+	empty = len(tree.Entries) == 0
+	hash, err = repo.writeObject(tree)
+	return
+}
+
+func (repo *Repo) writeBlob(filePath string) (hash plumbing.Hash, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	obj := repo.git.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, err := obj.Writer()
+	if err != nil {
+		return
+	}
+
+	_, err = io.Copy(w, file)
+	if err != nil {
+		return
+	}
+
+	err = w.Close()
+	if err != nil {
+		return
+	}
+
+	return repo.git.Storer.SetEncodedObject(obj)
+}
+
+// Look up a revision by hash, tag name or HEAD
+func (repo *Repo) resolve(name string) (commit *object.Commit, err error) {
+	var hash plumbing.Hash
+	if name == "HEAD" {
+		hash, err = repo.head()
+	} else if ref, err2 := repo.git.Storer.Reference(plumbing.ReferenceName(repo.tagPrefix + name)); err2 == nil {
+		hash = ref.Hash()
+	} else if plumbing.IsHash(name) {
+		hash = plumbing.NewHash(name)
+	} else {
+		var resolved *plumbing.Hash
+		resolved, err = repo.git.ResolveRevision(plumbing.Revision(name))
+		if err == nil {
+			hash = *resolved
+		}
+	}
+	if err != nil {
+		err = ErrRevisionNotFound
+		return
+	}
+
+	obj, err := repo.git.Storer.EncodedObject(plumbing.AnyObject, hash)
+	if err == plumbing.ErrObjectNotFound {
+		err = ErrRevisionNotFound
+		return
+	} else if err != nil {
+		return
+	}
+
+	if obj.Type() == plumbing.TagObject {
+		var tag *object.Tag
+		tag, err = object.DecodeTag(repo.git.Storer, obj)
+		if err != nil {
+			return
+		}
+		commit, err = tag.Commit()
+	} else {
+		commit, err = object.DecodeCommit(repo.git.Storer, obj)
+	}
+	if err == object.ErrUnsupportedObject {
+		err = ErrRevisionNotFound
+	}
+	if err != nil {
+		return
+	}
+
+	ok, err := repo.reachable(commit.Hash)
+	if err == nil && !ok {
+		commit, err = nil, ErrRevisionNotFound
+	}
+	return
+}
+
+// Whether a commit is part of this repository's history, reachable from its
+// branch or one of its tags. Mapsets share object storage under the packed
+// backend, so a hash on its own could name another mapset's revision.
+func (repo *Repo) reachable(target plumbing.Hash) (ok bool, err error) {
+	tips := make([]*object.Commit, 0)
+	head, err := repo.head()
+	if err == nil {
+		var commit *object.Commit
+		commit, err = repo.git.CommitObject(head)
+		if err != nil {
+			return
+		}
+		tips = append(tips, commit)
+	} else if err != plumbing.ErrReferenceNotFound {
+		return
+	}
+
+	names, err := repo.tagNames()
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		var tagObj *object.Tag
+		tagObj, err = repo.tagObject(name)
+		if err == plumbing.ErrObjectNotFound {
+			// lightweight tags weren't made by us
+			err = nil
+			continue
+		} else if err != nil {
+			return
+		}
+
+		var commit *object.Commit
+		commit, err = tagObj.Commit()
+		if err != nil {
+			return
+		}
+		tips = append(tips, commit)
+	}
+
+	// tags are nearly always on the branch, so walking them skips everything
+	// already seen
+	seen := make(map[plumbing.Hash]bool)
+	for _, tip := range tips {
+		err = object.NewCommitPreorderIter(tip, seen, nil).ForEach(func(commit *object.Commit) error {
+			seen[commit.Hash] = true
+			if commit.Hash == target {
+				ok = true
+				return storer.ErrStop
+			}
+			return nil
+		})
+		if err != nil || ok {
+			return
+		}
+	}
+	return
+}
+
+func revisionOf(commit *object.Commit, withSummary bool) (rev Revision, err error) {
+	_, err = commit.Parent(0)
+	hasParent := !errors.Is(err, object.ErrParentNotFound)
+	if err != nil && hasParent {
+		err = fmt.Errorf("couldn't retrieve commit parent: %w", err)
+		return
+	}
+	err = nil
+
+	rev = Revision{
+		Hash:      commit.Hash.String(),
+		Date:      commit.Author.When,
+		Message:   commit.Message,
+		HasParent: hasParent,
+	}
+	if hasParent {
+		rev.Parent = commit.ParentHashes[0].String()
+	}
+
+	meta, err := ParseMessage(commit.Message)
+	if err == nil {
+		rev.Metadata = &meta
+	} else if !errors.Is(err, ErrNoMetadata) {
+		err = fmt.Errorf("couldn't parse metadata for %s: %w", commit.Hash, err)
+		return
+	}
+	err = nil
+
+	if withSummary {
+		var stats object.FileStats
+		stats, err = commit.Stats()
+		if err != nil {
+			err = fmt.Errorf("couldn't compute stats for %s: %w", commit.Hash, err)
+			return
+		}
+		rev.Summary = stats.String()
+	}
+	return
+}
+
+// Look up a single revision by hash
+func (repo *Repo) Revision(hash string) (rev Revision, err error) {
+	commit, err := repo.resolve(hash)
+	if err != nil {
+		return
+	}
+
+	return revisionOf(commit, true)
+}
+
+func (repo *Repo) log() (logIter object.CommitIter, err error) {
+	head, err := repo.head()
+	if err != nil {
+		return
+	}
+
+	return repo.git.Log(&git.LogOptions{From: head})
+}
+
+// List up to limit revisions, newest first
+func (repo *Repo) Log(limit int) (revs []Revision, err error) {
+	revs = make([]Revision, 0)
+	logIter, err := repo.log()
+	if err == plumbing.ErrReferenceNotFound {
+		// no commits yet
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	defer logIter.Close()
+
+	for len(revs) < limit {
+		var commit *object.Commit
+		commit, err = logIter.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+
+		var rev Revision
+		rev, err = revisionOf(commit, true)
+		if err != nil {
+			return
+		}
+		revs = append(revs, rev)
+	}
+
+	return
+}
+
+// Diff a revision against its parent, returning ErrNoParent for the first one
+func (repo *Repo) Diff(hash string) (diff Diff, err error) {
+	commit, err := repo.resolve(hash)
+	if err != nil {
+		return
+	}
+
+	parent, err := commit.Parent(0)
+	if errors.Is(err, object.ErrParentNotFound) {
+		err = ErrNoParent
+		return
+	} else if err != nil {
+		err = fmt.Errorf("couldn't retrieve commit parent: %w", err)
+		return
+	}
+
+	patch, err := parent.Patch(commit)
+	if err != nil {
+		err = fmt.Errorf("couldn't retrieve patch: %w", err)
+		return
+	}
+
+	diff = Diff{
+		Stats: patch.Stats(),
+		Patch: patch.String(),
+	}
+	return
+}
+
+// Read a single file as it was at the given revision
+func (repo *Repo) FileAt(hash string, name string) (data []byte, err error) {
+	commit, err := repo.resolve(hash)
+	if err != nil {
+		return
+	}
+
+	file, err := commit.File(name)
+	if err != nil {
+		return
+	}
+
+	contents, err := file.Contents()
+	if err != nil {
+		return
+	}
+
+	data = []byte(contents)
+	return
+}
+
+// Write a zip of every file in the given revision to w
+func (repo *Repo) Archive(hash string, w io.Writer) (err error) {
+	commit, err := repo.resolve(hash)
+	if err != nil {
+		return
+	}
+
+	files, err := commit.Files()
+	if err != nil {
+		return
+	}
+	defer files.Close()
+
+	ar := zip.NewWriter(w)
+	err = files.ForEach(func(file *object.File) error {
+		reader, err := file.Reader()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		fdest, err := ar.Create(file.Name)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(fdest, reader)
+		return err
+	})
+	if err != nil {
+		return
+	}
+
+	return ar.Close()
+}
+
+// List the names of every tag reference, without the prefix
+func (repo *Repo) tagNames() (names []string, err error) {
+	refs, err := repo.git.Storer.IterReferences()
+	if err != nil {
+		return
+	}
+	defer refs.Close()
+
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().String()
+		if strings.HasPrefix(name, repo.tagPrefix) {
+			names = append(names, strings.TrimPrefix(name, repo.tagPrefix))
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,293 @@
+package repo
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+var testEpoch = time.Date(2020, 10, 10, 12, 0, 0, 0, time.UTC)
+
+// Run a test against a fresh instance of each backend
+func eachBackendOf(t *testing.T, test func(t *testing.T, backend Backend)) {
+	backends := map[string]func(root string) (Backend, error){
+		BACKEND_DIR:    func(root string) (Backend, error) { return NewDirBackend(root) },
+		BACKEND_PACKED: func(root string) (Backend, error) { return NewPackedBackend(root) },
+	}
+
+	for name, newBackend := range backends {
+		t.Run(name, func(t *testing.T) {
+			backend, err := newBackend(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			test(t, backend)
+		})
+	}
+}
+
+// Run a test against a fresh repository on each backend
+func eachBackend(t *testing.T, test func(t *testing.T, r *Repo)) {
+	eachBackendOf(t, func(t *testing.T, backend Backend) {
+		r, err := backend.OpenOrInit(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test(t, r)
+	})
+}
+
+// Snapshot a directory holding exactly the given files. n numbers the
+// revision, dating it n hours after testEpoch.
+func snapshotFiles(t *testing.T, r *Repo, n int, files map[string]string) (rev Revision, err error) {
+	t.Helper()
+
+	src := t.TempDir()
+	for name, contents := range files {
+		err = ioutil.WriteFile(filepath.Join(src, name), []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	when := testEpoch.Add(time.Duration(n) * time.Hour)
+	return r.Snapshot(src, &SnapshotOptions{
+		Subject: "Update Artist - Title (1)",
+		Metadata: Metadata{
+			BeatmapsetID: 1,
+			Status:       "pending",
+			LastUpdated:  when.Format(time.RFC3339),
+		},
+		Author:    object.Signature{Name: "mapper", When: when},
+		Committer: object.Signature{Name: "subscribe-bot", When: when},
+	})
+}
+
+func mustSnapshot(t *testing.T, r *Repo, n int, files map[string]string) Revision {
+	t.Helper()
+
+	rev, err := snapshotFiles(t, r, n, files)
+	if err != nil {
+		t.Fatalf("couldn't snapshot revision %d: %s", n, err)
+	}
+	return rev
+}
+
+func TestSnapshot(t *testing.T) {
+	eachBackend(t, func(t *testing.T, r *Repo) {
+		_, err := snapshotFiles(t, r, 0, nil)
+		if !errors.Is(err, ErrNoChange) {
+			t.Fatalf("expected an empty first snapshot to be ErrNoChange, got %v", err)
+		}
+
+		first := mustSnapshot(t, r, 1, map[string]string{"1.osu": "one"})
+		if first.HasParent || first.Parent != "" {
+			t.Errorf("first revision has a parent %q", first.Parent)
+		}
+		if first.Metadata == nil || first.Metadata.LastUpdated != testEpoch.Add(time.Hour).Format(time.RFC3339) {
+			t.Errorf("metadata wasn't kept: %+v", first.Metadata)
+		}
+
+		_, err = snapshotFiles(t, r, 2, map[string]string{"1.osu": "one"})
+		if !errors.Is(err, ErrNoChange) {
+			t.Fatalf("expected an identical snapshot to be ErrNoChange, got %v", err)
+		}
+
+		second := mustSnapshot(t, r, 3, map[string]string{"1.osu": "one", "2.osu": "two"})
+		if second.Parent != first.Hash {
+			t.Errorf("expected parent %s, got %s", first.Hash, second.Parent)
+		}
+
+		if r.dir == "" {
+			return
+		}
+		matches, err := filepath.Glob(filepath.Join(r.dir, "*.osu"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(matches)
+		if len(matches) != 2 || filepath.Base(matches[0]) != "1.osu" || filepath.Base(matches[1]) != "2.osu" {
+			t.Errorf("worktree doesn't match the last revision: %v", matches)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(r.dir, "2.osu"))
+		if err != nil || string(data) != "two" {
+			t.Errorf("expected 2.osu to contain %q, got %q (%v)", "two", data, err)
+		}
+
+		// files dropped from a revision are removed from the worktree too
+		mustSnapshot(t, r, 4, map[string]string{"2.osu": "two"})
+		matches, err = filepath.Glob(filepath.Join(r.dir, "*.osu"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != 1 || filepath.Base(matches[0]) != "2.osu" {
+			t.Errorf("worktree doesn't match the last revision: %v", matches)
+		}
+	})
+}
+
+func TestLog(t *testing.T) {
+	eachBackend(t, func(t *testing.T, r *Repo) {
+		revs, err := r.Log(10)
+		if err != nil || len(revs) != 0 {
+			t.Fatalf("expected an empty log, got %v (%v)", revs, err)
+		}
+
+		hashes := make([]string, 0)
+		for i := 1; i <= 3; i++ {
+			rev := mustSnapshot(t, r, i, map[string]string{"1.osu": string(rune('a' + i))})
+			hashes = append(hashes, rev.Hash)
+		}
+
+		revs, err = r.Log(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(revs) != 3 {
+			t.Fatalf("expected 3 revisions, got %d", len(revs))
+		}
+		for i, rev := range revs {
+			if rev.Hash != hashes[len(hashes)-1-i] {
+				t.Errorf("revision %d is %s, expected %s", i, rev.Hash, hashes[len(hashes)-1-i])
+			}
+		}
+
+		revs, err = r.Log(2)
+		if err != nil || len(revs) != 2 {
+			t.Errorf("expected the log to stop at 2, got %d (%v)", len(revs), err)
+		}
+	})
+}
+
+func TestDiff(t *testing.T) {
+	eachBackend(t, func(t *testing.T, r *Repo) {
+		first := mustSnapshot(t, r, 1, map[string]string{"1.osu": "one\n"})
+		second := mustSnapshot(t, r, 2, map[string]string{"1.osu": "one\nmore\n"})
+
+		_, err := r.Diff(first.Hash)
+		if !errors.Is(err, ErrNoParent) {
+			t.Errorf("expected ErrNoParent for the first revision, got %v", err)
+		}
+
+		diff, err := r.Diff(second.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(diff.Stats) != 1 || diff.Stats[0].Name != "1.osu" || diff.Stats[0].Addition != 1 || diff.Stats[0].Deletion != 0 {
+			t.Errorf("unexpected stats: %+v", diff.Stats)
+		}
+		if !bytes.Contains([]byte(diff.Patch), []byte("+more")) {
+			t.Errorf("patch doesn't add the line:\n%s", diff.Patch)
+		}
+
+		_, err = r.Diff("0123456789012345678901234567890123456789")
+		if !errors.Is(err, ErrRevisionNotFound) {
+			t.Errorf("expected ErrRevisionNotFound, got %v", err)
+		}
+	})
+}
+
+func TestFileAt(t *testing.T) {
+	eachBackend(t, func(t *testing.T, r *Repo) {
+		first := mustSnapshot(t, r, 1, map[string]string{"1.osu": "old"})
+		mustSnapshot(t, r, 2, map[string]string{"1.osu": "new"})
+
+		data, err := r.FileAt(first.Hash, "1.osu")
+		if err != nil || string(data) != "old" {
+			t.Errorf("expected %q, got %q (%v)", "old", data, err)
+		}
+
+		data, err = r.FileAt("HEAD", "1.osu")
+		if err != nil || string(data) != "new" {
+			t.Errorf("expected %q, got %q (%v)", "new", data, err)
+		}
+
+		_, err = r.FileAt(first.Hash, "2.osu")
+		if err == nil {
+			t.Error("expected an error for a missing file")
+		}
+	})
+}
+
+func TestArchive(t *testing.T) {
+	eachBackend(t, func(t *testing.T, r *Repo) {
+		files := map[string]string{"1.osu": "one", "2.osu": "two"}
+		rev := mustSnapshot(t, r, 1, files)
+
+		var buf bytes.Buffer
+		err := r.Archive(rev.Hash, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(zr.File) != len(files) {
+			t.Errorf("expected %d files, got %d", len(files), len(zr.File))
+		}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil || string(data) != files[f.Name] {
+				t.Errorf("expected %s to contain %q, got %q (%v)", f.Name, files[f.Name], data, err)
+			}
+		}
+	})
+}
+
+func TestForeignRevisions(t *testing.T) {
+	eachBackendOf(t, func(t *testing.T, backend Backend) {
+		mine, err := backend.OpenOrInit(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		theirs, err := backend.OpenOrInit(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		own := mustSnapshot(t, mine, 1, map[string]string{"1.osu": "mine"})
+		mustSnapshot(t, mine, 2, map[string]string{"1.osu": "mine, later"})
+		_, err = mine.RecordStatus("pending", testEpoch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := mustSnapshot(t, theirs, 1, map[string]string{"1.osu": "theirs"})
+		foreign := mustSnapshot(t, theirs, 2, map[string]string{"1.osu": "theirs, later"})
+
+		if _, err := mine.Revision(own.Hash); err != nil {
+			t.Errorf("couldn't resolve an older revision of its own: %s", err)
+		}
+		if _, err := mine.Revision("pending-1"); err != nil {
+			t.Errorf("couldn't resolve its own tag: %s", err)
+		}
+
+		reads := map[string]func(hash string) error{
+			"Revision": func(hash string) error { _, err := mine.Revision(hash); return err },
+			"Diff":     func(hash string) error { _, err := mine.Diff(hash); return err },
+			"FileAt":   func(hash string) error { _, err := mine.FileAt(hash, "1.osu"); return err },
+			"Archive":  func(hash string) error { return mine.Archive(hash, ioutil.Discard) },
+			"Blame":    func(hash string) error { _, err := mine.Blame(hash, "1.osu"); return err },
+			"Compare":  func(hash string) error { _, err := mine.Compare(first.Hash, hash); return err },
+		}
+		for name, read := range reads {
+			err := read(foreign.Hash)
+			if !errors.Is(err, ErrRevisionNotFound) {
+				t.Errorf("%s of another mapset's revision: expected ErrRevisionNotFound, got %v", name, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,269 @@
+package repo
+
+// Status transitions are recorded as annotated tags named <status>-<n>, where
+// n counts how many times the mapset has entered that status. The most recent
+// tag holds the status the mapset was last seen in.
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const (
+	STATUS_PENDING      = "pending"
+	STATUS_QUALIFIED    = "qualified"
+	STATUS_DISQUALIFIED = "disqualified"
+	STATUS_RANKED       = "ranked"
+	STATUS_LOVED        = "loved"
+	STATUS_GRAVEYARDED  = "graveyarded"
+)
+
+type Tag struct {
+	Name   string
+	Status string
+	// Hash of the tagged revision
+	Hash string
+	Date time.Time
+	// Status before this one, not set by Tags. Empty for the first status
+	// recorded.
+	Previous string
+}
+
+// Map the status reported by the API onto the name used for tags
+func tagStatus(apiStatus string) string {
+	switch apiStatus {
+	case "graveyard":
+		return STATUS_GRAVEYARDED
+	case "wip":
+		return STATUS_PENDING
+	case "approved":
+		return STATUS_RANKED
+	default:
+		return apiStatus
+	}
+}
+
+// The status to record when going from previous to status. A qualified mapset
+// going back to pending is recorded as disqualified.
+func followingStatus(previous string, status string) string {
+	if status == STATUS_PENDING && (previous == STATUS_QUALIFIED || previous == STATUS_DISQUALIFIED) {
+		return STATUS_DISQUALIFIED
+	}
+	return status
+}
+
+func statusOfTagName(name string) string {
+	idx := strings.LastIndex(name, "-")
+	if idx < 0 {
+		return name
+	}
+	return name[:idx]
+}
+
+// List every status tag, oldest first
+func (repo *Repo) Tags() (tags []Tag, err error) {
+	tags = make([]Tag, 0)
+	names, err := repo.tagNames()
+	if err != nil {
+		return
+	}
+
+	for _, name := range names {
+		var tagObj *object.Tag
+		tagObj, err = repo.tagObject(name)
+		if err == plumbing.ErrObjectNotFound {
+			// lightweight tags weren't made by us
+			err = nil
+			continue
+		} else if err != nil {
+			return
+		}
+
+		var commit *object.Commit
+		commit, err = tagObj.Commit()
+		if err != nil {
+			return
+		}
+
+		tags = append(tags, Tag{
+			Name:   name,
+			Status: statusOfTagName(name),
+			Hash:   commit.Hash.String(),
+			Date:   tagObj.Tagger.When,
+		})
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].Date.Before(tags[j].Date)
+	})
+	return
+}
+
+func (repo *Repo) tagObject(name string) (tagObj *object.Tag, err error) {
+	ref, err := repo.git.Storer.Reference(plumbing.ReferenceName(repo.tagPrefix + name))
+	if err != nil {
+		return
+	}
+
+	return repo.git.TagObject(ref.Hash())
+}
+
+// Create an annotated tag pointing at target
+func (repo *Repo) createTag(name string, target plumbing.Hash, tagger object.Signature, message string) (err error) {
+	refName := plumbing.ReferenceName(repo.tagPrefix + name)
+	if _, err = repo.git.Storer.Reference(refName); err == nil {
+		err = git.ErrTagExists
+		return
+	} else if err != plumbing.ErrReferenceNotFound {
+		return
+	}
+
+	return repo.setTag(name, target, tagger, message)
+}
+
+// Point a tag at target with a new tag object, replacing whatever it pointed
+// at before in one step
+func (repo *Repo) setTag(name string, target plumbing.Hash, tagger object.Signature, message string) (err error) {
+	hash, err := repo.writeObject(&object.Tag{
+		Name:       name,
+		Tagger:     tagger,
+		Message:    strings.TrimSpace(message) + "\n",
+		TargetType: plumbing.CommitObject,
+		Target:     target,
+	})
+	if err != nil {
+		return
+	}
+
+	refName := plumbing.ReferenceName(repo.tagPrefix + name)
+	return repo.git.Storer.SetReference(plumbing.NewHashReference(refName, hash))
+}
+
+func (repo *Repo) deleteTag(name string) error {
+	return repo.git.Storer.RemoveReference(plumbing.ReferenceName(repo.tagPrefix + name))
+}
+
+// The most recent tag for the given status, if there is one
+func (repo *Repo) LatestTag(status string) (tag Tag, ok bool, err error) {
+	tags, err := repo.Tags()
+	if err != nil {
+		return
+	}
+
+	for i := len(tags) - 1; i >= 0; i-- {
+		if tags[i].Status == status {
+			tag, ok = tags[i], true
+			return
+		}
+	}
+	return
+}
+
+// Tag the latest revision if the mapset's status differs from the last one
+// that was recorded. A qualified mapset going back to pending is recorded as
+// disqualified. Returns nil if the status didn't change.
+func (repo *Repo) RecordStatus(apiStatus string, when time.Time) (tag *Tag, err error) {
+	if apiStatus == "" {
+		return
+	}
+
+	head, err := repo.head()
+	if err == plumbing.ErrReferenceNotFound {
+		// nothing to tag yet
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+
+	previous, status, count, err := repo.nextStatus(apiStatus)
+	if err != nil || status == previous {
+		return
+	}
+
+	name := status + "-" + strconv.Itoa(count+1)
+	err = repo.createTag(
+		name,
+		head,
+		object.Signature{Name: "subscribe-bot", When: when},
+		fmt.Sprintf("Status changed to %s", status),
+	)
+	if err != nil {
+		err = fmt.Errorf("couldn't create tag %s: %w", name, err)
+		return
+	}
+
+	tag = &Tag{
+		Name:     name,
+		Status:   status,
+		Hash:     head.String(),
+		Date:     when,
+		Previous: previous,
+	}
+	return
+}
+
+// The status last recorded and the one RecordStatus would record for
+// apiStatus, along with how many times the mapset has been in that one
+func (repo *Repo) nextStatus(apiStatus string) (previous string, status string, count int, err error) {
+	tags, err := repo.Tags()
+	if err != nil {
+		return
+	}
+
+	counts := make(map[string]int)
+	for _, t := range tags {
+		counts[t.Status]++
+		previous = t.Status
+	}
+
+	status = followingStatus(previous, tagStatus(apiStatus))
+	count = counts[status]
+	return
+}
+
+// What RecordStatus would do without doing it: the status last recorded and
+// the one it would change to, or an empty status if it wouldn't change
+func (repo *Repo) StatusChange(apiStatus string) (previous string, status string, err error) {
+	if apiStatus == "" {
+		return
+	}
+
+	previous, status, _, err = repo.nextStatus(apiStatus)
+	if status == previous {
+		status = ""
+	}
+	return
+}
+
+// Diff two arbitrary revisions, which may be given as hashes or tag names
+func (repo *Repo) Compare(from string, to string) (diff Diff, err error) {
+	fromCommit, err := repo.resolve(from)
+	if err != nil {
+		return
+	}
+
+	toCommit, err := repo.resolve(to)
+	if err != nil {
+		return
+	}
+
+	patch, err := fromCommit.Patch(toCommit)
+	if err != nil {
+		err = fmt.Errorf("couldn't retrieve patch: %w", err)
+		return
+	}
+
+	diff = Diff{
+		Stats: patch.Stats(),
+		Patch: patch.String(),
+	}
+	return
+}
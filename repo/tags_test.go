@@ -0,0 +1,108 @@
+package repo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFollowingStatus(t *testing.T) {
+	tests := []struct {
+		previous, status, want string
+	}{
+		{"", STATUS_PENDING, STATUS_PENDING},
+		{STATUS_PENDING, STATUS_QUALIFIED, STATUS_QUALIFIED},
+		{STATUS_QUALIFIED, STATUS_PENDING, STATUS_DISQUALIFIED},
+		{STATUS_DISQUALIFIED, STATUS_PENDING, STATUS_DISQUALIFIED},
+		{STATUS_DISQUALIFIED, STATUS_QUALIFIED, STATUS_QUALIFIED},
+		{STATUS_GRAVEYARDED, STATUS_PENDING, STATUS_PENDING},
+		{STATUS_QUALIFIED, STATUS_RANKED, STATUS_RANKED},
+		{STATUS_RANKED, STATUS_PENDING, STATUS_PENDING},
+	}
+
+	for _, test := range tests {
+		got := followingStatus(test.previous, test.status)
+		if got != test.want {
+			t.Errorf("followingStatus(%q, %q) = %q, want %q", test.previous, test.status, got, test.want)
+		}
+	}
+}
+
+func TestRecordStatus(t *testing.T) {
+	// each step is an API status and the tag it should make, if any
+	type step struct {
+		apiStatus string
+		tag       string
+		previous  string
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"ranking", []step{
+			{"pending", "pending-1", ""},
+			{"pending", "", ""},
+			{"qualified", "qualified-1", "pending"},
+			{"pending", "disqualified-1", "qualified"},
+			// a disqualified mapset stays disqualified until it's qualified
+			// again
+			{"pending", "", ""},
+			{"qualified", "qualified-2", "disqualified"},
+			{"ranked", "ranked-1", "qualified"},
+		}},
+		{"api names", []step{
+			{"wip", "pending-1", ""},
+			{"graveyard", "graveyarded-1", "pending"},
+			{"wip", "pending-2", "graveyarded"},
+			{"approved", "ranked-1", "pending"},
+			{"", "", ""},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			eachBackend(t, func(t *testing.T, r *Repo) {
+				tag, err := r.RecordStatus("pending", testEpoch)
+				if err != nil || tag != nil {
+					t.Fatalf("expected nothing to be tagged without revisions, got %+v (%v)", tag, err)
+				}
+
+				mustSnapshot(t, r, 0, map[string]string{"1.osu": "one"})
+				names := make([]string, 0)
+				for i, step := range test.steps {
+					when := testEpoch.Add(time.Duration(i) * time.Minute)
+					tag, err := r.RecordStatus(step.apiStatus, when)
+					if err != nil {
+						t.Fatalf("step %d: %s", i, err)
+					}
+
+					if step.tag == "" {
+						if tag != nil {
+							t.Errorf("step %d: expected no tag, got %s", i, tag.Name)
+						}
+						continue
+					}
+					if tag == nil {
+						t.Fatalf("step %d: expected %s, got no tag", i, step.tag)
+					}
+					if tag.Name != step.tag || tag.Previous != step.previous {
+						t.Errorf("step %d: expected %s after %q, got %s after %q", i, step.tag, step.previous, tag.Name, tag.Previous)
+					}
+					names = append(names, tag.Name)
+				}
+
+				tags, err := r.Tags()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(tags) != len(names) {
+					t.Fatalf("expected %d tags, got %d", len(names), len(tags))
+				}
+				for i, tag := range tags {
+					if tag.Name != names[i] {
+						t.Errorf("tag %d is %s, expected %s", i, tag.Name, names[i])
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package repo
+
+import (
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// A read-only view of shared storage that only shows the references of one
+// repository, renamed to what they'd be in a repository of its own
+type refView struct {
+	storer.Storer
+	repo *Repo
+}
+
+const viewTagPrefix = "refs/tags/"
+
+func (view *refView) Reference(name plumbing.ReferenceName) (ref *plumbing.Reference, err error) {
+	switch {
+	case name == plumbing.HEAD:
+		ref = plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.Master)
+		return
+	case name == plumbing.Master:
+		var hash plumbing.Hash
+		hash, err = view.repo.head()
+		if err != nil {
+			return
+		}
+		ref = plumbing.NewHashReference(plumbing.Master, hash)
+		return
+	case strings.HasPrefix(name.String(), viewTagPrefix):
+		tagName := strings.TrimPrefix(name.String(), viewTagPrefix)
+		ref, err = view.Storer.Reference(plumbing.ReferenceName(view.repo.tagPrefix + tagName))
+		if err != nil {
+			return
+		}
+		ref = plumbing.NewHashReference(name, ref.Hash())
+		return
+	}
+
+	err = plumbing.ErrReferenceNotFound
+	return
+}
+
+func (view *refView) IterReferences() (iter storer.ReferenceIter, err error) {
+	refs := make([]*plumbing.Reference, 0)
+
+	head, err := view.Reference(plumbing.Master)
+	if err == nil {
+		refs = append(refs, head)
+	} else if err != plumbing.ErrReferenceNotFound {
+		return
+	}
+
+	names, err := view.repo.tagNames()
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		var ref *plumbing.Reference
+		ref, err = view.Reference(plumbing.ReferenceName(viewTagPrefix + name))
+		if err != nil {
+			return
+		}
+		refs = append(refs, ref)
+	}
+
+	iter = storer.NewReferenceSliceIter(refs)
+	return
+}
+
+func (view *refView) SetReference(*plumbing.Reference) error {
+	return ErrReadOnly
+}
+
+func (view *refView) CheckAndSetReference(*plumbing.Reference, *plumbing.Reference) error {
+	return ErrReadOnly
+}
+
+func (view *refView) RemoveReference(plumbing.ReferenceName) error {
+	return ErrReadOnly
+}
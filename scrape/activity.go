@@ -0,0 +1,257 @@
+package scrape
+
+// The activity strategy polls each tracked mapper's recent activity feed in
+// turn instead of searching every mapset. Each mapper's feed has its own
+// cursor, the ID of the latest event handled, saved in the database. Mappers
+// are polled round-robin by user ID, a few every tick, so everyone is polled
+// equally often however the list of tracked mappers changes. Mapsets tracked
+// on their own whose host isn't tracked are fetched directly in the same way.
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"subscribe-bot/db"
+	"subscribe-bot/osuapi"
+)
+
+const (
+	STRATEGY_SEARCH   = "search"
+	STRATEGY_ACTIVITY = "activity"
+	STRATEGY_BOTH     = "both"
+
+	DEFAULT_ACTIVITY_PER_MINUTE = 120
+	// activity feed pages are fetched this many events at a time
+	ACTIVITY_PAGE_SIZE = 50
+)
+
+// Work out which scrape strategies the config asks for
+func strategies(strategy string) (search bool, activity bool, err error) {
+	switch strategy {
+	case "", STRATEGY_SEARCH:
+		search = true
+	case STRATEGY_ACTIVITY:
+		activity = true
+	case STRATEGY_BOTH:
+		search, activity = true, true
+	default:
+		err = fmt.Errorf("unknown scrape strategy %s", strategy)
+	}
+	return
+}
+
+// How many mappers to poll every tick, according to the budget
+func (s *Scraper) activityPerTick() int {
+	perMinute := s.config.Scraper.ActivityPerMinute
+	if perMinute <= 0 {
+		perMinute = DEFAULT_ACTIVITY_PER_MINUTE
+	}
+
+	perTick := int(time.Duration(perMinute) * s.interval() / time.Minute)
+	if perTick < 1 {
+		perTick = 1
+	}
+	return perTick
+}
+
+// Poll the next few tracked mappers' activity feeds, and the next few mapsets
+// that aren't covered by them, picking up where the last tick left off
+func (s *Scraper) scrapeActivity(ctx context.Context) {
+	t := s.trackedNow()
+	mappers := make([]int, 0, len(t.mappers))
+	for userId := range t.mappers {
+		mappers = append(mappers, userId)
+	}
+	mapsets := make([]int, 0)
+	for mapId := range t.mapsets {
+		if host, ok := s.repos.Mapper(mapId); !ok || !t.mappers[host] {
+			mapsets = append(mapsets, mapId)
+		}
+	}
+	if len(mappers)+len(mapsets) == 0 {
+		return
+	}
+
+	// the budget is shared out between the two
+	count := s.activityPerTick()
+	mapperCount := count * len(mappers) / (len(mappers) + len(mapsets))
+	if mapperCount == 0 && len(mappers) > 0 {
+		mapperCount = 1
+	}
+
+	polled := rotate(mappers, &s.activityNext, mapperCount)
+	errs := s.runPool(ctx, polled, func(i int) error {
+		return s.pollMapper(ctx, polled[i])
+	})
+	for i, err := range errs {
+		if err != nil {
+			log.Printf("error polling activity of %d: %s\n", polled[i], err)
+		}
+	}
+
+	fetched := rotate(mapsets, &s.activityNextMapset, count-mapperCount)
+	errs = s.runPool(ctx, fetched, func(i int) error {
+		return s.handleActivity(ctx, fetched[i], 0, s.config.Scraper.Strategy == STRATEGY_ACTIVITY)
+	})
+	for i, err := range errs {
+		if err != nil {
+			log.Printf("error fetching tracked mapset %d: %s\n", fetched[i], err)
+		}
+	}
+}
+
+// Take up to count IDs in order, starting from the first at or after next and
+// wrapping around, then move next past the last one taken
+func rotate(ids []int, next *int, count int) (taken []int) {
+	if count > len(ids) {
+		count = len(ids)
+	}
+	if count <= 0 {
+		return
+	}
+	sort.Ints(ids)
+
+	start := sort.SearchInts(ids, *next)
+	taken = make([]int, count)
+	for i := range taken {
+		taken[i] = ids[(start+i)%len(ids)]
+	}
+	*next = taken[count-1] + 1
+	return
+}
+
+// Handle every new upload or update in a mapper's activity feed, oldest first,
+// saving the feed's cursor after each one that's done
+func (s *Scraper) pollMapper(ctx context.Context, userId int) (err error) {
+	newMaps, latestEvent, err := getNewMaps(s.db, s.api, userId)
+	if err != nil {
+		return
+	}
+
+	if len(newMaps) == 0 {
+		if latestEvent > 0 && ctx.Err() == nil {
+			err = s.db.UpdateMapperLatestEvent(userId, latestEvent)
+		}
+		return
+	}
+
+	// the search already posts touch notes when it runs too
+	touched := s.config.Scraper.Strategy == STRATEGY_ACTIVITY
+	handled := make(map[int]bool)
+	for i := len(newMaps) - 1; i >= 0; i-- {
+		event := newMaps[i]
+		mapId, err := eventBeatmapsetId(event)
+		if err != nil {
+			log.Printf("couldn't find mapset of event %d: %s\n", event.ID, err)
+			continue
+		}
+
+		// a later event for the same mapset always fetches the latest version
+		// anyway
+		if !handled[mapId] {
+			handled[mapId] = true
+			err = s.handleActivity(ctx, mapId, event.ID, touched)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		err = s.db.UpdateMapperLatestEvent(userId, event.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if latestEvent > 0 && ctx.Err() == nil {
+		err = s.db.UpdateMapperLatestEvent(userId, latestEvent)
+	}
+	return
+}
+
+func (s *Scraper) handleActivity(ctx context.Context, mapId int, eventId int, touched bool) (err error) {
+	beatmapSet, err := s.api.GetBeatmapSet(mapId)
+	if err != nil {
+		err = fmt.Errorf("couldn't fetch mapset %d: %w", mapId, err)
+		return
+	}
+
+	if s.alreadyAnnounced(beatmapSet) {
+		return
+	}
+
+	err = s.handleUpdate(ctx, beatmapSet, eventId, touched)
+	if err != nil && (ctx.Err() != nil || !s.giveUp(beatmapSet, err)) {
+		return
+	}
+	err = nil
+	return
+}
+
+// Whether this version of a mapset was already announced, which happens when
+// the search got to it first. A revision that was committed but never
+// announced still needs handling, so it's the announced record that counts,
+// not the repository.
+func (s *Scraper) alreadyAnnounced(beatmapSet osuapi.Beatmapset) bool {
+	announced, ok := s.db.Announced(beatmapSet.ID)
+	return ok && announced.LastUpdated == beatmapSet.LastUpdated
+}
+
+// Event links look like /s/<mapset id> or /beatmapsets/<mapset id>
+func eventBeatmapsetId(event osuapi.Event) (mapId int, err error) {
+	url := event.Beatmapset.URL
+	return strconv.Atoi(url[strings.LastIndex(url, "/")+1:])
+}
+
+// Read a mapper's activity feed back to the last event handled, returning new
+// uploads and updates newest first along with the ID of the latest event of
+// any kind. Nothing is saved, so that the caller can move the cursor once
+// they're handled. On the first poll nothing is returned but the latest event.
+func getNewMaps(db *db.Db, api *osuapi.Osuapi, userId int) (newMaps []osuapi.Event, latestEvent int, err error) {
+	// see if there's a last event
+	hasLastEvent, lastEventId := db.MapperLastEvent(userId)
+	newMaps = make([]osuapi.Event, 0)
+	offset := 0
+
+loop:
+	for {
+		var events []osuapi.Event
+		events, err = api.GetUserEvents(userId, ACTIVITY_PAGE_SIZE, offset)
+		if err != nil {
+			err = fmt.Errorf("couldn't load events for user %d, offset %d: %w", userId, offset, err)
+			return
+		}
+		if len(events) == 0 {
+			break
+		}
+
+		for _, event := range events {
+			if event.ID > latestEvent {
+				latestEvent = event.ID
+			}
+			if !hasLastEvent {
+				break loop
+			}
+			if event.ID <= lastEventId {
+				break loop
+			}
+
+			if event.Type == "beatmapsetUpload" ||
+				event.Type == "beatmapsetRevive" ||
+				event.Type == "beatmapsetUpdate" {
+				newMaps = append(newMaps, event)
+			}
+		}
+
+		offset += len(events)
+	}
+
+	return
+}
@@ -0,0 +1,69 @@
+package scrape
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"subscribe-bot/db"
+	"subscribe-bot/osuapi"
+	"subscribe-bot/repo"
+)
+
+func TestAlreadyAnnounced(t *testing.T) {
+	const earlier, later = "2020-10-10T12:00:00Z", "2020-10-11T12:00:00Z"
+
+	tests := []struct {
+		name string
+		// Last-Updated of the revision committed, if any
+		committed string
+		// Last-Updated on record as announced, if any
+		announced string
+		want      bool
+	}{
+		{"never seen", "", "", false},
+		{"announced", later, later, true},
+		{"committed but never announced", later, earlier, false},
+		{"announced before the repository was lost", "", later, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestScraper(t)
+			beatmapSet := osuapi.Beatmapset{ID: 1, UserID: 1, LastUpdated: later}
+
+			if test.committed != "" {
+				r, err := s.repos.OpenOrInit(beatmapSet.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				src := t.TempDir()
+				err = ioutil.WriteFile(filepath.Join(src, "1.osu"), []byte("one"), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = r.Snapshot(src, &repo.SnapshotOptions{
+					Subject:   "Update Artist - Title (1)",
+					Metadata:  repo.Metadata{BeatmapsetID: 1, LastUpdated: test.committed},
+					Author:    object.Signature{Name: "mapper"},
+					Committer: object.Signature{Name: "subscribe-bot"},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.announced != "" {
+				err := s.db.SetAnnounced(beatmapSet.ID, db.Announced{LastUpdated: test.announced})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := s.alreadyAnnounced(beatmapSet); got != test.want {
+				t.Errorf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package scrape
+
+import (
+	"log"
+	"time"
+
+	"subscribe-bot/db"
+	"subscribe-bot/discord"
+)
+
+// Work out what every channel should be sent about an update. Channels with a
+// debounce window get a single announcement for every revision that comes in
+// during the window, with the diff since the last revision they were told
+// about. Nothing is queued until the deliveries are handed to db.Announce.
+func (s *Scraper) deliveries(channels []string, update discord.BeatmapUpdate) (deliveries []db.Delivery, err error) {
+	if len(channels) == 0 {
+		return
+	}
+
+	message, err := s.bot.AnnouncementMessage(update)
+	if err != nil {
+		return
+	}
+
+	// later revisions are diffed from wherever this one's diff started
+	base := update.Revision.Parent
+	if update.Since != "" {
+		base = update.Since
+	}
+
+	now := time.Now()
+	for _, channelId := range channels {
+		delivery := db.Delivery{ChannelID: channelId, Message: message}
+		window := s.db.ChannelSettingDuration(channelId, db.SETTING_DEBOUNCE)
+		// status changes on their own have nothing to coalesce with
+		if window <= 0 || update.Revision.Hash == "" {
+			deliveries = append(deliveries, delivery)
+			continue
+		}
+
+		delivery.Window = window
+		delivery.EditPrevious = s.db.ChannelSettingEnabled(channelId, db.SETTING_EDIT_PREVIOUS)
+		delivery.Hash = update.Revision.Hash
+		delivery.Base = base
+
+		last, ok := s.db.Announcement(channelId, update.Beatmapset.ID)
+		if ok && last.Base != "" && last.Hash != update.Revision.Hash && now.Sub(last.WindowStart) < window {
+			delivery.Coalesced, err = s.coalesced(update, last)
+			if err != nil {
+				return
+			}
+			delivery.Previous = last
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return
+}
+
+// The announcement for an update folded into the one already made in the
+// window, with the diff since that one started. Returns nil if the revision
+// it started from is gone.
+func (s *Scraper) coalesced(update discord.BeatmapUpdate, last db.Announcement) (message []byte, err error) {
+	mapId := update.Beatmapset.ID
+	r, err := s.repos.Open(mapId)
+	if err != nil {
+		return
+	}
+
+	unlock := s.repos.Lock(mapId)
+	diff, err := r.Compare(last.Base, update.Revision.Hash)
+	unlock()
+	if err != nil {
+		// truncating history can take the base with it, in which case this
+		// gets announced on its own
+		log.Printf("couldn't compare %d against %s, not coalescing: %s\n", mapId, last.Base, err)
+		err = nil
+		return
+	}
+
+	update.Diff = &diff
+	update.Since = last.Base
+	update.Coalesced = last.Count + 1
+	return s.bot.AnnouncementMessage(update)
+}
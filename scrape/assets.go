@@ -0,0 +1,120 @@
+package scrape
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"subscribe-bot/repo"
+)
+
+// Keep a copy of everything in the mapset besides its difficulties, so old
+// revisions can be rebuilt into something the editor can open. This downloads
+// the whole mapset, so it only happens when there's a new revision or nothing
+// has been archived yet. Failures are logged but don't affect the revision.
+func (s *Scraper) archiveAssets(r *repo.Repo, mapId int, committed bool) {
+	if !committed {
+		has, err := r.HasAssets()
+		if err != nil {
+			log.Printf("couldn't check assets of %d: %s\n", mapId, err)
+			return
+		} else if has {
+			return
+		}
+	}
+
+	err := s.downloadAssets(r, mapId)
+	if err != nil {
+		log.Printf("couldn't archive assets of %d: %s\n", mapId, err)
+	}
+}
+
+func (s *Scraper) downloadAssets(r *repo.Repo, mapId int) (err error) {
+	oszPath, err := s.api.BeatmapsetDownload(mapId)
+	if err != nil {
+		err = fmt.Errorf("couldn't download mapset: %w", err)
+		return
+	}
+	defer os.Remove(oszPath)
+
+	staging, err := ioutil.TempDir("", "subscribe-bot-assets")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(staging)
+
+	err = extractAssets(oszPath, staging)
+	if err != nil {
+		return
+	}
+
+	changed, err := r.StoreAssets(staging, time.Now())
+	if err != nil {
+		return
+	}
+	if changed {
+		log.Printf("archived new assets for %d\n", mapId)
+	}
+	return
+}
+
+// Unpack everything but the .osu files from an .osz into dir
+func extractAssets(oszPath string, dir string) (err error) {
+	ar, err := zip.OpenReader(oszPath)
+	if err != nil {
+		err = fmt.Errorf("couldn't open %s: %w", oszPath, err)
+		return
+	}
+	defer ar.Close()
+
+	for _, f := range ar.File {
+		// mapsets packed on windows sometimes use backslashes
+		name := path.Clean(strings.ReplaceAll(f.Name, "\\", "/"))
+		if f.FileInfo().IsDir() || strings.HasSuffix(strings.ToLower(name), ".osu") {
+			continue
+		}
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			log.Printf("skipping asset with bad name %q\n", f.Name)
+			continue
+		}
+
+		dest := filepath.Join(dir, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(dest), 0755)
+		if err != nil {
+			return
+		}
+
+		err = extractFile(f, dest)
+		if err != nil {
+			err = fmt.Errorf("couldn't extract %s: %w", f.Name, err)
+			return
+		}
+	}
+	return
+}
+
+func extractFile(f *zip.File, dest string) (err error) {
+	src, err := f.Open()
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	file, err := os.Create(dest)
+	if err != nil {
+		return
+	}
+
+	_, err = io.Copy(file, src)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return
+}
@@ -0,0 +1,338 @@
+package scrape
+
+// A dry run goes through the same searches and nomination events as a
+// scrape and works out what would be committed and who'd be told about it,
+// but only ever reads from the database and repositories and never touches
+// discord. Together with recorded API responses, it shows what a change to the
+// matching or notification logic does without posting anywhere.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"subscribe-bot/db"
+	"subscribe-bot/osuapi"
+	"subscribe-bot/repo"
+)
+
+type DryRunOptions struct {
+	// Only look at updates and events in this range. Leaving out From carries
+	// on from the saved cursors, and leaving out To goes up to now.
+	From time.Time
+	To   time.Time
+}
+
+// Something a scrape would do about a single mapset
+type Planned struct {
+	// "update", "touch", "unchanged" or "nomination"
+	Kind string `json:"kind"`
+	// The search or "nominations"
+	Source   string `json:"source"`
+	MapsetID int    `json:"mapset_id"`
+	Mapset   string `json:"mapset"`
+	// When it was updated, or when the nomination event happened
+	When string `json:"when"`
+
+	Commit       bool     `json:"commit"`
+	NewlyTracked bool     `json:"newly_tracked,omitempty"`
+	Changed      []string `json:"changed_difficulties,omitempty"`
+	StatusFrom   string   `json:"status_from,omitempty"`
+	StatusTo     string   `json:"status_to,omitempty"`
+	Event        string   `json:"event,omitempty"`
+
+	Notify []Notice `json:"notify"`
+}
+
+// Channels that would get the same announcement
+type Notice struct {
+	Channels []string `json:"channels"`
+	// Guest difficulties picked out, for channels following their mappers
+	GuestDifficulties []int `json:"guest_difficulties,omitempty"`
+}
+
+type DryRunReport struct {
+	Planned []Planned `json:"planned"`
+	Errors  []string  `json:"errors,omitempty"`
+}
+
+// Work out what a scrape would do without doing any of it
+func (s *Scraper) DryRun(opts DryRunOptions) (report DryRunReport) {
+	report.Planned = make([]Planned, 0)
+	tracked := s.trackedNow()
+	for _, search := range statusSearches {
+		since, until := opts.From, opts.To
+		if until.IsZero() {
+			until = time.Now().Add(-search.lag)
+		}
+		if since.IsZero() {
+			var ok bool
+			since, ok = s.db.ScraperCursor(search.status)
+			if !ok {
+				// a scrape would only save a cursor
+				continue
+			}
+		}
+
+		progress := newSearchProgress(until)
+		complete, err := s.searchSince(search, since, progress)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		} else if !complete {
+			report.Errors = append(report.Errors, fmt.Sprintf(
+				"%s search stopped after %d pages before getting back to %s, only planning what it found",
+				search.status, MAX_SEARCH_PAGES, since.Format(time.RFC3339),
+			))
+		}
+
+		for _, beatmapSet := range progress.oldestFirst() {
+			if !tracked.has(beatmapSet) {
+				continue
+			}
+
+			planned, err := s.planUpdate(search, beatmapSet)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("couldn't plan %d: %s", beatmapSet.ID, err))
+				continue
+			}
+			report.Planned = append(report.Planned, planned)
+		}
+	}
+
+	nominations, complete, err := s.planNominations(opts)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	} else if !complete {
+		report.Errors = append(report.Errors, fmt.Sprintf(
+			"nomination events stopped after %d pages before getting back to where they left off, only planning what was found",
+			MAX_SEARCH_PAGES,
+		))
+	}
+	report.Planned = append(report.Planned, nominations...)
+	return
+}
+
+// What handleUpdate would do with a mapset
+func (s *Scraper) planUpdate(search statusSearch, beatmapSet osuapi.Beatmapset) (planned Planned, err error) {
+	planned = Planned{
+		Kind:     "update",
+		Source:   search.status,
+		MapsetID: beatmapSet.ID,
+		Mapset:   fmt.Sprintf("%s - %s (%s)", beatmapSet.Artist, beatmapSet.Title, beatmapSet.Creator),
+		When:     search.when(beatmapSet),
+		Notify:   make([]Notice, 0),
+	}
+
+	err = s.planCommit(beatmapSet, &planned)
+	if err != nil {
+		return
+	}
+
+	channels := s.subscribers(beatmapSet)
+	if !planned.Commit && planned.StatusTo == "" {
+		planned.Kind = "unchanged"
+		if search.status != "pending" {
+			return
+		}
+
+		// only the pending search posts touch notes
+		wantsNote := make([]string, 0)
+		for _, channelId := range channels {
+			if s.db.ChannelSettingEnabled(channelId, db.SETTING_TOUCH_NOTES) {
+				wantsNote = append(wantsNote, channelId)
+			}
+		}
+		if len(wantsNote) > 0 {
+			planned.Kind = "touch"
+			planned.Notify = append(planned.Notify, Notice{Channels: wantsNote})
+		}
+		return
+	}
+
+	if len(channels) > 0 {
+		planned.Notify = append(planned.Notify, Notice{Channels: channels})
+	}
+	for _, group := range s.guestGroups(beatmapSet, channels) {
+		planned.Notify = append(planned.Notify, Notice{group.channels, group.difficulties})
+	}
+	return
+}
+
+// Whether snapshotting a mapset would make a new revision, going by the
+// checksums the API reports rather than downloading anything, and whether its
+// status would change
+func (s *Scraper) planCommit(beatmapSet osuapi.Beatmapset, planned *Planned) (err error) {
+	unlock := s.repos.Lock(beatmapSet.ID)
+	defer unlock()
+
+	r, err := s.repos.Open(beatmapSet.ID)
+	if errors.Is(err, repo.ErrNotExist) {
+		// a snapshot would create it
+		err = nil
+		planned.Commit = true
+		planned.NewlyTracked = true
+		return
+	} else if err != nil {
+		return
+	}
+
+	revs, err := r.Log(1)
+	if err != nil {
+		return
+	}
+	if len(revs) == 0 || revs[0].Metadata == nil {
+		// nothing to compare against, so it'd be snapshotted to find out
+		planned.Commit = true
+	} else {
+		previous := make(map[int]string)
+		for _, difficulty := range revs[0].Metadata.Difficulties {
+			previous[difficulty.ID] = difficulty.Checksum
+		}
+
+		for _, beatmap := range beatmapSet.Beatmaps {
+			checksum, ok := previous[beatmap.ID]
+			delete(previous, beatmap.ID)
+			if !ok || checksum != beatmap.Checksum {
+				planned.Changed = append(planned.Changed, beatmap.DifficultyName)
+			}
+		}
+		for id := range previous {
+			planned.Changed = append(planned.Changed, fmt.Sprintf("%d (removed)", id))
+		}
+		planned.Commit = len(planned.Changed) > 0
+	}
+
+	planned.StatusFrom, planned.StatusTo, err = r.StatusChange(beatmapSet.Status)
+	return
+}
+
+// What scrapeNominatedMaps would announce
+func (s *Scraper) planNominations(opts DryRunOptions) (planned []Planned, complete bool, err error) {
+	lastEventId, hasLast := s.db.LastBeatmapsetEvent()
+
+	// page back until the events are older than what's being looked at
+	events := make([]osuapi.BeatmapsetEvent, 0)
+	for page := 1; page <= MAX_SEARCH_PAGES; page++ {
+		// the first page is fetched the same way the scraper does, so it can
+		// be replayed from what the scraper recorded
+		options := osuapi.GetBeatmapsetEventsOptions{Types: nominationEventTypes}
+		if page > 1 {
+			options.Page = page
+		}
+
+		var reply osuapi.BeatmapsetEvents
+		reply, err = s.api.GetBeatmapsetEvents(&options)
+		if err != nil {
+			err = fmt.Errorf("couldn't fetch page %d of nomination events: %w", page, err)
+			return
+		}
+		events = append(events, reply.Events...)
+		if len(reply.Events) == 0 {
+			complete = true
+			break
+		}
+
+		oldest := reply.Events[len(reply.Events)-1]
+		if opts.From.IsZero() {
+			// without a saved event a scrape only saves the latest one
+			complete = !hasLast || oldest.ID <= lastEventId
+		} else if when, err := time.Parse(time.RFC3339, oldest.CreatedAt); err == nil {
+			complete = !when.After(opts.From)
+		}
+		if complete {
+			break
+		}
+	}
+
+	for _, event := range events {
+		if opts.From.IsZero() && (!hasLast || event.ID <= lastEventId) {
+			continue
+		}
+
+		when, err := time.Parse(time.RFC3339, event.CreatedAt)
+		if err != nil {
+			log.Printf("error parsing time of nomination event %d: %s\n", event.ID, err)
+			continue
+		}
+		if (!opts.From.IsZero() && !when.After(opts.From)) || (!opts.To.IsZero() && when.After(opts.To)) {
+			continue
+		}
+
+		mappers := []int{event.Beatmapset.UserID}
+		if mapperId, ok := s.repos.Mapper(event.Beatmapset.ID); ok && mapperId != event.Beatmapset.UserID {
+			mappers = append(mappers, mapperId)
+		}
+		channels := s.channelsFor(event.Beatmapset.ID, mappers...)
+		if len(channels) == 0 {
+			continue
+		}
+
+		planned = append(planned, Planned{
+			Kind:     "nomination",
+			Source:   "nominations",
+			MapsetID: event.Beatmapset.ID,
+			Mapset:   fmt.Sprintf("%s - %s (%s)", event.Beatmapset.Artist, event.Beatmapset.Title, event.Beatmapset.Creator),
+			When:     event.CreatedAt,
+			Event:    event.Type,
+			Notify:   []Notice{{Channels: channels}},
+		})
+	}
+
+	// events come newest first
+	for i, j := 0, len(planned)-1; i < j; i, j = i+1, j-1 {
+		planned[i], planned[j] = planned[j], planned[i]
+	}
+	return
+}
+
+// Write a human readable version of the report
+func (report *DryRunReport) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "kind\tsource\tmapset\twhen\tdetails\tnotify")
+	for _, planned := range report.Planned {
+		details := make([]string, 0)
+		if planned.NewlyTracked {
+			details = append(details, "newly tracked")
+		} else if len(planned.Changed) > 0 {
+			details = append(details, "changed "+strings.Join(planned.Changed, ", "))
+		} else if planned.Commit {
+			details = append(details, "commit")
+		}
+		if planned.StatusTo != "" {
+			details = append(details, fmt.Sprintf("%s -> %s", planned.StatusFrom, planned.StatusTo))
+		}
+		if planned.Event != "" {
+			details = append(details, planned.Event)
+		}
+
+		notify := make([]string, 0, len(planned.Notify))
+		for _, notice := range planned.Notify {
+			channels := strings.Join(notice.Channels, ",")
+			if len(notice.GuestDifficulties) > 0 {
+				channels += fmt.Sprintf(" (guest difficulties %v)", notice.GuestDifficulties)
+			}
+			notify = append(notify, channels)
+		}
+
+		fmt.Fprintf(
+			tw, "%s\t%s\t%d %s\t%s\t%s\t%s\n",
+			planned.Kind,
+			planned.Source,
+			planned.MapsetID,
+			planned.Mapset,
+			planned.When,
+			strings.Join(details, "; "),
+			strings.Join(notify, " "),
+		)
+	}
+	tw.Flush()
+
+	for _, err := range report.Errors {
+		fmt.Fprintln(w, "error:", err)
+	}
+}
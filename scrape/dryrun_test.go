@@ -0,0 +1,166 @@
+package scrape
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"subscribe-bot/db"
+	"subscribe-bot/osuapi"
+	"subscribe-bot/repo"
+)
+
+// Commit a revision of a mapset with the difficulties the API reports for it,
+// at its current status
+func commitMapset(t *testing.T, s *Scraper, beatmapSet osuapi.Beatmapset) {
+	t.Helper()
+
+	r, err := s.repos.OpenOrInit(beatmapSet.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := t.TempDir()
+	meta := repo.Metadata{BeatmapsetID: beatmapSet.ID, LastUpdated: beatmapSet.LastUpdated}
+	for _, beatmap := range beatmapSet.Beatmaps {
+		meta.Difficulties = append(meta.Difficulties, repo.Difficulty{
+			ID:       beatmap.ID,
+			Name:     beatmap.DifficultyName,
+			Checksum: beatmap.Checksum,
+		})
+		err = ioutil.WriteFile(filepath.Join(src, beatmap.DifficultyName+".osu"), []byte(beatmap.Checksum), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = r.Snapshot(src, &repo.SnapshotOptions{
+		Subject:   "Update Artist - Title (1)",
+		Metadata:  meta,
+		Author:    object.Signature{Name: "mapper"},
+		Committer: object.Signature{Name: "subscribe-bot"},
+	})
+	if err == nil {
+		_, err = r.RecordStatus(beatmapSet.Status, time.Now())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	from, to := now.Add(-3*time.Hour), now.Add(-time.Minute)
+	at := func(minutes int) time.Time { return now.Add(-time.Duration(minutes) * time.Minute) }
+
+	// a new mapset by a followed mapper with a guest difficulty by another
+	newMapset := pendingMapset(1, 10, at(30))
+	newMapset.Beatmaps = []osuapi.Beatmap{{ID: 101, UserID: 10}, {ID: 102, UserID: 20}}
+	// a mapset only a query picks up
+	queried := pendingMapset(2, 99, at(40))
+	queried.Artist = "Camellia"
+	// nobody follows this one
+	untracked := pendingMapset(3, 99, at(50))
+	// followed on its own, one unchanged and one with a new version of a
+	// difficulty
+	unchanged := pendingMapset(4, 99, at(110))
+	unchanged.Beatmaps = []osuapi.Beatmap{{ID: 401, DifficultyName: "Easy", Checksum: "a"}}
+	changed := pendingMapset(5, 99, at(100))
+	changed.Beatmaps = []osuapi.Beatmap{{ID: 501, DifficultyName: "Hard", Checksum: "a"}}
+	// from before the range
+	tooOld := pendingMapset(6, 10, at(240))
+
+	s := newTestScraper(t)
+	trackMapper(t, s, "a", 10)
+	trackMapper(t, s, "b", 20)
+	for _, mapId := range []int{unchanged.ID, changed.ID} {
+		err := s.db.ChannelTrackMapset("d", mapId, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := s.db.SetChannelSetting("d", db.SETTING_TOUCH_NOTES, "on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := db.ParseQuery("c", "camellia")
+	if err == nil {
+		_, err = s.db.AddQuery(query)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitMapset(t, s, unchanged)
+	commitMapset(t, s, changed)
+	changed.Beatmaps[0].Checksum = "b"
+
+	nomination := eventsPage(7, 8)
+	nomination.Events[0].CreatedAt = at(20).Format(time.RFC3339)
+	nomination.Events[0].Beatmapset = newMapset
+	nomination.Events[1].CreatedAt = at(300).Format(time.RFC3339)
+	responses := map[string]interface{}{
+		searchUrl(statusSearches[0], ""): searchPage("", newMapset, queried, untracked, changed, unchanged, tooOld),
+		eventsUrl(0):                     nomination,
+	}
+	for _, search := range statusSearches[1:] {
+		responses[searchUrl(search, "")] = searchPage("")
+	}
+	replay(t, s, responses)
+
+	report := s.DryRun(DryRunOptions{From: from, To: to})
+	if len(report.Errors) != 0 {
+		t.Errorf("expected no errors, got %v", report.Errors)
+	}
+
+	want := []struct {
+		kind     string
+		mapsetId int
+		changed  []string
+		notify   []Notice
+	}{
+		{"touch", unchanged.ID, nil, []Notice{{Channels: []string{"d"}}}},
+		{"update", changed.ID, []string{"Hard"}, []Notice{{Channels: []string{"d"}}}},
+		{"update", queried.ID, nil, []Notice{{Channels: []string{"c"}}}},
+		{"update", newMapset.ID, nil, []Notice{{Channels: []string{"a"}}, {[]string{"b"}, []int{102}}}},
+		{"nomination", newMapset.ID, nil, []Notice{{Channels: []string{"a"}}}},
+	}
+	if len(report.Planned) != len(want) {
+		t.Fatalf("expected %d planned, got %+v", len(want), report.Planned)
+	}
+	for i, planned := range report.Planned {
+		w := want[i]
+		if planned.Kind != w.kind || planned.MapsetID != w.mapsetId ||
+			fmt.Sprint(planned.Changed) != fmt.Sprint(w.changed) || fmt.Sprint(planned.Notify) != fmt.Sprint(w.notify) {
+			t.Errorf("expected %d to be a %s of %d changing %v for %+v, got %+v",
+				i, w.kind, w.mapsetId, w.changed, w.notify, planned)
+		}
+	}
+	if !report.Planned[3].Commit || !report.Planned[3].NewlyTracked {
+		t.Errorf("expected the new mapset to be committed, got %+v", report.Planned[3])
+	}
+
+	var out bytes.Buffer
+	report.Print(&out)
+	if !strings.Contains(out.String(), "changed Hard") || !strings.Contains(out.String(), "b (guest difficulties [102])") {
+		t.Errorf("report is missing details:\n%s", out.String())
+	}
+
+	// and nothing was written
+	if _, ok := s.db.ScraperCursor(statusSearches[0].status); ok {
+		t.Error("a cursor was saved")
+	}
+	if _, ok := s.db.LastBeatmapsetEvent(); ok {
+		t.Error("the last nomination event was saved")
+	}
+	if _, err := s.repos.Open(newMapset.ID); err == nil {
+		t.Error("the new mapset was committed")
+	}
+	if messages, _ := s.db.OutboxMessages(false); len(messages) != 0 {
+		t.Errorf("announcements were queued: %+v", messages)
+	}
+}
@@ -1,16 +1,207 @@
 package scrape
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+
+	"subscribe-bot/discord"
 	"subscribe-bot/osuapi"
 )
 
-func (s *Scraper) scrapeNominatedMaps() {
-	events, _ := s.api.GetBeatmapsetEvents(&osuapi.GetBeatmapsetEventsOptions{
-		Types: []string{"nominate", "qualify"},
+var nominationEventTypes = []string{
+	osuapi.EVENT_NOMINATE,
+	osuapi.EVENT_QUALIFY,
+	osuapi.EVENT_DISQUALIFY,
+	osuapi.EVENT_NOMINATION_RESET,
+}
+
+// Announce nomination events on mapsets that are tracked, either on their own
+// or because their host is, now or when they were last snapshotted. Events
+// are paged back to the last one handled, then handled oldest first with the
+// last one handled saved, so each is announced once. Stops as soon as ctx is
+// done.
+func (s *Scraper) scrapeNominatedMaps(ctx context.Context) {
+	lastEventId, ok := s.db.LastBeatmapsetEvent()
+	if !ok {
+		// nothing to catch up on the first time around
+		reply, err := s.api.GetBeatmapsetEvents(&osuapi.GetBeatmapsetEventsOptions{
+			Types: nominationEventTypes,
+		})
+		if err != nil {
+			log.Println("error fetching nomination events", err)
+			s.bot.NotifyError("failed to fetch nomination events: %s", err)
+			return
+		}
+		if len(reply.Events) > 0 && ctx.Err() == nil {
+			err = s.db.SetLastBeatmapsetEvent(reply.Events[0].ID)
+			if err != nil {
+				log.Println("error saving last nomination event:", err)
+			}
+		}
+		return
+	}
+
+	progress := s.nominations
+	if progress == nil {
+		progress = newNominationProgress()
+	}
+	complete, err := s.nominationsSince(lastEventId, progress)
+	if err != nil {
+		// pick up from the page that failed next time
+		s.nominations = progress
+		log.Println("error fetching nomination events", err)
+		s.bot.NotifyError("failed to fetch nomination events: %s", err)
+		return
+	} else if !complete {
+		s.nominations = progress
+		log.Printf("nomination events didn't get back to %d within %d pages, continuing next time\n", lastEventId, MAX_SEARCH_PAGES)
+		return
+	}
+	s.nominations = nil
+
+	events := progress.events
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ID < events[j].ID
 	})
 
 	for _, event := range events {
-		(func(_ osuapi.BeatmapsetEvent) {})(event)
-		// fmt.Println(event)
+		if ctx.Err() != nil {
+			break
+		}
+
+		err = s.handleNomination(event, progress.users[event.UserID])
+		if err != nil {
+			s.eventRetries[event.ID]++
+			attempts := s.eventRetries[event.ID]
+			if attempts < MAX_ATTEMPTS {
+				log.Printf("error handling nomination event %d (attempt %d of %d): %s\n", event.ID, attempts, MAX_ATTEMPTS, err)
+				// try again from here next time
+				break
+			}
+
+			log.Printf("giving up on nomination event %d after %d attempts: %s\n", event.ID, attempts, err)
+			s.bot.NotifyError("gave up on nomination event %d after %d attempts: %s", event.ID, attempts, err)
+		}
+		delete(s.eventRetries, event.ID)
+
+		err = s.db.SetLastBeatmapsetEvent(event.ID)
+		if err != nil {
+			log.Println("error saving last nomination event:", err)
+			break
+		}
+	}
+}
+
+// How far paging back through nomination events got towards the last one
+// handled. Like a searchProgress, running out of pages carries on from the
+// next page next time, leaving the last event handled where it was.
+type nominationProgress struct {
+	// the last page fetched, 0 before the first one
+	page int
+	// events found so far, and everyone who caused them
+	events []osuapi.BeatmapsetEvent
+	seen   map[int]bool
+	users  map[int]osuapi.EventUserCompact
+}
+
+func newNominationProgress() *nominationProgress {
+	return &nominationProgress{
+		seen:  make(map[int]bool),
+		users: make(map[int]osuapi.EventUserCompact),
+	}
+}
+
+// Page through nomination events newer than lastEventId, collecting them in
+// progress. Returns false if it gave up after MAX_SEARCH_PAGES before getting
+// back to lastEventId.
+func (s *Scraper) nominationsSince(lastEventId int, progress *nominationProgress) (complete bool, err error) {
+	for pages := 0; pages < MAX_SEARCH_PAGES; pages++ {
+		// the first page is asked for without a number, the way a dry run
+		// expects to find it recorded
+		options := osuapi.GetBeatmapsetEventsOptions{Types: nominationEventTypes}
+		if progress.page > 0 {
+			options.Page = progress.page + 1
+		}
+
+		var reply osuapi.BeatmapsetEvents
+		reply, err = s.api.GetBeatmapsetEvents(&options)
+		if err != nil {
+			err = fmt.Errorf("couldn't fetch page %d of nomination events: %w", progress.page+1, err)
+			return
+		}
+		progress.page++
+
+		for _, user := range reply.Users {
+			progress.users[user.ID] = user
+		}
+		for _, event := range reply.Events {
+			if event.ID <= lastEventId {
+				complete = true
+				continue
+			}
+
+			// new events push older ones onto later pages while paging, so
+			// some show up twice
+			if progress.seen[event.ID] {
+				continue
+			}
+			progress.seen[event.ID] = true
+			progress.events = append(progress.events, event)
+		}
+
+		if complete || len(reply.Events) == 0 {
+			return true, nil
+		}
+	}
+
+	return
+}
+
+func (s *Scraper) handleNomination(event osuapi.BeatmapsetEvent, user osuapi.EventUserCompact) (err error) {
+	// the host in the index is used too, since the event might predate a
+	// host change
+	mappers := []int{event.Beatmapset.UserID}
+	if mapperId, ok := s.repos.Mapper(event.Beatmapset.ID); ok && mapperId != event.Beatmapset.UserID {
+		mappers = append(mappers, mapperId)
+	}
+
+	channels := s.channelsFor(event.Beatmapset.ID, mappers...)
+	if len(channels) == 0 {
+		return
+	}
+
+	err = s.bot.NotifyNomination(channels, discord.NominationUpdate{
+		Event:   event,
+		User:    user,
+		Comment: eventComment(event),
+	})
+	if err != nil {
+		err = fmt.Errorf("couldn't notify nomination event: %w", err)
+	}
+	return
+}
+
+// Whatever was said along with an event. Disqualifications and nomination
+// resets point at the discussion that caused them, other events may carry a
+// comment of their own.
+func eventComment(event osuapi.BeatmapsetEvent) string {
+	if event.Discussion != nil && event.Discussion.StartingPost != nil {
+		return event.Discussion.StartingPost.Message
+	}
+
+	var comment string
+	if json.Unmarshal(event.Comment, &comment) == nil {
+		return comment
+	}
+
+	var reason struct {
+		Reason string `json:"reason"`
+	}
+	if json.Unmarshal(event.Comment, &reason) == nil {
+		return reason.Reason
 	}
+	return ""
 }
@@ -0,0 +1,176 @@
+package scrape
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"subscribe-bot/osuapi"
+)
+
+// The URL scrapeNominatedMaps asks for a page of events with
+func eventsUrl(page int) string {
+	url := "/beatmapsets/events?user="
+	for _, t := range nominationEventTypes {
+		url += "&types[]=" + t
+	}
+	if page > 0 {
+		url += "&page=" + strconv.Itoa(page)
+	}
+	return url
+}
+
+// A page of nomination events with the given IDs, on untracked mapsets
+func eventsPage(ids ...int) osuapi.BeatmapsetEvents {
+	page := osuapi.BeatmapsetEvents{Events: make([]osuapi.BeatmapsetEvent, len(ids))}
+	for i, id := range ids {
+		page.Events[i] = osuapi.BeatmapsetEvent{
+			ID:         id,
+			Type:       osuapi.EVENT_NOMINATE,
+			Beatmapset: osuapi.Beatmapset{ID: id, UserID: 1},
+		}
+	}
+	return page
+}
+
+func TestScrapeNominatedMaps(t *testing.T) {
+	tests := []struct {
+		name  string
+		last  int
+		pages []osuapi.BeatmapsetEvents
+		// events to be handled, newest first
+		found []int
+		// where the last event handled should end up
+		want int
+	}{
+		{
+			"caught up on the first page",
+			10,
+			[]osuapi.BeatmapsetEvents{eventsPage(13, 12, 11, 10, 9)},
+			[]int{13, 12, 11},
+			13,
+		},
+		{"nothing new", 10, []osuapi.BeatmapsetEvents{eventsPage(10, 9)}, nil, 10},
+		{
+			"pages back to the last event",
+			10,
+			[]osuapi.BeatmapsetEvents{eventsPage(15, 14), eventsPage(13, 12), eventsPage(11, 10)},
+			[]int{15, 14, 13, 12, 11},
+			15,
+		},
+		{
+			"events pushed onto the next page",
+			10,
+			[]osuapi.BeatmapsetEvents{eventsPage(15, 14), eventsPage(14, 13), eventsPage(12, 10)},
+			[]int{15, 14, 13, 12},
+			15,
+		},
+		{
+			"runs out of events",
+			10,
+			[]osuapi.BeatmapsetEvents{eventsPage(12, 11), eventsPage()},
+			[]int{12, 11},
+			12,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestScraper(t)
+			responses := make(map[string]interface{})
+			for i, page := range test.pages {
+				if i == 0 {
+					responses[eventsUrl(0)] = page
+				} else {
+					responses[eventsUrl(i+1)] = page
+				}
+			}
+			replay(t, s, responses)
+
+			progress := newNominationProgress()
+			complete, err := s.nominationsSince(test.last, progress)
+			if err != nil || !complete {
+				t.Fatalf("expected to get back to the last event, got %v (%v)", complete, err)
+			}
+			found := make([]int, 0)
+			for _, event := range progress.events {
+				found = append(found, event.ID)
+			}
+			if fmt.Sprint(found) != fmt.Sprint(test.found) {
+				t.Errorf("expected events %v, got %v", test.found, found)
+			}
+
+			err = s.db.SetLastBeatmapsetEvent(test.last)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.scrapeNominatedMaps(context.Background())
+
+			if last, _ := s.db.LastBeatmapsetEvent(); last != test.want {
+				t.Errorf("expected the last event handled to be %d, got %d", test.want, last)
+			}
+			if s.nominations != nil {
+				t.Errorf("progress was kept after getting back to the last event: %+v", s.nominations)
+			}
+		})
+	}
+}
+
+func TestScrapeNominatedMapsPageCap(t *testing.T) {
+	s := newTestScraper(t)
+	responses := map[string]interface{}{eventsUrl(0): eventsPage(1000, 999)}
+	for page := 2; page <= MAX_SEARCH_PAGES; page++ {
+		id := 1000 - 2*(page-1)
+		responses[eventsUrl(page)] = eventsPage(id, id-1)
+	}
+	replay(t, s, responses)
+
+	err := s.db.SetLastBeatmapsetEvent(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the cursor stays put until paging gets back to it
+	s.scrapeNominatedMaps(context.Background())
+	if last, _ := s.db.LastBeatmapsetEvent(); last != 10 {
+		t.Errorf("last event handled moved to %d before paging got back to it", last)
+	}
+	if s.nominations == nil || s.nominations.page != MAX_SEARCH_PAGES {
+		t.Fatalf("expected to carry on after page %d, got %+v", MAX_SEARCH_PAGES, s.nominations)
+	}
+
+	responses[eventsUrl(MAX_SEARCH_PAGES+1)] = eventsPage(11, 10)
+	replay(t, s, responses)
+	s.scrapeNominatedMaps(context.Background())
+	if last, _ := s.db.LastBeatmapsetEvent(); last != 1000 {
+		t.Errorf("expected the last event handled to be 1000, got %d", last)
+	}
+	if s.nominations != nil {
+		t.Error("progress was kept after getting back to the last event")
+	}
+}
+
+func TestNominationsSinceFailure(t *testing.T) {
+	s := newTestScraper(t)
+	replay(t, s, map[string]interface{}{eventsUrl(0): eventsPage(15, 14)})
+
+	progress := newNominationProgress()
+	_, err := s.nominationsSince(10, progress)
+	if !errors.Is(err, osuapi.ErrNotRecorded) {
+		t.Fatalf("expected the second page to fail, got %v", err)
+	}
+	if progress.page != 1 || len(progress.events) != 2 {
+		t.Errorf("expected to pick up from the second page with 2 events, got page %d with %d", progress.page, len(progress.events))
+	}
+
+	replay(t, s, map[string]interface{}{eventsUrl(2): eventsPage(13, 10)})
+	complete, err := s.nominationsSince(10, progress)
+	if err != nil || !complete {
+		t.Fatalf("expected to get back to the last event, got %v (%v)", complete, err)
+	}
+	if len(progress.events) != 3 {
+		t.Errorf("expected 3 events, got %d", len(progress.events))
+	}
+}
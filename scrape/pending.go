@@ -1,152 +1,267 @@
 package scrape
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+
 	"subscribe-bot/db"
+	"subscribe-bot/discord"
 	"subscribe-bot/osuapi"
-	"time"
+	"subscribe-bot/repo"
+)
+
+const (
+	// times a mapset is tried before the cursor moves past it anyway
+	MAX_ATTEMPTS = 3
 )
 
-func (s *Scraper) scrapePendingMaps() {
-	// build a list of currently tracked mappers
-	trackedMappers := make(map[int]int)
-	s.db.IterAllTrackedMappers(func(userId int) error {
-		trackedMappers[userId] = 1
-		return nil
-	})
+// A mapset that couldn't be handled yet
+type retry struct {
+	attempts int
+}
 
-	// TODO: is this sorted for sure??
-	pendingSets, err := s.api.SearchBeatmaps("pending")
+// Snapshot a tracked mapset and tell everyone following it, its mapper or a
+// query it matches about any revision or status change not announced yet.
+// Channels following the mapper of a guest difficulty hear about it too, with
+// that difficulty's changes picked out. Updates that changed neither are only
+// noted if touched is set. eventId is the activity event that pointed at it,
+// if there was one. Nothing more is written once ctx is done, since that's
+// when the lease is lost.
+func (s *Scraper) handleUpdate(ctx context.Context, beatmapSet osuapi.Beatmapset, eventId int, touched bool) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	channels := s.subscribers(beatmapSet)
+
+	// what was announced has to be on record before the snapshot moves the
+	// mapset on, otherwise a crash before announcing would lose the update
+	announced, err := s.lastAnnounced(beatmapSet.ID)
 	if err != nil {
-		log.Println("error fetching pending sets", err)
-		s.bot.NotifyError("failed to fetch pending sets", err)
+		err = fmt.Errorf("couldn't find what was last announced: %w", err)
+		s.finishRetry(beatmapSet.ID, err)
 		return
 	}
 
-	allNewMaps := make(map[int][]osuapi.Beatmapset, 0)
-	var newLastUpdateTime = time.Unix(0, 0)
-	for _, beatmapSet := range pendingSets.Beatmapsets {
-		updatedTime, err := time.Parse(time.RFC3339, beatmapSet.LastUpdated)
-		if err != nil {
-			log.Println("error parsing last updated time", updatedTime)
-		}
+	snapshotErr := s.snapshot(ctx, beatmapSet, eventId)
+	if snapshotErr != nil && !errors.Is(snapshotErr, repo.ErrNoChange) {
+		err = fmt.Errorf("couldn't save new revision: %w", snapshotErr)
+		s.finishRetry(beatmapSet.ID, err)
+		return
+	}
 
-		if updatedTime.After(newLastUpdateTime) {
-			// update lastUpdateTime to latest updated map
-			newLastUpdateTime = updatedTime
+	update, latest, found, err := s.unannounced(beatmapSet, announced)
+	if err != nil {
+		err = fmt.Errorf("couldn't find unannounced changes: %w", err)
+		s.finishRetry(beatmapSet.ID, err)
+		return
+	} else if !found {
+		if touched {
+			err = s.notifyTouched(ctx, channels, beatmapSet)
+		}
+		if err != nil {
+			err = fmt.Errorf("couldn't notify touched map: %w", err)
 		}
+		s.finishRetry(beatmapSet.ID, err)
+		return
+	}
 
-		if !updatedTime.After(lastUpdateTime) {
+	groups := append([]guestGroup{{channels: channels}}, s.guestGroups(beatmapSet, channels)...)
+	deliveries := make([]db.Delivery, 0)
+	for _, group := range groups {
+		groupUpdate := update
+		groupUpdate.GuestDifficulties = group.difficulties
+		var groupDeliveries []db.Delivery
+		groupDeliveries, err = s.deliveries(group.channels, groupUpdate)
+		if err != nil {
 			break
 		}
+		deliveries = append(deliveries, groupDeliveries...)
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		// every channel is queued along with the record of what was
+		// announced, or none of them are
+		err = s.db.Announce(beatmapSet.ID, deliveries, latest)
+	}
+	if err != nil {
+		err = fmt.Errorf("couldn't notify update: %w", err)
+	} else {
+		s.bot.Outbox.Wake()
+	}
+	s.finishRetry(beatmapSet.ID, err)
+	return
+}
 
-		mapperId := beatmapSet.UserID
-		if _, ok := trackedMappers[mapperId]; ok {
-			if _, ok2 := allNewMaps[mapperId]; !ok2 {
-				allNewMaps[mapperId] = make([]osuapi.Beatmapset, 0)
-			}
+// The latest revision and status announced for a mapset. Mapsets without a
+// record yet start from whatever their repository has now, so only what comes
+// after is announced.
+func (s *Scraper) lastAnnounced(mapId int) (announced db.Announced, err error) {
+	announced, ok := s.db.Announced(mapId)
+	if ok {
+		return
+	}
 
-			allNewMaps[mapperId] = append(allNewMaps[mapperId], beatmapSet)
-		}
+	unlock := s.repos.Lock(mapId)
+	r, err := s.repos.Open(mapId)
+	if errors.Is(err, repo.ErrNotExist) {
+		err = nil
+	} else if err == nil {
+		announced, _, _, err = latestState(r)
+	}
+	unlock()
+	if err != nil {
+		return
 	}
 
-	if len(allNewMaps) > 0 {
-		for mapperId, newMaps := range allNewMaps {
-			channels := make([]string, 0)
-			s.db.IterTrackingChannels(mapperId, func(channelId string) error {
-				channels = append(channels, channelId)
-				return nil
-			})
+	err = s.db.SetAnnounced(mapId, announced)
+	return
+}
 
-			err := s.bot.NotifyNewBeatmap(channels, newMaps)
-			if err != nil {
-				log.Println("error notifying new maps:", err)
-			}
+// The latest revision and status tag of a repository, either of which may be
+// missing
+func latestState(r *repo.Repo) (state db.Announced, head *repo.Revision, tag *repo.Tag, err error) {
+	revs, err := r.Log(1)
+	if err != nil {
+		return
+	}
+	if len(revs) > 0 {
+		head = &revs[0]
+		state.Hash = head.Hash
+		if head.Metadata != nil {
+			state.LastUpdated = head.Metadata.LastUpdated
 		}
 	}
 
-	lastUpdateTime = newLastUpdateTime
-	// this rings the terminal bell when it's updated so i don't have to stare
-	// at a blank screen for 30 seconds waiting for the feed to update
-	if s.config.Debug {
-		fmt.Print("\a")
+	tags, err := r.Tags()
+	if err != nil {
+		return
+	}
+	if len(tags) > 0 {
+		t := tags[len(tags)-1]
+		if len(tags) > 1 {
+			t.Previous = tags[len(tags)-2].Status
+		}
+		tag = &t
+		state.Tag = t.Name
 	}
-	log.Println("last updated time", lastUpdateTime)
+	return
 }
 
-func getNewMaps(db *db.Db, api *osuapi.Osuapi, userId int) (newMaps []osuapi.Event, err error) {
-	// see if there's a last event
-	hasLastEvent, lastEventId := db.MapperLastEvent(userId)
-	newMaps = make([]osuapi.Event, 0)
-	var (
-		events            []osuapi.Event
-		newLatestEvent    = 0
-		updateLatestEvent = false
-	)
-	if hasLastEvent {
-		offset := 0
-
-	loop:
-		for {
-			events, err = api.GetUserEvents(userId, 50, offset)
-			if err != nil {
-				err = fmt.Errorf("couldn't load events for user %d, offset %d: %w", userId, offset, err)
-				return
-			}
-			if len(events) == 0 {
-				break
-			}
+// Work out what a mapset's repository has that wasn't announced yet. latest
+// is what to record once it has been.
+func (s *Scraper) unannounced(beatmapSet osuapi.Beatmapset, announced db.Announced) (update discord.BeatmapUpdate, latest db.Announced, found bool, err error) {
+	update.Beatmapset = beatmapSet
 
-			for _, event := range events {
-				if event.ID == lastEventId {
-					break loop
-				}
-
-				if event.ID > newLatestEvent {
-					updateLatestEvent = true
-					newLatestEvent = event.ID
-				}
-
-				if event.Type == "beatmapsetUpload" ||
-					event.Type == "beatmapsetRevive" ||
-					event.Type == "beatmapsetUpdate" {
-					newMaps = append(newMaps, event)
-				}
-			}
+	unlock := s.repos.Lock(beatmapSet.ID)
+	defer unlock()
+
+	r, err := s.repos.Open(beatmapSet.ID)
+	if err != nil {
+		return
+	}
+
+	latest, head, tag, err := latestState(r)
+	if err != nil {
+		return
+	}
+
+	// truncating history gives revisions new hashes, but they keep their
+	// metadata
+	sameRevision := latest.Hash == announced.Hash ||
+		(latest.LastUpdated != "" && latest.LastUpdated == announced.LastUpdated)
+	if head != nil && !sameRevision {
+		update.Revision = *head
+		found = true
 
-			offset += len(events)
+		var diff repo.Diff
+		var diffErr error = repo.ErrNoParent
+		if announced.Hash != "" && announced.Hash != head.Parent {
+			// more than one revision went unannounced
+			diff, diffErr = r.Compare(announced.Hash, head.Hash)
+			if diffErr == nil {
+				update.Since = announced.Hash
+			}
 		}
-	} else {
-		log.Printf("no last event id found for %d\n", userId)
-		events, err = api.GetUserEvents(userId, 50, 0)
-		if err != nil {
+		if diffErr != nil {
+			diff, err = r.Diff(head.Hash)
+		}
+		if errors.Is(err, repo.ErrNoParent) {
+			err = nil
+		} else if err != nil {
 			return
+		} else {
+			update.Diff = &diff
 		}
+	}
 
-		for _, event := range events {
-			if event.ID > newLatestEvent {
-				updateLatestEvent = true
-				newLatestEvent = event.ID
-			}
+	if tag != nil && tag.Name != announced.Tag && tag.Previous != "" {
+		update.StatusTag = tag
+		found = true
+	}
+	return
+}
 
-			if event.Type == "beatmapsetUpload" ||
-				event.Type == "beatmapsetRevive" ||
-				event.Type == "beatmapsetUpdate" {
-				newMaps = append(newMaps, event)
-			}
-		}
+// Count another attempt at a mapset, or forget about it once it worked
+func (s *Scraper) finishRetry(mapId int, err error) {
+	s.retryMutex.Lock()
+	defer s.retryMutex.Unlock()
+
+	if err == nil {
+		delete(s.retries, mapId)
+		return
 	}
 
-	// TODO: debug
-	// updateLatestEvent = false
+	r, ok := s.retries[mapId]
+	if !ok {
+		r = &retry{}
+		s.retries[mapId] = r
+	}
+	r.attempts++
+}
 
-	if updateLatestEvent {
-		err = db.UpdateMapperLatestEvent(userId, newLatestEvent)
-		if err != nil {
-			return
+// Whether a mapset has failed enough times that the cursor should move past
+// it
+func (s *Scraper) giveUp(beatmapSet osuapi.Beatmapset, err error) bool {
+	s.retryMutex.Lock()
+	defer s.retryMutex.Unlock()
+
+	attempts := 0
+	if r, ok := s.retries[beatmapSet.ID]; ok {
+		attempts = r.attempts
+	}
+
+	if attempts < MAX_ATTEMPTS {
+		log.Printf("error handling %d (attempt %d of %d): %s\n", beatmapSet.ID, attempts, MAX_ATTEMPTS, err)
+		return false
+	}
+
+	log.Printf("giving up on %d after %d attempts: %s\n", beatmapSet.ID, attempts, err)
+	s.bot.NotifyError("gave up on %d after %d attempts: %s", beatmapSet.ID, attempts, err)
+	delete(s.retries, beatmapSet.ID)
+	return true
+}
+
+// Post a note about an update without content changes to the channels that
+// asked for them
+func (s *Scraper) notifyTouched(ctx context.Context, channels []string, beatmapSet osuapi.Beatmapset) (err error) {
+	wantsNote := make([]string, 0)
+	for _, channelId := range channels {
+		if s.db.ChannelSettingEnabled(channelId, db.SETTING_TOUCH_NOTES) {
+			wantsNote = append(wantsNote, channelId)
 		}
 	}
 
-	return
+	log.Printf("no content change for %d, notifying %d channels\n", beatmapSet.ID, len(wantsNote))
+	if len(wantsNote) == 0 {
+		return
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	return s.bot.NotifyTouched(wantsNote, beatmapSet)
 }
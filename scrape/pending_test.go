@@ -0,0 +1,35 @@
+package scrape
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"subscribe-bot/osuapi"
+	"subscribe-bot/repo"
+)
+
+func TestHandleUpdateAfterLosingLease(t *testing.T) {
+	s := newTestScraper(t)
+	trackMapper(t, s, "channel", TRACKED_MAPPER)
+	beatmapSet := pendingMapset(1, TRACKED_MAPPER, time.Now())
+	beatmapSet.Beatmaps = []osuapi.Beatmap{{ID: 101, UserID: TRACKED_MAPPER}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := s.handleUpdate(ctx, beatmapSet, 0, true)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the update to be dropped, got %v", err)
+	}
+
+	if _, ok := s.db.Announced(beatmapSet.ID); ok {
+		t.Error("announced record was written after the lease was lost")
+	}
+	if _, err := s.repos.Open(beatmapSet.ID); !errors.Is(err, repo.ErrNotExist) {
+		t.Errorf("repository was written after the lease was lost: %v", err)
+	}
+	if len(s.retries) != 0 {
+		t.Errorf("losing the lease counted as a failed attempt: %v", s.retries)
+	}
+}
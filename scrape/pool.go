@@ -0,0 +1,84 @@
+package scrape
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_WORKERS = 4
+	// workers wait before starting anything new while fewer API requests than
+	// this are left in the budget
+	LOW_BUDGET = 100
+)
+
+func (s *Scraper) workers() int {
+	if s.config.Scraper.Workers > 0 {
+		return s.config.Scraper.Workers
+	}
+	return DEFAULT_WORKERS
+}
+
+// Call fn for every item with up to the configured number of workers at once.
+// Items with the same key run one after another in the order given, so work
+// on one mapset never overlaps. Returns each item's error in the order given,
+// with ctx's error for items that never ran because it was done.
+func (s *Scraper) runPool(ctx context.Context, keys []int, fn func(i int) error) (errs []error) {
+	errs = make([]error, len(keys))
+
+	groups := make([][]int, 0)
+	groupOf := make(map[int]int)
+	for i, key := range keys {
+		g, ok := groupOf[key]
+		if !ok {
+			g = len(groups)
+			groupOf[key] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+
+	queue := make(chan []int)
+	var wg sync.WaitGroup
+	for w := 0; w < s.workers() && w < len(groups); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range queue {
+				for _, i := range group {
+					errs[i] = s.waitForBudget(ctx)
+					if errs[i] == nil {
+						errs[i] = fn(i)
+					}
+				}
+			}
+		}()
+	}
+
+	for _, group := range groups {
+		queue <- group
+	}
+	close(queue)
+	wg.Wait()
+	return
+}
+
+// Block until there's enough left of the API budget to start on something new
+func (s *Scraper) waitForBudget(ctx context.Context) error {
+	logged := false
+	for s.api.BudgetRemaining() < LOW_BUDGET {
+		if !logged {
+			log.Printf("API budget is low (%d left), waiting\n", s.api.BudgetRemaining())
+			logged = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,162 @@
+package scrape
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"subscribe-bot/osuapi"
+)
+
+func TestRunPool(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		keys    []int
+		// most items that should be seen running at once
+		concurrent int
+	}{
+		{"no items", 2, nil, 0},
+		{"one worker", 1, []int{1, 2, 3, 4}, 1},
+		{"distinct keys", 3, []int{1, 2, 3, 4, 5, 6}, 3},
+		{"default workers", 0, []int{1, 2, 3, 4, 5, 6}, DEFAULT_WORKERS},
+		{"same key", 3, []int{1, 1, 1, 1}, 1},
+		{"mixed keys", 4, []int{1, 2, 1, 2, 1, 3}, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestScraper(t)
+			s.config.Scraper.Workers = test.workers
+			replay(t, s, nil)
+
+			var lock sync.Mutex
+			running, most := 0, 0
+			runningKeys := make(map[int]bool)
+			var order []int
+			errs := s.runPool(context.Background(), test.keys, func(i int) error {
+				lock.Lock()
+				if runningKeys[test.keys[i]] {
+					t.Errorf("item %d started while another with key %d was running", i, test.keys[i])
+				}
+				runningKeys[test.keys[i]] = true
+				running++
+				if running > most {
+					most = running
+				}
+				order = append(order, i)
+				lock.Unlock()
+
+				time.Sleep(20 * time.Millisecond)
+
+				lock.Lock()
+				running--
+				runningKeys[test.keys[i]] = false
+				lock.Unlock()
+				return fmt.Errorf("item %d", i)
+			})
+
+			if most != test.concurrent {
+				t.Errorf("expected %d at once, got %d", test.concurrent, most)
+			}
+			if len(errs) != len(test.keys) {
+				t.Fatalf("expected %d errors, got %v", len(test.keys), errs)
+			}
+			for i, err := range errs {
+				if err == nil || err.Error() != fmt.Sprintf("item %d", i) {
+					t.Errorf("expected item %d's own error, got %v", i, err)
+				}
+			}
+
+			// items with the same key start in the order given
+			last := make(map[int]int)
+			for _, i := range order {
+				if prev, ok := last[test.keys[i]]; ok && prev > i {
+					t.Errorf("item %d ran after item %d with the same key", prev, i)
+				}
+				last[test.keys[i]] = i
+			}
+		})
+	}
+}
+
+func TestRunPoolCanceled(t *testing.T) {
+	s := newTestScraper(t)
+	replay(t, s, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	keys := []int{1, 1, 1, 2}
+	errs := s.runPool(ctx, keys, func(i int) error {
+		// the lease is lost partway through the first key
+		cancel()
+		return nil
+	})
+
+	ran := 0
+	for i, err := range errs {
+		if err == nil {
+			ran++
+		} else if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected item %d to be canceled, got %v", i, err)
+		}
+	}
+	if ran == 0 || ran > 2 {
+		t.Errorf("expected only items started before the cancel to run, %d did", ran)
+	}
+}
+
+func TestWaitForBudget(t *testing.T) {
+	s := newTestScraper(t)
+	s.api = osuapi.New(s.config)
+
+	if s.api.BudgetRemaining() < LOW_BUDGET {
+		t.Fatalf("a new client starts with only %d left", s.api.BudgetRemaining())
+	}
+	err := s.waitForBudget(context.Background())
+	if err != nil {
+		t.Errorf("expected a full budget not to wait, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = s.waitForBudget(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected nothing to start once ctx is done, got %v", err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	tests := []struct {
+		name  string
+		ids   []int
+		next  int
+		count int
+		want  []int
+		// next afterwards
+		after int
+	}{
+		{"from the start", []int{3, 1, 2}, 0, 2, []int{1, 2}, 3},
+		{"wraps around", []int{1, 2, 3}, 3, 2, []int{3, 1}, 2},
+		{"next was removed", []int{10, 30, 40}, 20, 2, []int{30, 40}, 41},
+		{"past the end", []int{10, 20}, 50, 1, []int{10}, 11},
+		{"more than there are", []int{1, 2}, 2, 5, []int{2, 1}, 2},
+		{"none wanted", []int{1, 2}, 2, 0, nil, 2},
+		{"nothing to take", nil, 7, 3, nil, 7},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := test.next
+			taken := rotate(test.ids, &next, test.count)
+			if fmt.Sprint(taken) != fmt.Sprint(test.want) {
+				t.Errorf("expected %v, got %v", test.want, taken)
+			}
+			if next != test.after {
+				t.Errorf("expected next to be %d, got %d", test.after, next)
+			}
+		})
+	}
+}
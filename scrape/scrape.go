@@ -1,36 +1,172 @@
 package scrape
 
 import (
+	"context"
+	"math/rand"
+	"sync"
 	"time"
 
 	"subscribe-bot/config"
 	"subscribe-bot/db"
 	"subscribe-bot/discord"
 	"subscribe-bot/osuapi"
+	"subscribe-bot/repo"
 )
 
-var (
-	refreshInterval = 30 * time.Second
-	lastUpdateTime  time.Time
-	Ticker          = time.NewTicker(refreshInterval)
-)
+const DEFAULT_INTERVAL = 30 * time.Second
 
 type Scraper struct {
 	config *config.Config
 	bot    *discord.Bot
 	db     *db.Db
 	api    *osuapi.Osuapi
+	repos  repo.Backend
+
+	version string
+
+	search   bool
+	activity bool
+
+	// mapsets that failed to be handled, kept until they succeed or are
+	// given up on
+	retries map[int]*retry
+	// updates that were handled but that a search's cursor hasn't moved past,
+	// because something before them failed
+	handled    map[handledKey]bool
+	retryMutex sync.Mutex
+	// searches that haven't got back to their cursor yet, by status
+	searches map[string]*searchProgress
+	// nomination events paged through without getting back to the last one
+	// handled yet
+	nominations *nominationProgress
+	// attempts at nomination events that couldn't be announced
+	eventRetries map[int]int
+	// the activity feed poller continues from the first mapper at or after
+	// this user ID, and the first mapset at or after this mapset ID
+	activityNext       int
+	activityNextMapset int
+
+	// holds a request to scrape as soon as possible
+	trigger chan struct{}
+	cancel  context.CancelFunc
+	done    chan struct{}
+	mutex   sync.Mutex
+}
+
+func New(config *config.Config, bot *discord.Bot, db *db.Db, api *osuapi.Osuapi, repos repo.Backend, version string) (scraper *Scraper, err error) {
+	search, activity, err := strategies(config.Scraper.Strategy)
+	if err != nil {
+		return
+	}
+
+	scraper = &Scraper{
+		config:   config,
+		bot:      bot,
+		db:       db,
+		api:      api,
+		repos:    repos,
+		version:  version,
+		search:   search,
+		activity: activity,
+		retries:  make(map[int]*retry),
+		handled:  make(map[handledKey]bool),
+		searches: make(map[string]*searchProgress),
+
+		eventRetries: make(map[int]int),
+		trigger:      make(chan struct{}, 1),
+	}
+	return
 }
 
-func RunScraper(config *config.Config, bot *discord.Bot, db *db.Db, api *osuapi.Osuapi) {
-	lastUpdateTime = time.Now()
+// Scrape right away, then every interval until ctx is done or Stop is called.
+// Ticks run one at a time, so a slow one delays the next rather than running
+// alongside it. Does nothing if the scraper is already running.
+func (s *Scraper) Start(ctx context.Context) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.done != nil {
+		return
+	}
 
-	scraper := Scraper{config, bot, db, api}
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+	go s.run(ctx, s.done)
+}
+
+// Stop scraping, waiting for the tick in progress to finish
+func (s *Scraper) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.done == nil {
+		return
+	}
 
-	go func() {
-		for ; true; <-Ticker.C {
-			scraper.scrapePendingMaps()
-			scraper.scrapeNominatedMaps()
+	s.cancel()
+	<-s.done
+	s.cancel, s.done = nil, nil
+}
+
+// Ask for a scrape as soon as the current one finishes, or right away if
+// nothing's running. Returns false if one was already asked for.
+func (s *Scraper) ScrapeNow() bool {
+	select {
+	case s.trigger <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Scraper) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-s.trigger:
+			// the timer starts over after this tick
+			if !timer.Stop() {
+				<-timer.C
+			}
 		}
-	}()
+
+		s.tick(ctx)
+		timer.Reset(s.nextWait())
+	}
+}
+
+func (s *Scraper) tick(ctx context.Context) {
+	if s.search {
+		s.scrapeStatuses(ctx)
+	}
+	if s.activity {
+		s.scrapeActivity(ctx)
+	}
+	s.scrapeNominatedMaps(ctx)
+}
+
+// The configured interval, defaulting to 30 seconds
+func (s *Scraper) interval() time.Duration {
+	if s.config.Scraper.Interval.Duration > 0 {
+		return s.config.Scraper.Interval.Duration
+	}
+	return DEFAULT_INTERVAL
+}
+
+// How long to wait until the next tick, the interval give or take up to the
+// configured jitter so several instances don't hit the API in lockstep
+func (s *Scraper) nextWait() time.Duration {
+	wait := s.interval()
+	jitter := s.config.Scraper.Jitter.Duration
+	if jitter > 0 {
+		wait += time.Duration(rand.Int63n(int64(2*jitter))) - jitter
+	}
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
 }
@@ -0,0 +1,92 @@
+package scrape
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+
+	"subscribe-bot/config"
+	"subscribe-bot/db"
+	"subscribe-bot/osuapi"
+	"subscribe-bot/repo"
+)
+
+// A scraper with a fresh database and repositories, and no API until replay
+// is called
+func newTestScraper(t *testing.T) *Scraper {
+	t.Helper()
+
+	database, err := db.OpenDb(filepath.Join(t.TempDir(), "db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(database.Close)
+
+	repos, err := repo.NewDirBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Scraper{
+		config:       &config.Config{},
+		db:           database,
+		repos:        repos,
+		retries:      make(map[int]*retry),
+		handled:      make(map[handledKey]bool),
+		searches:     make(map[string]*searchProgress),
+		eventRetries: make(map[int]int),
+	}
+}
+
+// Answer the scraper's API requests with the given responses, by URL. Anything
+// else fails with osuapi.ErrNotRecorded.
+func replay(t *testing.T, s *Scraper, responses map[string]interface{}) {
+	t.Helper()
+
+	dir := t.TempDir()
+	for url, response := range responses {
+		data, err := json.Marshal(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// named the way osuapi records them
+		name := fmt.Sprintf("%x.json", sha1.Sum([]byte("GET "+url)))
+		err = ioutil.WriteFile(filepath.Join(dir, name), data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.api = osuapi.New(s.config)
+	s.api.ReplayFrom(dir)
+}
+
+// Have a channel follow a mapper without asking the API for their events
+func trackMapper(t *testing.T, s *Scraper, channelId string, mapperId int) {
+	t.Helper()
+
+	err := s.db.DB.Update(func(tx *bolt.Tx) error {
+		mappers, err := tx.CreateBucketIfNotExists(db.MAPPERS)
+		if err != nil {
+			return err
+		}
+		mapper, err := mappers.CreateBucketIfNotExists([]byte(strconv.Itoa(mapperId)))
+		if err != nil {
+			return err
+		}
+		trackers, err := mapper.CreateBucketIfNotExists([]byte("trackers"))
+		if err != nil {
+			return err
+		}
+		return trackers.Put([]byte(channelId), []byte("0"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,179 @@
+package scrape
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"subscribe-bot/osuapi"
+	"subscribe-bot/repo"
+)
+
+// Download the latest version of a mapset and commit it to its repository.
+// Every difficulty is downloaded into a staging directory and checked before
+// anything is committed, so a failed download never leaves a partial
+// revision behind. Returns repo.ErrNoChange if the downloaded files are
+// identical to the last revision. Status changes are tagged in that case too.
+// eventId is the event that triggered the update, if there was one. Nothing is
+// written once ctx is done.
+func (s *Scraper) snapshot(ctx context.Context, beatmapSet osuapi.Beatmapset, eventId int) (err error) {
+	eventTime, err := time.Parse(time.RFC3339, beatmapSet.LastUpdated)
+	if err != nil {
+		return
+	}
+
+	staging, err := ioutil.TempDir("", "subscribe-bot-snapshot")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(staging)
+
+	difficulties, err := s.stageBeatmapset(&beatmapSet, staging)
+	if err != nil {
+		err = fmt.Errorf("couldn't stage %d, not committing: %w", beatmapSet.ID, err)
+		return
+	}
+
+	unlock := s.repos.Lock(beatmapSet.ID)
+	defer unlock()
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	r, err := s.repos.OpenOrInit(beatmapSet.ID)
+	if err != nil {
+		return
+	}
+
+	previousHost, err := s.repos.SetMapper(beatmapSet.ID, beatmapSet.UserID)
+	if err != nil {
+		err = fmt.Errorf("couldn't update mapper index for %d: %w", beatmapSet.ID, err)
+		return
+	}
+	if previousHost != 0 && previousHost != beatmapSet.UserID {
+		log.Printf("%d changed hosts from %d to %d\n", beatmapSet.ID, previousHost, beatmapSet.UserID)
+	}
+
+	meta := repo.Metadata{
+		BeatmapsetID: beatmapSet.ID,
+		Status:       beatmapSet.Status,
+		LastUpdated:  beatmapSet.LastUpdated,
+		EventID:      eventId,
+		BotVersion:   s.version,
+		Difficulties: difficulties,
+	}
+
+	_, err = r.Snapshot(staging, &repo.SnapshotOptions{
+		Subject:  fmt.Sprintf("Update %s - %s (%d)", beatmapSet.Artist, beatmapSet.Title, beatmapSet.ID),
+		Metadata: meta,
+		Author: object.Signature{
+			Name:  beatmapSet.Creator,
+			Email: fmt.Sprintf("%d@users.osu.ppy.sh", beatmapSet.UserID),
+			When:  eventTime,
+		},
+		Committer: object.Signature{
+			Name: "subscribe-bot",
+			When: time.Now(),
+		},
+	})
+	if err != nil && !errors.Is(err, repo.ErrNoChange) {
+		err = fmt.Errorf("couldn't create commit for %d: %w", beatmapSet.ID, err)
+		return
+	}
+
+	// the status can change without the content changing, so this happens
+	// either way. Only qualifying, ranking and loving have their own time, any
+	// other change is dated when it's noticed so it sorts after the last
+	// update.
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		err = ctxErr
+		return
+	}
+	statusTime := time.Now()
+	if rankedTime, err := time.Parse(time.RFC3339, beatmapSet.RankedDate); err == nil {
+		statusTime = rankedTime
+	}
+	_, tagErr := r.RecordStatus(beatmapSet.Status, statusTime)
+	if tagErr != nil {
+		log.Printf("couldn't record status of %d: %s\n", beatmapSet.ID, tagErr)
+	}
+
+	if s.config.ArchiveAssets {
+		s.archiveAssets(r, beatmapSet.ID, err == nil)
+	}
+	return
+}
+
+var (
+	ErrNoDifficulties   = errors.New("mapset has no difficulties")
+	ErrChecksumMismatch = errors.New("downloaded file doesn't match its checksum")
+)
+
+// Download every difficulty of a mapset into dir, making sure each one is
+// there and matches the checksum the API reported for it
+func (s *Scraper) stageBeatmapset(beatmapSet *osuapi.Beatmapset, dir string) (difficulties []repo.Difficulty, err error) {
+	if len(beatmapSet.Beatmaps) == 0 {
+		err = ErrNoDifficulties
+		return
+	}
+
+	for _, beatmap := range beatmapSet.Beatmaps {
+		filePath := path.Join(dir, fmt.Sprintf("%d.osu", beatmap.ID))
+		err = s.api.DownloadSingleBeatmap(beatmap.ID, filePath)
+		if err != nil {
+			err = fmt.Errorf("couldn't download difficulty %d: %w", beatmap.ID, err)
+			return
+		}
+
+		var checksum string
+		checksum, err = fileChecksum(filePath)
+		if err != nil {
+			return
+		}
+		// the map can be updated again between fetching its info and
+		// downloading it, which also ends up here. the next update will pick
+		// it up.
+		if beatmap.Checksum != "" && checksum != beatmap.Checksum {
+			err = fmt.Errorf("%w: difficulty %d is %s, expected %s", ErrChecksumMismatch, beatmap.ID, checksum, beatmap.Checksum)
+			return
+		}
+
+		difficulty := repo.Difficulty{
+			ID:       beatmap.ID,
+			Name:     beatmap.DifficultyName,
+			Checksum: checksum,
+		}
+		if beatmap.UserID != 0 && beatmap.UserID != beatmapSet.UserID {
+			difficulty.Mapper = beatmap.UserID
+		}
+		difficulties = append(difficulties, difficulty)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	if len(files) != len(beatmapSet.Beatmaps) {
+		err = fmt.Errorf("expected %d difficulties, staged %d files", len(beatmapSet.Beatmaps), len(files))
+	}
+	return
+}
+
+// md5 of a downloaded file, matching the checksums that the API reports
+func fileChecksum(path string) (checksum string, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	checksum = fmt.Sprintf("%x", md5.Sum(data))
+	return
+}
@@ -0,0 +1,248 @@
+package scrape
+
+// Every status a tracked mapset can be in is followed with its own search,
+// each with a cursor saved in the database. Pending mapsets are ordered by
+// when they were last updated, while qualified, ranked and loved ones are
+// ordered by when they got there. Mapsets are graveyarded a fixed time after
+// their last update, so the graveyard is followed by last update too, just
+// that far behind.
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"subscribe-bot/osuapi"
+)
+
+const (
+	DEFAULT_MAX_LOOKBACK = 24 * time.Hour
+	// search pages hold 50 mapsets each, far more than a day of updates
+	MAX_SEARCH_PAGES = 40
+	// how long after its last update a pending mapset is graveyarded
+	GRAVEYARD_AFTER = 28 * 24 * time.Hour
+)
+
+type statusSearch struct {
+	// status to search for, also the name of its cursor
+	status string
+	sort   string
+	// when a mapset in the results got there, which is what they're sorted by
+	when func(beatmapSet osuapi.Beatmapset) string
+	// how far behind the present the newest results are
+	lag time.Duration
+}
+
+func lastUpdated(beatmapSet osuapi.Beatmapset) string { return beatmapSet.LastUpdated }
+func rankedDate(beatmapSet osuapi.Beatmapset) string  { return beatmapSet.RankedDate }
+
+var statusSearches = []statusSearch{
+	{"pending", osuapi.SORT_UPDATED_DESC, lastUpdated, 0},
+	{"qualified", osuapi.SORT_RANKED_DESC, rankedDate, 0},
+	{"ranked", osuapi.SORT_RANKED_DESC, rankedDate, 0},
+	{"loved", osuapi.SORT_RANKED_DESC, rankedDate, 0},
+	{"graveyard", osuapi.SORT_UPDATED_DESC, lastUpdated, GRAVEYARD_AFTER},
+}
+
+func (s *Scraper) scrapeStatuses(ctx context.Context) {
+	tracked := s.trackedNow()
+	for _, search := range statusSearches {
+		s.scrapeStatus(ctx, search, tracked)
+	}
+
+	// this rings the terminal bell when it's updated so i don't have to stare
+	// at a blank screen for 30 seconds waiting for the feed to update
+	if s.config.Debug {
+		fmt.Print("\a")
+	}
+}
+
+// Handle every tracked mapset that entered the searched status
+// since the cursor, then move the cursor past every one that's done, oldest
+// first
+func (s *Scraper) scrapeStatus(ctx context.Context, search statusSearch, tracked tracked) {
+	now := time.Now().Add(-search.lag)
+	cursor, ok := s.db.ScraperCursor(search.status)
+	if !ok {
+		// nothing to catch up on the first time around
+		log.Printf("no %s cursor saved, starting from %s\n", search.status, now)
+		err := s.db.SetScraperCursor(search.status, now)
+		if err != nil {
+			log.Println("error saving scraper cursor:", err)
+		}
+		return
+	}
+
+	maxLookback := s.config.Scraper.MaxLookback.Duration
+	if maxLookback == 0 {
+		maxLookback = DEFAULT_MAX_LOOKBACK
+	}
+	if floor := now.Add(-maxLookback); cursor.Before(floor) {
+		log.Printf("%s cursor %s is older than the max lookback, skipping to %s\n", search.status, cursor, floor)
+		cursor = floor
+	}
+
+	progress, ok := s.searches[search.status]
+	if !ok {
+		progress = newSearchProgress(now)
+	}
+	complete, err := s.searchSince(search, cursor, progress)
+	if err != nil {
+		// pick up from the page that failed next time
+		s.searches[search.status] = progress
+		log.Printf("error fetching %s sets: %s\n", search.status, err)
+		s.bot.NotifyError("failed to fetch %s sets: %s", search.status, err)
+		return
+	} else if !complete {
+		s.searches[search.status] = progress
+		log.Printf("%s search didn't get back to %s within %d pages, continuing next time\n", search.status, cursor, MAX_SEARCH_PAGES)
+		return
+	}
+	delete(s.searches, search.status)
+	beatmapSets := progress.oldestFirst()
+
+	keys := make([]int, len(beatmapSets))
+	for i, beatmapSet := range beatmapSets {
+		keys[i] = beatmapSet.ID
+	}
+	errs := s.runPool(ctx, keys, func(i int) error {
+		beatmapSet := beatmapSets[i]
+		key := handledKey{search.status, beatmapSet.ID, search.when(beatmapSet)}
+		if !tracked.has(beatmapSet) || s.wasHandled(key) {
+			return nil
+		}
+
+		err := s.handleUpdate(ctx, beatmapSet, 0, search.status == "pending")
+		if err == nil {
+			s.setHandled(key, true)
+		}
+		return err
+	})
+
+	// the next search stops at the cursor, so it only moves past a time once
+	// every mapset there is done. Mapsets handled before one that failed are
+	// remembered until then so they aren't handled again.
+	done := 0
+	for i, beatmapSet := range beatmapSets {
+		if ctx.Err() != nil {
+			// the lease is gone, so the cursor is someone else's now
+			break
+		}
+		if errs[i] != nil && !s.giveUp(beatmapSet, errs[i]) {
+			// try again from here next time
+			break
+		}
+
+		when := search.when(beatmapSet)
+		if i+1 < len(beatmapSets) && search.when(beatmapSets[i+1]) == when {
+			continue
+		}
+
+		cursor, _ = time.Parse(time.RFC3339, when)
+		err = s.db.SetScraperCursor(search.status, cursor)
+		if err != nil {
+			log.Println("error saving scraper cursor:", err)
+			break
+		}
+		for _, beatmapSet := range beatmapSets[done : i+1] {
+			s.setHandled(handledKey{search.status, beatmapSet.ID, search.when(beatmapSet)}, false)
+		}
+		done = i + 1
+	}
+
+	log.Printf("%s cursor at %s\n", search.status, cursor)
+}
+
+// How far a search got paging back towards its cursor. A search that runs out
+// of pages before getting there carries on from the same page next time, with
+// the cursor left where it was so nothing in between is skipped.
+type searchProgress struct {
+	until time.Time
+	// the last page fetched, nil before the first one
+	page *osuapi.BeatmapSearch
+	// mapsets found so far, newest first
+	found []osuapi.Beatmapset
+	seen  map[int]bool
+}
+
+func newSearchProgress(until time.Time) *searchProgress {
+	return &searchProgress{until: until, seen: make(map[int]bool)}
+}
+
+// Mapsets found so far, oldest first
+func (progress *searchProgress) oldestFirst() (beatmapSets []osuapi.Beatmapset) {
+	beatmapSets = make([]osuapi.Beatmapset, len(progress.found))
+	copy(beatmapSets, progress.found)
+	reverse(beatmapSets)
+	return
+}
+
+// Page through mapsets that entered the searched status after since, up to
+// progress.until, collecting them in progress. Returns false if it gave up
+// after MAX_SEARCH_PAGES before getting back to since.
+func (s *Scraper) searchSince(search statusSearch, since time.Time, progress *searchProgress) (complete bool, err error) {
+	for pages := 0; pages < MAX_SEARCH_PAGES; pages++ {
+		var results osuapi.BeatmapSearch
+		results, err = s.api.SearchBeatmapsPage(search.status, search.sort, progress.page)
+		if err != nil {
+			err = fmt.Errorf("couldn't search page %d of %s sets: %w", pages+1, search.status, err)
+			return
+		}
+
+		for _, beatmapSet := range results.Beatmapsets {
+			when, err := time.Parse(time.RFC3339, search.when(beatmapSet))
+			if err != nil {
+				log.Printf("error parsing time of %d: %s\n", beatmapSet.ID, err)
+				continue
+			}
+			if !when.After(since) {
+				return true, nil
+			}
+
+			// picked up once until catches up with it, and a mapset updated
+			// while paging shows up twice
+			if when.After(progress.until) || progress.seen[beatmapSet.ID] {
+				continue
+			}
+			progress.seen[beatmapSet.ID] = true
+			progress.found = append(progress.found, beatmapSet)
+		}
+
+		if !results.HasNextPage() {
+			return true, nil
+		}
+		progress.page = &results
+	}
+
+	return
+}
+
+// An update found by one of the searches
+type handledKey struct {
+	status string
+	mapId  int
+	when   string
+}
+
+func (s *Scraper) wasHandled(key handledKey) bool {
+	s.retryMutex.Lock()
+	defer s.retryMutex.Unlock()
+	return s.handled[key]
+}
+
+func (s *Scraper) setHandled(key handledKey, handled bool) {
+	s.retryMutex.Lock()
+	defer s.retryMutex.Unlock()
+	if handled {
+		s.handled[key] = true
+	} else {
+		delete(s.handled, key)
+	}
+}
+
+func reverse(beatmapSets []osuapi.Beatmapset) {
+	for i, j := 0, len(beatmapSets)-1; i < j; i, j = i+1, j-1 {
+		beatmapSets[i], beatmapSets[j] = beatmapSets[j], beatmapSets[i]
+	}
+}
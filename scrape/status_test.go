@@ -0,0 +1,220 @@
+package scrape
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"subscribe-bot/osuapi"
+)
+
+// The URL a search asks for a page with, cursor being the previous page's
+func searchUrl(search statusSearch, cursor string) string {
+	values := url.Values{}
+	values.Set("s", search.status)
+	values.Set("sort", search.sort)
+	if cursor != "" {
+		values.Set("cursor_string", cursor)
+	}
+	return "/beatmapsets/search?" + values.Encode()
+}
+
+// A page of search results leading on to the page named next, if there is one
+func searchPage(next string, beatmapSets ...osuapi.Beatmapset) osuapi.BeatmapSearch {
+	return osuapi.BeatmapSearch{Beatmapsets: beatmapSets, CursorString: next}
+}
+
+// A pending mapset last updated at when. Mapsets hosted by TRACKED_MAPPER
+// fail to be handled, since they don't have any difficulties.
+func pendingMapset(id int, userId int, when time.Time) osuapi.Beatmapset {
+	return osuapi.Beatmapset{ID: id, UserID: userId, Status: "pending", LastUpdated: when.Format(time.RFC3339)}
+}
+
+const TRACKED_MAPPER = 50
+
+func TestSearchSince(t *testing.T) {
+	search := statusSearches[0]
+	now := time.Now().Truncate(time.Second)
+	at := func(hours int) time.Time { return now.Add(-time.Duration(hours) * time.Hour) }
+
+	tests := []struct {
+		name  string
+		pages map[string]osuapi.BeatmapSearch
+		since time.Time
+		// mapsets found, oldest first
+		want     []int
+		complete bool
+	}{
+		{
+			"stops at the cursor",
+			map[string]osuapi.BeatmapSearch{
+				"":  searchPage("2", pendingMapset(1, 1, at(1)), pendingMapset(2, 1, at(2))),
+				"2": searchPage("3", pendingMapset(3, 1, at(3)), pendingMapset(4, 1, at(4))),
+			},
+			at(4),
+			[]int{3, 2, 1},
+			true,
+		},
+		{
+			"runs out of pages",
+			map[string]osuapi.BeatmapSearch{
+				"":  searchPage("2", pendingMapset(1, 1, at(1))),
+				"2": searchPage("", pendingMapset(2, 1, at(2))),
+			},
+			at(10),
+			[]int{2, 1},
+			true,
+		},
+		{
+			"mapset updated while paging",
+			map[string]osuapi.BeatmapSearch{
+				"":  searchPage("2", pendingMapset(1, 1, at(1)), pendingMapset(2, 1, at(2))),
+				"2": searchPage("", pendingMapset(1, 1, at(3)), pendingMapset(3, 1, at(4))),
+			},
+			at(10),
+			[]int{3, 2, 1},
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestScraper(t)
+			responses := make(map[string]interface{})
+			for cursor, page := range test.pages {
+				responses[searchUrl(search, cursor)] = page
+			}
+			replay(t, s, responses)
+
+			progress := newSearchProgress(now)
+			complete, err := s.searchSince(search, test.since, progress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if complete != test.complete {
+				t.Errorf("expected complete to be %v", test.complete)
+			}
+			found := make([]int, 0)
+			for _, beatmapSet := range progress.oldestFirst() {
+				found = append(found, beatmapSet.ID)
+			}
+			if fmt.Sprint(found) != fmt.Sprint(test.want) {
+				t.Errorf("expected %v, got %v", test.want, found)
+			}
+		})
+	}
+}
+
+func TestSearchSincePageCap(t *testing.T) {
+	search := statusSearches[0]
+	now := time.Now().Truncate(time.Second)
+
+	s := newTestScraper(t)
+	responses := make(map[string]interface{})
+	for page := 1; page <= MAX_SEARCH_PAGES+1; page++ {
+		cursor := ""
+		if page > 1 {
+			cursor = fmt.Sprint(page)
+		}
+		when := now.Add(-time.Duration(page) * time.Minute)
+		responses[searchUrl(search, cursor)] = searchPage(fmt.Sprint(page+1), pendingMapset(page, 1, when))
+	}
+	replay(t, s, responses)
+
+	since := now.Add(-time.Duration(MAX_SEARCH_PAGES+1) * time.Minute)
+	progress := newSearchProgress(now)
+	complete, err := s.searchSince(search, since, progress)
+	if err != nil || complete {
+		t.Fatalf("expected to run out of pages, got %v (%v)", complete, err)
+	}
+	if len(progress.found) != MAX_SEARCH_PAGES {
+		t.Errorf("expected %d mapsets, got %d", MAX_SEARCH_PAGES, len(progress.found))
+	}
+
+	// carries on from the page after the last one
+	complete, err = s.searchSince(search, since, progress)
+	if err != nil || !complete {
+		t.Fatalf("expected to get back to the cursor, got %v (%v)", complete, err)
+	}
+	if len(progress.found) != MAX_SEARCH_PAGES {
+		t.Errorf("expected %d mapsets, got %d", MAX_SEARCH_PAGES, len(progress.found))
+	}
+}
+
+func TestScrapeStatusSharedTime(t *testing.T) {
+	search := statusSearches[0]
+	now := time.Now().Truncate(time.Second)
+	cursor, older, shared := now.Add(-3*time.Hour), now.Add(-2*time.Hour), now.Add(-time.Hour)
+
+	tests := []struct {
+		name string
+		// newest first, the way the search returns them
+		page []osuapi.Beatmapset
+		want time.Time
+	}{
+		{
+			"failure after a mapset sharing its time",
+			[]osuapi.Beatmapset{
+				pendingMapset(1, TRACKED_MAPPER, shared),
+				pendingMapset(2, 1, shared),
+				pendingMapset(3, 1, older),
+			},
+			older,
+		},
+		{
+			"failure before a mapset sharing its time",
+			[]osuapi.Beatmapset{
+				pendingMapset(2, 1, shared),
+				pendingMapset(1, TRACKED_MAPPER, shared),
+				pendingMapset(3, 1, older),
+			},
+			older,
+		},
+		{
+			"every mapset at a time handled",
+			[]osuapi.Beatmapset{
+				pendingMapset(1, 1, shared),
+				pendingMapset(2, 1, shared),
+				pendingMapset(3, 1, older),
+			},
+			shared,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestScraper(t)
+			trackMapper(t, s, "channel", TRACKED_MAPPER)
+			replay(t, s, map[string]interface{}{searchUrl(search, ""): searchPage("", test.page...)})
+			err := s.db.SetScraperCursor(search.status, cursor)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s.scrapeStatus(context.Background(), search, s.trackedNow())
+			got, _ := s.db.ScraperCursor(search.status)
+			if !got.Equal(test.want) {
+				t.Errorf("expected the cursor at %s, got %s", test.want, got)
+			}
+		})
+	}
+
+	// the mapset that failed is found again once it can be handled
+	s := newTestScraper(t)
+	trackMapper(t, s, "channel", TRACKED_MAPPER)
+	err := s.db.SetScraperCursor(search.status, cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay(t, s, map[string]interface{}{searchUrl(search, ""): searchPage("", tests[0].page...)})
+	s.scrapeStatus(context.Background(), search, s.trackedNow())
+
+	fixed := searchPage("", pendingMapset(1, 1, shared), pendingMapset(2, 1, shared), pendingMapset(3, 1, older))
+	replay(t, s, map[string]interface{}{searchUrl(search, ""): fixed})
+	s.scrapeStatus(context.Background(), search, s.trackedNow())
+	if got, _ := s.db.ScraperCursor(search.status); !got.Equal(shared) {
+		t.Errorf("expected the cursor at %s once the failure was handled, got %s", shared, got)
+	}
+}
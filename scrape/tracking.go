@@ -0,0 +1,161 @@
+package scrape
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"subscribe-bot/db"
+	"subscribe-bot/osuapi"
+)
+
+// Everything channels are following, either every mapset of a mapper, a
+// single mapset whoever's hosting it or every mapset matching a query
+type tracked struct {
+	mappers map[int]bool
+	mapsets map[int]bool
+	queries []db.Query
+}
+
+func (s *Scraper) trackedNow() (t tracked) {
+	t = tracked{mappers: make(map[int]bool), mapsets: make(map[int]bool)}
+	s.db.IterAllTrackedMappers(func(userId int) error {
+		t.mappers[userId] = true
+		return nil
+	})
+	s.db.IterAllTrackedMapsets(func(mapId int) error {
+		t.mapsets[mapId] = true
+		return nil
+	})
+
+	var err error
+	t.queries, err = s.db.Queries("")
+	if err != nil {
+		log.Println("error reading query subscriptions:", err)
+	}
+	return
+}
+
+// Whether anyone follows a mapset, its host or the mapper of any of its
+// difficulties
+func (t tracked) has(beatmapSet osuapi.Beatmapset) bool {
+	if t.mappers[beatmapSet.UserID] || t.mapsets[beatmapSet.ID] {
+		return true
+	}
+	for _, beatmap := range beatmapSet.Beatmaps {
+		if t.mappers[beatmap.UserID] {
+			return true
+		}
+	}
+	for _, query := range t.queries {
+		if query.Matches(beatmapSet) {
+			return true
+		}
+	}
+	return false
+}
+
+// Every channel following a mapset, either on its own or through any of the
+// given mappers, without duplicates
+func (s *Scraper) channelsFor(mapId int, mappers ...int) (channels []string) {
+	seen := make(map[string]bool)
+	channels = make([]string, 0)
+	add := func(channelId string) error {
+		if !seen[channelId] {
+			seen[channelId] = true
+			channels = append(channels, channelId)
+		}
+		return nil
+	}
+
+	for _, mapperId := range mappers {
+		s.db.IterTrackingChannels(mapperId, add)
+	}
+	s.db.IterMapsetTrackingChannels(mapId, add)
+	return
+}
+
+// Every channel that gets every update to a mapset, following it, its host or
+// a query it matches
+func (s *Scraper) subscribers(beatmapSet osuapi.Beatmapset) (channels []string) {
+	channels = s.channelsFor(beatmapSet.ID, beatmapSet.UserID)
+
+	queries, err := s.db.Queries("")
+	if err != nil {
+		log.Println("error reading query subscriptions:", err)
+	}
+	for _, query := range queries {
+		if query.Matches(beatmapSet) && !contains(channels, query.ChannelID) {
+			channels = append(channels, query.ChannelID)
+		}
+	}
+	return
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Channels that only follow a mapset through the mappers of its guest
+// difficulties, along with which of those difficulties they care about
+type guestGroup struct {
+	channels     []string
+	difficulties []int
+}
+
+// Group channels following any guest mapper of a mapset by the difficulties
+// they follow, leaving out the ones in exclude that get every update anyway
+func (s *Scraper) guestGroups(beatmapSet osuapi.Beatmapset, exclude []string) (groups []guestGroup) {
+	skip := make(map[string]bool)
+	for _, channelId := range exclude {
+		skip[channelId] = true
+	}
+
+	// difficulty IDs are in the mapset's order
+	following := make(map[string][]int)
+	order := make([]string, 0)
+	for _, beatmap := range beatmapSet.Beatmaps {
+		if beatmap.UserID == 0 || beatmap.UserID == beatmapSet.UserID {
+			continue
+		}
+		s.db.IterTrackingChannels(beatmap.UserID, func(channelId string) error {
+			if skip[channelId] {
+				return nil
+			}
+			if _, ok := following[channelId]; !ok {
+				order = append(order, channelId)
+			}
+			following[channelId] = append(following[channelId], beatmap.ID)
+			return nil
+		})
+	}
+
+	byKey := make(map[string]int)
+	for _, channelId := range order {
+		difficulties := following[channelId]
+		ids := make([]string, len(difficulties))
+		for i, id := range difficulties {
+			ids[i] = strconv.Itoa(id)
+		}
+		key := strings.Join(ids, ",")
+
+		g, ok := byKey[key]
+		if !ok {
+			g = len(groups)
+			byKey[key] = g
+			groups = append(groups, guestGroup{difficulties: difficulties})
+		}
+		groups[g].channels = append(groups[g].channels, channelId)
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].channels[0] < groups[j].channels[0]
+	})
+	return
+}
@@ -0,0 +1,146 @@
+package scrape
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"subscribe-bot/db"
+	"subscribe-bot/osuapi"
+)
+
+func TestGuestGroups(t *testing.T) {
+	// mapset 1 by user 10, with guest difficulties by users 20 and 30
+	beatmapSet := osuapi.Beatmapset{ID: 1, UserID: 10, Beatmaps: []osuapi.Beatmap{
+		{ID: 101, UserID: 10},
+		{ID: 102, UserID: 20},
+		{ID: 103, UserID: 30},
+		{ID: 104, UserID: 20},
+		{ID: 105},
+	}}
+
+	tests := []struct {
+		name    string
+		follows map[string][]int
+		exclude []string
+		want    []guestGroup
+	}{
+		{"nobody follows the guests", map[string][]int{"a": {10}}, []string{"a"}, nil},
+		{
+			"one guest",
+			map[string][]int{"a": {20}},
+			nil,
+			[]guestGroup{{[]string{"a"}, []int{102, 104}}},
+		},
+		{
+			"channels following the same difficulties share a group",
+			map[string][]int{"a": {20}, "b": {20}, "c": {30}},
+			nil,
+			[]guestGroup{{[]string{"a", "b"}, []int{102, 104}}, {[]string{"c"}, []int{103}}},
+		},
+		{
+			"both guests",
+			map[string][]int{"a": {20, 30}, "b": {30}},
+			nil,
+			[]guestGroup{{[]string{"a"}, []int{102, 103, 104}}, {[]string{"b"}, []int{103}}},
+		},
+		{
+			"channels getting every update are left out",
+			map[string][]int{"a": {10, 20}, "b": {20}},
+			[]string{"a"},
+			[]guestGroup{{[]string{"b"}, []int{102, 104}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestScraper(t)
+			for channelId, mappers := range test.follows {
+				for _, mapperId := range mappers {
+					trackMapper(t, s, channelId, mapperId)
+				}
+			}
+
+			groups := s.guestGroups(beatmapSet, test.exclude)
+			if !reflect.DeepEqual(groups, test.want) {
+				t.Errorf("want %+v, got %+v", test.want, groups)
+			}
+		})
+	}
+}
+
+func TestSubscribers(t *testing.T) {
+	// mapset 1 by user 10, with a guest difficulty by user 20
+	beatmapSet := osuapi.Beatmapset{
+		ID:       1,
+		UserID:   10,
+		Artist:   "Camellia",
+		Title:    "Some Song",
+		Tags:     "tournament",
+		Status:   "pending",
+		Beatmaps: []osuapi.Beatmap{{ID: 101, UserID: 10, Mode: "osu"}, {ID: 102, UserID: 20, Mode: "osu"}},
+	}
+
+	tests := []struct {
+		name    string
+		mappers map[string][]int
+		mapsets map[string][]int
+		queries map[string]string
+		// whether the scraper looks at the mapset at all
+		has  bool
+		want []string
+	}{
+		{"nobody", nil, nil, nil, false, []string{}},
+		{"host", map[string][]int{"a": {10}}, nil, nil, true, []string{"a"}},
+		{"mapset", nil, map[string][]int{"a": {1}}, nil, true, []string{"a"}},
+		{"guest", map[string][]int{"a": {20}}, nil, nil, true, []string{}},
+		{"someone else", map[string][]int{"a": {30}}, map[string][]int{"a": {2}}, nil, false, []string{}},
+		{"matching query", nil, nil, map[string]string{"a": "camellia tag=tournament"}, true, []string{"a"}},
+		{"query that doesn't match", nil, nil, map[string]string{"a": "camellia mode=mania"}, false, []string{}},
+		{
+			"query and host in the same channel",
+			map[string][]int{"a": {10}},
+			nil,
+			map[string]string{"a": "status=pending", "b": "some song"},
+			true,
+			[]string{"a", "b"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestScraper(t)
+			for channelId, mappers := range test.mappers {
+				for _, mapperId := range mappers {
+					trackMapper(t, s, channelId, mapperId)
+				}
+			}
+			for channelId, mapsets := range test.mapsets {
+				for _, mapId := range mapsets {
+					err := s.db.ChannelTrackMapset(channelId, mapId, 0)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			for channelId, text := range test.queries {
+				query, err := db.ParseQuery(channelId, text)
+				if err == nil {
+					_, err = s.db.AddQuery(query)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := s.trackedNow().has(beatmapSet); got != test.has {
+				t.Errorf("expected has to be %v, got %v", test.has, got)
+			}
+			channels := s.subscribers(beatmapSet)
+			sort.Strings(channels)
+			if !reflect.DeepEqual(channels, test.want) {
+				t.Errorf("expected %v, got %v", test.want, channels)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package web
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"subscribe-bot/backup"
+	"subscribe-bot/db"
+	"subscribe-bot/scrape"
+)
+
+func (web *Web) requireAdmin(c *gin.Context) {
+	if !web.isAdmin(c) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	c.Next()
+}
+
+// Admin pages work with the database, which only the leader has open
+func (web *Web) requireLeader(c *gin.Context) {
+	database, scraper := web.leader()
+	if database == nil {
+		c.String(http.StatusServiceUnavailable, "this instance isn't the leader, try the one that is")
+		c.Abort()
+		return
+	}
+
+	c.Set("db", database)
+	c.Set("scraper", scraper)
+	c.Next()
+}
+
+// Scrape as soon as possible instead of waiting for the next tick
+func (web *Web) adminScrape(c *gin.Context) {
+	queued := c.MustGet("scraper").(*scrape.Scraper).ScrapeNow()
+	c.JSON(http.StatusAccepted, gin.H{"queued": queued})
+}
+
+// A message in the outbox, summarized for the admin page
+type outboxEntry struct {
+	db.OutboxMessage
+	Summary string
+}
+
+func summarizeOutbox(messages []db.OutboxMessage) (entries []outboxEntry) {
+	entries = make([]outboxEntry, 0, len(messages))
+	for _, msg := range messages {
+		var message struct {
+			Content string `json:"content"`
+			Embed   *struct {
+				Title string `json:"title"`
+			} `json:"embed"`
+		}
+		json.Unmarshal(msg.Message, &message)
+
+		summary := message.Content
+		if message.Embed != nil {
+			summary = message.Embed.Title
+		}
+		entries = append(entries, outboxEntry{msg, summary})
+	}
+	return
+}
+
+// List messages waiting to be sent and the dead letters that were given up on
+func (web *Web) adminOutbox(c *gin.Context) {
+	database := c.MustGet("db").(*db.Db)
+	waiting, err := database.OutboxMessages(false)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	deadLetters, err := database.OutboxMessages(true)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if strings.HasSuffix(c.FullPath(), ".json") {
+		c.JSON(http.StatusOK, gin.H{
+			"waiting":      waiting,
+			"dead_letters": deadLetters,
+		})
+		return
+	}
+
+	c.HTML(http.StatusOK, "admin-outbox.html", gin.H{
+		"LoggedIn":    isLoggedIn(c),
+		"Waiting":     summarizeOutbox(waiting),
+		"DeadLetters": summarizeOutbox(deadLetters),
+	})
+}
+
+// Put a dead letter back in the outbox
+func (web *Web) adminRetryDeadLetter(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	err = c.MustGet("db").(*db.Db).RequeueDeadLetter(id)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/admin/outbox")
+}
+
+// Download a full backup of the database and repositories
+func (web *Web) adminBackup(c *gin.Context) {
+	database := c.MustGet("db").(*db.Db)
+	serveDownload(c, backup.FileName(time.Now()), "application/gzip", func(w io.Writer) error {
+		return backup.Write(w, database.DB, web.repos, web.config, web.version)
+	})
+}
@@ -4,17 +4,44 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
 	"strings"
 
 	"github.com/gin-gonic/contrib/sessions"
 	"github.com/gin-gonic/gin"
+
+	"subscribe-bot/osuapi"
 )
 
+// Look up who an access token belongs to
+func (web *Web) currentUser(accessToken string) (user osuapi.User, err error) {
+	req, err := http.NewRequest("GET", "https://osu.ppy.sh/api/v2/me", nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := web.hc.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("unexpected status %s", resp.Status)
+		return
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&user)
+	return
+}
+
 func (web *Web) logout(c *gin.Context) {
 	session := sessions.Default(c)
 	session.Delete("access_token")
+	session.Delete("user_id")
 	session.Save()
 
 	c.Redirect(http.StatusTemporaryRedirect, "/")
@@ -61,6 +88,11 @@ func (web *Web) loginCallback(c *gin.Context) {
 
 	session := sessions.Default(c)
 	session.Set("access_token", token.AccessToken)
+	if user, err := web.currentUser(token.AccessToken); err == nil {
+		session.Set("user_id", user.ID)
+	} else {
+		log.Println("couldn't look up logged in user:", err)
+	}
 	session.Save()
 
 	c.Redirect(http.StatusTemporaryRedirect, "/")
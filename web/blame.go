@@ -0,0 +1,114 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gin-gonic/gin"
+
+	"subscribe-bot/osufile"
+)
+
+// Attribute every timing point and hit object of one difficulty to the
+// revision that last changed it. Served as a page, or as JSON when the
+// beatmap id ends in .json.
+func (web *Web) mapBlame(c *gin.Context) {
+	r, mapId, ok := web.openRepo(c)
+	if !ok {
+		return
+	}
+
+	beatmapParam := c.Param("beatmapId")
+	asJson := strings.HasSuffix(beatmapParam, ".json")
+	beatmapId, err := strconv.Atoi(strings.TrimSuffix(beatmapParam, ".json"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid beatmap id")
+		return
+	}
+
+	rev, err := r.Revision(c.Param("hash"))
+	if err != nil {
+		repoError(c, err)
+		return
+	}
+
+	fileName := fmt.Sprintf("%d.osu", beatmapId)
+	blame, err := r.Blame(rev.Hash, fileName)
+	if err != nil {
+		repoError(c, err)
+		return
+	}
+
+	type Entry struct {
+		Section     string    `json:"section"`
+		Time        float64   `json:"time"`
+		Description string    `json:"description"`
+		Line        string    `json:"line"`
+		Hash        string    `json:"hash"`
+		Date        time.Time `json:"date"`
+
+		HumanTime string `json:"-"`
+		HumanDate string `json:"-"`
+	}
+
+	entries := make([]Entry, 0, len(blame))
+	for _, entry := range blame {
+		ms, _ := osufile.LineTime(entry.Section, entry.Line)
+		entries = append(entries, Entry{
+			Section:     entry.Section,
+			Time:        ms,
+			Description: osufile.DescribeLine(entry.Section, entry.Line),
+			Line:        entry.Line,
+			Hash:        entry.Hash,
+			Date:        entry.Date,
+			HumanTime:   osufile.FormatTime(ms),
+			HumanDate:   humanize.Time(entry.Date),
+		})
+	}
+
+	// 0 unless this is a guest difficulty
+	guest := 0
+	if rev.Metadata != nil {
+		for _, diff := range rev.Metadata.Difficulties {
+			if diff.ID == beatmapId {
+				guest = diff.Mapper
+			}
+		}
+	}
+
+	if asJson {
+		c.JSON(http.StatusOK, gin.H{
+			"beatmapset_id": mapId,
+			"beatmap_id":    beatmapId,
+			"guest_mapper":  guest,
+			"revision":      rev.Hash,
+			"entries":       entries,
+		})
+		return
+	}
+
+	data, err := r.FileAt(rev.Hash, fileName)
+	if err != nil {
+		repoError(c, err)
+		return
+	}
+	parsed, err := osufile.Parse(strings.NewReader(string(data)))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.HTML(http.StatusOK, "map-blame.html", gin.H{
+		"LoggedIn":  isLoggedIn(c),
+		"Base":      fmt.Sprintf("/map/%s/%d", c.Param("userId"), mapId),
+		"BeatmapID": beatmapId,
+		"Metadata":  parsed.Metadata(),
+		"Guest":     guest,
+		"Revision":  rev,
+		"Entries":   entries,
+	})
+}
@@ -0,0 +1,267 @@
+package web
+
+// Read-only git smart HTTP, so map repositories can be cloned with
+//
+//   git clone <served_at>/map/<userId>/<mapId>.git
+//
+// Only the stateless upload-pack service is implemented.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	"golang.org/x/time/rate"
+)
+
+const UPLOAD_PACK = "git-upload-pack"
+
+// Serves a single, already opened repository to the go-git server
+type storerLoader struct {
+	storer storer.Storer
+}
+
+func (l storerLoader) Load(ep *transport.Endpoint) (storer.Storer, error) {
+	return l.storer, nil
+}
+
+// Per-client rate limiting for git requests, since packing is expensive
+type gitLimiter struct {
+	sync.Mutex
+	limit    rate.Limit
+	burst    int
+	limiters map[string]*rate.Limiter
+	lastSeen map[string]time.Time
+}
+
+func newGitLimiter(perMinute int) *gitLimiter {
+	if perMinute <= 0 {
+		perMinute = 30
+	}
+
+	return &gitLimiter{
+		limit:    rate.Limit(float64(perMinute) / 60),
+		burst:    perMinute,
+		limiters: make(map[string]*rate.Limiter),
+		lastSeen: make(map[string]time.Time),
+	}
+}
+
+func (gl *gitLimiter) Allow(client string) bool {
+	gl.Lock()
+	defer gl.Unlock()
+
+	now := time.Now()
+	// forget clients that have been quiet long enough to have a full bucket
+	for key, seen := range gl.lastSeen {
+		if now.Sub(seen) > time.Minute {
+			delete(gl.limiters, key)
+			delete(gl.lastSeen, key)
+		}
+	}
+
+	limiter, ok := gl.limiters[client]
+	if !ok {
+		limiter = rate.NewLimiter(gl.limit, gl.burst)
+		gl.limiters[client] = limiter
+	}
+	gl.lastSeen[client] = now
+
+	return limiter.Allow()
+}
+
+func (web *Web) gitRateLimit(c *gin.Context) {
+	if !web.gitLimiter.Allow(c.ClientIP()) {
+		c.String(http.StatusTooManyRequests, "slow down")
+		c.Abort()
+		return
+	}
+
+	c.Next()
+}
+
+func (web *Web) gitInfoRefs(c *gin.Context) {
+	if c.Query("service") != UPLOAD_PACK {
+		c.String(http.StatusForbidden, "only %s is supported", UPLOAD_PACK)
+		return
+	}
+
+	r, _, ok := web.openRepo(c)
+	if !ok {
+		return
+	}
+
+	srv := server.NewServer(storerLoader{r.Storer()})
+	session, err := srv.NewUploadPackSession(&transport.Endpoint{}, nil)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	defer session.Close()
+
+	ar, err := session.AdvertisedReferences()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	ar.Prefix = [][]byte{
+		[]byte("# service=" + UPLOAD_PACK),
+		pktline.Flush,
+	}
+	err = ar.Encode(&buf)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "application/x-"+UPLOAD_PACK+"-advertisement", buf.Bytes())
+}
+
+func (web *Web) gitUploadPack(c *gin.Context) {
+	r, _, ok := web.openRepo(c)
+	if !ok {
+		return
+	}
+
+	var body io.Reader = c.Request.Body
+	if c.GetHeader("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			c.String(http.StatusBadRequest, "bad gzip body")
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	req := packp.NewUploadPackRequest()
+	err := req.Decode(body)
+	if err != nil {
+		c.String(http.StatusBadRequest, "couldn't decode request: %s", err)
+		return
+	}
+
+	err = checkWants(r.Storer(), req.Wants)
+	if err != nil {
+		c.String(http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	done, err := decodeHaves(body, req, r.Storer())
+	if err != nil {
+		c.String(http.StatusBadRequest, "couldn't decode haves: %s", err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Content-Type", "application/x-"+UPLOAD_PACK+"-result")
+
+	// we don't support multi_ack, so all we can say to a client that's still
+	// negotiating is that we have nothing in common
+	if !done {
+		c.Status(http.StatusOK)
+		pktline.NewEncoder(c.Writer).EncodeString("NAK\n")
+		return
+	}
+
+	srv := server.NewServer(storerLoader{r.Storer()})
+	session, err := srv.NewUploadPackSession(&transport.Endpoint{}, nil)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	defer session.Close()
+
+	resp, err := session.UploadPack(c.Request.Context(), req)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	defer resp.Close()
+
+	c.Status(http.StatusOK)
+	err = resp.Encode(c.Writer)
+	if err != nil {
+		log.Println("error writing pack:", err)
+	}
+}
+
+// Make sure every object a client wants can be reached from the references
+// advertised for the repository. Mapsets share their object storage under the
+// packed backend, so anything else could be another mapset's.
+func checkWants(sto storer.Storer, wants []plumbing.Hash) (err error) {
+	refs, err := sto.IterReferences()
+	if err != nil {
+		return
+	}
+	defer refs.Close()
+
+	tips := make([]plumbing.Hash, 0)
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			tips = append(tips, ref.Hash())
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	objects, err := revlist.Objects(sto, tips, nil)
+	if err != nil {
+		return
+	}
+
+	reachable := make(map[plumbing.Hash]bool, len(objects))
+	for _, hash := range objects {
+		reachable[hash] = true
+	}
+	for _, want := range wants {
+		if !reachable[want] {
+			err = fmt.Errorf("not our ref %s", want)
+			return
+		}
+	}
+	return
+}
+
+// Read the "have" lines following the wants, keeping only objects that we
+// actually have. Returns whether the client finished with "done".
+func decodeHaves(body io.Reader, req *packp.UploadPackRequest, sto storer.Storer) (done bool, err error) {
+	scanner := pktline.NewScanner(body)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		switch {
+		case len(line) == 0:
+			// flush between batches of haves
+			continue
+		case bytes.Equal(line, []byte("done")):
+			done = true
+			return
+		case bytes.HasPrefix(line, []byte("have ")):
+			hash := plumbing.NewHash(string(line[5:]))
+			if sto.HasEncodedObject(hash) == nil {
+				req.Haves = append(req.Haves, hash)
+			}
+		}
+	}
+
+	err = scanner.Err()
+	return
+}
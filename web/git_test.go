@@ -0,0 +1,81 @@
+package web
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"subscribe-bot/repo"
+)
+
+func snapshotFile(t *testing.T, r *repo.Repo, contents string) repo.Revision {
+	t.Helper()
+
+	src := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(src, "1.osu"), []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rev, err := r.Snapshot(src, &repo.SnapshotOptions{
+		Subject:   "Update",
+		Author:    object.Signature{Name: "mapper", When: time.Unix(1600000000, 0)},
+		Committer: object.Signature{Name: "subscribe-bot", When: time.Unix(1600000000, 0)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rev
+}
+
+func TestCheckWantsPacked(t *testing.T) {
+	backend, err := repo.NewPackedBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mine, err := backend.OpenOrInit(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := backend.OpenOrInit(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := snapshotFile(t, mine, "first")
+	second := snapshotFile(t, mine, "second")
+	other := snapshotFile(t, theirs, "someone else's")
+
+	otherCommit, err := object.GetCommit(theirs.Storer(), plumbing.NewHash(other.Hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want plumbing.Hash
+		ok   bool
+	}{
+		{"head", plumbing.NewHash(second.Hash), true},
+		{"older revision", plumbing.NewHash(first.Hash), true},
+		{"another mapset's revision", plumbing.NewHash(other.Hash), false},
+		{"another mapset's tree", otherCommit.TreeHash, false},
+		{"missing object", plumbing.NewHash("0123456789012345678901234567890123456789"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkWants(mine.Storer(), []plumbing.Hash{test.want})
+			if test.ok && err != nil {
+				t.Errorf("expected %s to be allowed, got %s", test.want, err)
+			} else if !test.ok && err == nil {
+				t.Errorf("expected %s to be refused", test.want)
+			}
+		})
+	}
+}
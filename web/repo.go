@@ -1,31 +1,87 @@
 package web
 
 import (
-	"archive/zip"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
-	"path"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/gin-gonic/gin"
-	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing"
-	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"subscribe-bot/osufile"
+	"subscribe-bot/repo"
 )
 
-func (web *Web) mapVersions(c *gin.Context) {
-	userId := c.Param("userId")
-	mapId := c.Param("mapId")
+// Open the repository named by the :mapId param, writing an error response if
+// it can't be found. Repositories are keyed by mapset alone, :userId is only
+// there so links from before host changes keep working.
+func (web *Web) openRepo(c *gin.Context) (r *repo.Repo, mapId int, ok bool) {
+	userId, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	// git clients ask for <mapId>.git
+	mapId, err = strconv.Atoi(strings.TrimSuffix(c.Param("mapId"), ".git"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid map id")
+		return
+	}
+
+	host, _ := web.repos.Mapper(mapId)
+	if web.isOptedOut(userId) || web.isOptedOut(host) {
+		c.String(http.StatusNotFound, "no such map")
+		return
+	}
+
+	r, err = web.repos.Open(mapId)
+	if errors.Is(err, repo.ErrNotExist) {
+		c.String(http.StatusNotFound, "no such map")
+		return
+	} else if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	ok = true
+	return
+}
+
+// Write an error response for errors coming out of a repo
+func repoError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, repo.ErrRevisionNotFound):
+		c.String(http.StatusNotFound, "no such revision")
+	case errors.Is(err, repo.ErrNoParent):
+		c.String(http.StatusNotFound, "revision has no parent")
+	case errors.Is(err, repo.ErrFileNotFound):
+		c.String(http.StatusNotFound, "no such difficulty in this revision")
+	case errors.Is(err, repo.ErrNoAssets):
+		c.String(http.StatusNotFound, "no assets were archived for this map, only the zip of difficulties is available")
+	default:
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
 
-	id, _ := strconv.Atoi(mapId)
-	bs, _ := web.api.GetBeatmapSet(id)
+func (web *Web) mapVersions(c *gin.Context) {
+	r, mapId, ok := web.openRepo(c)
+	if !ok {
+		return
+	}
 
-	repoDir := path.Join(web.config.Repos, userId, mapId)
-	repo, _ := git.PlainOpen(repoDir)
+	bs, err := web.api.GetBeatmapSet(mapId)
+	if err != nil {
+		c.AbortWithError(http.StatusBadGateway, err)
+		return
+	}
 
 	type Revision struct {
 		Date      time.Time
@@ -33,26 +89,54 @@ func (web *Web) mapVersions(c *gin.Context) {
 		Summary   string
 		Hash      string
 		HasParent bool
+		Status    string
+		Tags      []string
+	}
+
+	revs, err := r.Log(20)
+	if err != nil {
+		repoError(c, err)
+		return
+	}
+
+	tags, err := r.Tags()
+	if err != nil {
+		repoError(c, err)
+		return
+	}
+	tagsByHash := make(map[string][]string)
+	for _, tag := range tags {
+		tagsByHash[tag.Hash] = append(tagsByHash[tag.Hash], tag.Name)
 	}
 
-	versions := make([]Revision, 0)
-	logIter, _ := repo.Log(&git.LogOptions{})
-	for i := 0; i < 20; i++ {
-		commit, err := logIter.Next()
-		if err == io.EOF {
-			break
+	// compare links default to showing everything since the last qualification
+	base := c.Query("base")
+	if base == "" {
+		qualified, ok, err := r.LatestTag(repo.STATUS_QUALIFIED)
+		if err != nil {
+			repoError(c, err)
+			return
+		}
+		if ok {
+			base = qualified.Name
 		}
+	}
 
-		stats, _ := commit.Stats()
-		_, err = commit.Parent(0)
-		hasParent := !errors.Is(err, object.ErrParentNotFound)
+	versions := make([]Revision, 0, len(revs))
+	for _, rev := range revs {
+		status := ""
+		if rev.Metadata != nil {
+			status = rev.Metadata.Status
+		}
 
 		versions = append(versions, Revision{
-			Date:      commit.Author.When,
-			HumanDate: humanize.Time(commit.Author.When),
-			Summary:   stats.String(),
-			Hash:      commit.Hash.String(),
-			HasParent: hasParent,
+			Date:      rev.Date,
+			HumanDate: humanize.Time(rev.Date),
+			Summary:   rev.Summary,
+			Hash:      rev.Hash,
+			HasParent: rev.HasParent,
+			Status:    status,
+			Tags:      tagsByHash[rev.Hash],
 		})
 	}
 
@@ -60,55 +144,99 @@ func (web *Web) mapVersions(c *gin.Context) {
 		"Beatmapset": bs,
 		"LoggedIn":   isLoggedIn(c),
 		"Versions":   versions,
+		"Tags":       tags,
+		"Base":       base,
 	})
 }
 
 func (web *Web) mapPatch(c *gin.Context) {
-	userId := c.Param("userId")
-	mapId := c.Param("mapId")
-	hash := c.Param("hash")
+	r, _, ok := web.openRepo(c)
+	if !ok {
+		return
+	}
+
+	diff, err := r.Diff(c.Param("hash"))
+	if err != nil {
+		repoError(c, err)
+		return
+	}
+
+	c.String(http.StatusOK, diff.Patch)
+}
 
-	repoDir := path.Join(web.config.Repos, userId, mapId)
-	repo, _ := git.PlainOpen(repoDir)
+func (web *Web) mapCompare(c *gin.Context) {
+	r, _, ok := web.openRepo(c)
+	if !ok {
+		return
+	}
 
-	hashObj := plumbing.NewHash(hash)
-	commit, _ := repo.CommitObject(hashObj)
-	parent, _ := commit.Parent(0)
-	patch, _ := parent.Patch(commit)
+	diff, err := r.Compare(c.Param("from"), c.Param("to"))
+	if err != nil {
+		repoError(c, err)
+		return
+	}
 
-	c.String(http.StatusOK, "text/plain", patch.String())
+	c.String(http.StatusOK, diff.Patch)
 }
 
 func (web *Web) mapZip(c *gin.Context) {
-	userId := c.Param("userId")
-	mapId := c.Param("mapId")
+	r, mapId, ok := web.openRepo(c)
+	if !ok {
+		return
+	}
+
 	hash := c.Param("hash")
+	if _, err := r.Revision(hash); err != nil {
+		repoError(c, err)
+		return
+	}
 
-	repoDir := path.Join(web.config.Repos, userId, mapId)
-	repo, _ := git.PlainOpen(repoDir)
+	serveDownload(c, fmt.Sprintf("%d-%s.zip", mapId, hash), "application/zip", func(w io.Writer) error {
+		return r.Archive(hash, w)
+	})
+}
+
+// Rebuild a mapset as it was at some revision, with the latest archived
+// assets, so it can be opened in the editor
+func (web *Web) mapOsz(c *gin.Context) {
+	r, mapId, ok := web.openRepo(c)
+	if !ok {
+		return
+	}
 
-	hashObj := plumbing.NewHash(hash)
-	commit, _ := repo.CommitObject(hashObj)
-	tree, _ := commit.Tree()
+	hash := c.Param("hash")
+	osz, err := r.Osz(hash)
+	if err != nil {
+		repoError(c, err)
+		return
+	}
 
-	files := tree.Files()
+	name := osufile.SanitizeFileName(fmt.Sprintf("%d %s - %s (%s).osz", mapId, osz.Artist, osz.Title, hash))
+	serveDownload(c, name, "application/octet-stream", osz.Write)
+}
 
-	c.Writer.Header().Set("Content-type", "application/octet-stream")
-	c.Writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s-%s.zip", mapId, hash))
-	c.Stream(func(w io.Writer) bool {
-		ar := zip.NewWriter(w)
-		for {
-			file, err := files.Next()
-			if err == io.EOF {
-				break
-			}
+// Build a download into a temporary file and only send it once it's complete,
+// so anything going wrong partway still gets an error status instead of a
+// truncated file
+func serveDownload(c *gin.Context, name string, contentType string, build func(w io.Writer) error) {
+	f, err := ioutil.TempFile("", "subscribe-bot-download")
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
 
-			reader, _ := file.Reader()
-			fdest, _ := ar.Create(file.Name)
-			io.Copy(fdest, reader)
-		}
-		ar.Close()
+	err = build(f)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("couldn't build %s: %w", name, err))
+		return
+	}
 
-		return false
-	})
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(c.Writer, c.Request, name, time.Now(), f)
 }
@@ -3,11 +3,8 @@ package web
 import (
 	"fmt"
 	"html/template"
-	"io/ioutil"
+	"log"
 	"net/http"
-	"os"
-	"path"
-	"strconv"
 	"sync"
 	"time"
 
@@ -19,7 +16,10 @@ import (
 	"github.com/kofalt/go-memoize"
 
 	"subscribe-bot/config"
+	"subscribe-bot/db"
 	"subscribe-bot/osuapi"
+	"subscribe-bot/repo"
+	"subscribe-bot/scrape"
 )
 
 const (
@@ -33,17 +33,51 @@ var (
 type Web struct {
 	config  *config.Config
 	api     *osuapi.Osuapi
+	repos   repo.Backend
 	hc      *http.Client
 	version string
+
+	gitLimiter *gitLimiter
+
+	// only set while this instance is the leader, see Attach
+	db          *db.Db
+	scraper     *scrape.Scraper
+	leaderMutex sync.RWMutex
 }
 
-func RunWeb(config *config.Config, api *osuapi.Osuapi, version string) {
+func New(config *config.Config, api *osuapi.Osuapi, repos repo.Backend, version string) *Web {
 	hc := &http.Client{
 		Timeout: 10 * time.Second,
 	}
 
-	web := Web{config, api, hc, version}
-	web.Run()
+	return &Web{
+		config:     config,
+		api:        api,
+		repos:      repos,
+		hc:         hc,
+		version:    version,
+		gitLimiter: newGitLimiter(config.Web.GitRateLimit),
+	}
+}
+
+// Serve the admin pages from the database and scraper of an instance that's
+// become the leader. Until then, and after Detach, they're unavailable.
+func (web *Web) Attach(db *db.Db, scraper *scrape.Scraper) {
+	web.leaderMutex.Lock()
+	defer web.leaderMutex.Unlock()
+	web.db, web.scraper = db, scraper
+}
+
+// Stop using the database and scraper, once this instance steps down
+func (web *Web) Detach() {
+	web.Attach(nil, nil)
+}
+
+// The database and scraper, if this instance is the leader
+func (web *Web) leader() (database *db.Db, scraper *scrape.Scraper) {
+	web.leaderMutex.RLock()
+	defer web.leaderMutex.RUnlock()
+	return web.db, web.scraper
 }
 
 func (web *Web) Run() {
@@ -73,7 +107,23 @@ func (web *Web) Run() {
 
 	r.GET("/map/:userId/:mapId/versions", web.mapVersions)
 	r.GET("/map/:userId/:mapId/patch/:hash", web.mapPatch)
+	r.GET("/map/:userId/:mapId/compare/:from/:to", web.mapCompare)
 	r.GET("/map/:userId/:mapId/zip/:hash", web.mapZip)
+	r.GET("/map/:userId/:mapId/osz/:hash", web.mapOsz)
+	r.GET("/map/:userId/:mapId/blame/:hash/:beatmapId", web.mapBlame)
+
+	admin := r.Group("/admin", web.requireAdmin, web.requireLeader)
+	admin.GET("/backup", web.adminBackup)
+	admin.POST("/scrape", web.adminScrape)
+	admin.GET("/outbox", web.adminOutbox)
+	admin.GET("/outbox.json", web.adminOutbox)
+	admin.POST("/outbox/:id/retry", web.adminRetryDeadLetter)
+
+	if web.config.Web.GitHttp {
+		git := r.Group("/map/:userId/:mapId", web.gitRateLimit)
+		git.GET("/info/refs", web.gitInfoRefs)
+		git.POST("/"+UPLOAD_PACK, web.gitUploadPack)
+	}
 
 	r.GET("/", func(c *gin.Context) {
 		beatmapSets := web.listRepos()
@@ -101,41 +151,65 @@ func isLoggedIn(c *gin.Context) bool {
 	return loggedIn
 }
 
-func (web *Web) listRepos() []osuapi.Beatmapset {
-	expensive := func() (interface{}, error) {
-		repos := make([]int, 0)
-		reposDir := web.config.Repos
-		users, _ := ioutil.ReadDir(reposDir)
+// Whether the logged in user is listed as an admin in the config
+func (web *Web) isAdmin(c *gin.Context) bool {
+	userId, ok := sessions.Default(c).Get("user_id").(int)
+	if !ok {
+		return false
+	}
+
+	for _, id := range web.config.Web.Admins {
+		if id == userId {
+			return true
+		}
+	}
+	return false
+}
 
-		for _, user := range users {
-			userDir := path.Join(reposDir, user.Name())
-			var maps []os.FileInfo
-			maps, _ = ioutil.ReadDir(userDir)
+// Whether a mapper asked for their repositories not to be served
+func (web *Web) isOptedOut(userId int) bool {
+	for _, id := range web.config.Web.OptOutMappers {
+		if id == userId {
+			return true
+		}
+	}
+	return false
+}
 
-			for _, mapId := range maps {
-				mapDir := path.Join(userDir, mapId.Name())
-				fmt.Println(mapDir)
+func (web *Web) listRepos() []osuapi.Beatmapset {
+	expensive := func() (interface{}, error) {
+		repos, err := web.repos.List()
+		if err != nil {
+			return nil, err
+		}
 
-				id, _ := strconv.Atoi(mapId.Name())
-				repos = append(repos, id)
+		visible := repos[:0]
+		for _, key := range repos {
+			if !web.isOptedOut(key.UserID) {
+				visible = append(visible, key)
 			}
 		}
+		repos = visible
 
 		beatmapSets := make([]osuapi.Beatmapset, len(repos))
 		var wg sync.WaitGroup
-		for i, repo := range repos {
+		for i, key := range repos {
 			wg.Add(1)
-			go func(i int, repo int) {
-				bs, _ := web.api.GetBeatmapSet(repo)
+			go func(i int, mapId int) {
+				bs, _ := web.api.GetBeatmapSet(mapId)
 				beatmapSets[i] = bs
 				wg.Done()
-			}(i, repo)
+			}(i, key.MapID)
 		}
 		wg.Wait()
 
 		return beatmapSets, nil
 	}
 
-	result, _, _ := cache.Memoize("key1", expensive)
+	result, err, _ := cache.Memoize("key1", expensive)
+	if err != nil {
+		log.Println("couldn't list repos:", err)
+		return []osuapi.Beatmapset{}
+	}
 	return result.([]osuapi.Beatmapset)
 }